@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/crypto"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+)
+
+// clientFlags are shared by the commands that talk to a running server.
+type clientFlags struct {
+	addr       string
+	key        string
+	tenant     string
+	token      string
+	adminToken string
+	format     string
+	timeout    time.Duration
+}
+
+func (f *clientFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.addr, "a", "localhost:8080", "server address")
+	fs.StringVar(&f.key, "k", "", "key to sign requests with")
+	fs.StringVar(&f.tenant, "tenant", "", "tenant, sent as "+tenant.Header)
+	fs.StringVar(&f.token, "token", "", "tenant bearer token")
+	fs.StringVar(&f.adminToken, "admin-token", "", "admin API token, needed by delete")
+	fs.StringVar(&f.format, "format", string(outputTable), "table, json or prom")
+	fs.DurationVar(&f.timeout, "timeout", 10*time.Second, "request timeout")
+}
+
+func (f *clientFlags) client() *client {
+	base := f.addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return &client{
+		base:       strings.TrimSuffix(base, "/"),
+		key:        f.key,
+		tenant:     f.tenant,
+		token:      f.token,
+		adminToken: f.adminToken,
+		http:       &http.Client{Timeout: f.timeout},
+		// A stream stays open until the server or the user ends it.
+		stream: &http.Client{},
+	}
+}
+
+// client speaks the server's JSON API the way the agent does: bodies are
+// gzip'd and signed with HashSHA256 over the uncompressed JSON.
+type client struct {
+	base       string
+	key        string
+	tenant     string
+	token      string
+	adminToken string
+	http       *http.Client
+	stream     *http.Client
+}
+
+type apiError struct {
+	status string
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.status + ": " + e.msg
+}
+
+// errorMessage returns the message of an ErrorResponse body, or the body
+// itself.
+func errorMessage(body []byte) string {
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		return e.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// authorize sets the bearer token, the admin one if admin is set, and the
+// tenant of a request.
+func (c *client) authorize(req *http.Request, admin bool) {
+	switch {
+	case admin:
+		req.Header.Set("Authorization", "Bearer "+c.adminToken)
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.tenant != "" {
+		req.Header.Set(tenant.Header, c.tenant)
+	}
+}
+
+func (c *client) do(ctx context.Context, method, path string, body any, admin bool, out any) error {
+	var reader io.Reader
+	var hash string
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		if c.key != "" {
+			hash = crypto.ComputeHMACSHA256(string(data), c.key)
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err = gz.Write(data)
+		if err == nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("cant compress request: %w", err)
+		}
+		reader = &buf
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if hash != "" {
+		req.Header.Set("HashSHA256", hash)
+	}
+	c.authorize(req, admin)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cant read response: %w", err)
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return &apiError{status: resp.Status, msg: errorMessage(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		return fmt.Errorf("cant decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *client) get(ctx context.Context, t model.MetricType, id string) (model.Metric, error) {
+	var m model.Metric
+	err := c.do(ctx, http.MethodPost, "/value/", model.Metric{ID: id, Type: t}, false, &m)
+	return m, err
+}
+
+// list follows the pages of /api/v1/metrics.
+func (c *client) list(ctx context.Context, t model.MetricType, prefix string) ([]model.Metric, error) {
+	var metrics []model.Metric
+	cursor := ""
+	for {
+		q := url.Values{"limit": {"1000"}}
+		if t != "" {
+			q.Set("type", string(t))
+		}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		var page struct {
+			Metrics    []model.Metric `json:"metrics"`
+			NextCursor string         `json:"next_cursor"`
+		}
+		err := c.do(ctx, http.MethodGet, "/api/v1/metrics?"+q.Encode(), nil, false, &page)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, page.Metrics...)
+		if page.NextCursor == "" {
+			return metrics, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// push sends one metric to /update/ and several to /updates/.
+func (c *client) push(ctx context.Context, metrics []model.Metric) error {
+	switch len(metrics) {
+	case 0:
+		return errors.New("nothing to push")
+	case 1:
+		return c.do(ctx, http.MethodPost, "/update/", metrics[0], false, nil)
+	}
+	return c.do(ctx, http.MethodPost, "/updates/", metrics, false, nil)
+}
+
+func (c *client) delete(ctx context.Context, t model.MetricType, id string) error {
+	path := fmt.Sprintf("/value/%s/%s", url.PathEscape(string(t)), url.PathEscape(id))
+	if c.tenant != "" {
+		path += "?tenant=" + url.QueryEscape(c.tenant)
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, true, nil)
+}
+
+// watch follows the server-sent events of /api/v1/stream and calls fn for
+// every metric until ctx is done, fn fails or the server ends the stream.
+func (c *client) watch(ctx context.Context, prefix string, fn func(model.Metric) error) error {
+	path := "/api/v1/stream"
+	if prefix != "" {
+		path += "?prefix=" + url.QueryEscape(prefix)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	c.authorize(req, false)
+
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		data, _ := io.ReadAll(resp.Body)
+		return &apiError{status: resp.Status, msg: errorMessage(data)}
+	}
+
+	var event string
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			// Lines starting with a colon are comments, the server sends
+			// them as heartbeats.
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				data = append(data, value)
+			}
+			continue
+		}
+		payload := []byte(strings.Join(data, "\n"))
+		switch event {
+		case "metric":
+			var m model.Metric
+			err := json.Unmarshal(payload, &m)
+			if err != nil {
+				return fmt.Errorf("cant decode metric: %w", err)
+			}
+			err = fn(m)
+			if err != nil {
+				return err
+			}
+		case "error":
+			return fmt.Errorf("stream closed by server: %s", errorMessage(payload))
+		}
+		event, data = "", nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cant read stream: %w", err)
+	}
+	return errors.New("stream closed by server")
+}
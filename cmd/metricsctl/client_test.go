@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/crypto"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// request is what fakeAPI saw of a request, the body decompressed.
+type request struct {
+	method string
+	uri    string
+	header http.Header
+	body   []byte
+}
+
+// fakeAPI records the requests it gets and answers them with handle, which
+// is given the decompressed body.
+type fakeAPI struct {
+	t        *testing.T
+	mu       sync.Mutex
+	requests []request
+	handle   func(w http.ResponseWriter, r *http.Request, body []byte)
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(f.t, err)
+		body, err = io.ReadAll(gz)
+		require.NoError(f.t, err)
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, request{
+		method: r.Method,
+		uri:    r.URL.RequestURI(),
+		header: r.Header.Clone(),
+		body:   body,
+	})
+	f.mu.Unlock()
+	if f.handle != nil {
+		f.handle(w, r, body)
+	}
+}
+
+func newFakeAPI(t *testing.T, handle func(w http.ResponseWriter, r *http.Request, body []byte)) (*fakeAPI, string) {
+	fake := &fakeAPI{t: t, handle: handle}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv.URL
+}
+
+func TestClient_Get(t *testing.T) {
+	fake, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		var m model.Metric
+		require.NoError(t, json.Unmarshal(body, &m))
+		m.Value = float64Ptr(1.5)
+		json.NewEncoder(w).Encode(m)
+	})
+
+	var buf bytes.Buffer
+	err := runGet(&buf, []string{
+		"-a", addr, "-k", "secret", "-tenant", "acme", "-token", "tok", "-format", "json",
+		"gauge", "Alloc", "Sys",
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"id":"Alloc","type":"gauge","value":1.5},
+		{"id":"Sys","type":"gauge","value":1.5}
+	]`, buf.String())
+
+	require.Len(t, fake.requests, 2)
+	req := fake.requests[0]
+	assert.Equal(t, http.MethodPost, req.method)
+	assert.Equal(t, "/value/", req.uri)
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge"}`, string(req.body))
+	assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+	assert.Equal(t, crypto.ComputeHMACSHA256(string(req.body), "secret"), req.header.Get("HashSHA256"))
+	assert.Equal(t, "Bearer tok", req.header.Get("Authorization"))
+	assert.Equal(t, "acme", req.header.Get(tenant.Header))
+}
+
+func TestClient_GetUnsigned(t *testing.T) {
+	fake, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		fmt.Fprint(w, `{"id":"PollCount","type":"counter","delta":7}`)
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, runGet(&buf, []string{"-a", addr, "-format", "prom", "counter", "PollCount"}))
+	assert.Equal(t, "# TYPE PollCount counter\nPollCount 7\n", buf.String())
+
+	require.Len(t, fake.requests, 1)
+	req := fake.requests[0]
+	assert.Empty(t, req.header.Get("HashSHA256"))
+	assert.Empty(t, req.header.Get("Authorization"))
+	assert.Empty(t, req.header.Get(tenant.Header))
+}
+
+func TestClient_List(t *testing.T) {
+	fake, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		if r.URL.Query().Get("cursor") == "" {
+			fmt.Fprint(w, `{"metrics":[{"id":"a","type":"gauge","value":1}],"next_cursor":"a"}`)
+			return
+		}
+		fmt.Fprint(w, `{"metrics":[{"id":"b","type":"gauge","value":2}]}`)
+	})
+
+	var buf bytes.Buffer
+	err := runList(&buf, []string{"-a", addr, "-format", "prom", "-type", "gauge", "-prefix", "cpu"})
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE a gauge\na 1\n# TYPE b gauge\nb 2\n", buf.String())
+
+	require.Len(t, fake.requests, 2)
+	assert.Equal(t, http.MethodGet, fake.requests[0].method)
+	assert.Equal(t, "/api/v1/metrics?limit=1000&prefix=cpu&type=gauge", fake.requests[0].uri)
+	assert.Equal(t, "/api/v1/metrics?cursor=a&limit=1000&prefix=cpu&type=gauge", fake.requests[1].uri)
+}
+
+func TestClient_Push(t *testing.T) {
+	fake, addr := newFakeAPI(t, nil)
+
+	require.NoError(t, runPush([]string{"-a", addr, "-k", "secret", "gauge", "Alloc=1.5"}))
+	require.NoError(t, runPush([]string{"-a", addr, "counter", "a=1", "b=-2"}))
+	assert.Error(t, runPush([]string{"-a", addr, "counter", "a=1.5"}))
+	assert.Error(t, runPush([]string{"-a", addr, "gauge", "Alloc"}))
+
+	require.Len(t, fake.requests, 2)
+	single := fake.requests[0]
+	assert.Equal(t, "/update/", single.uri)
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":1.5}`, string(single.body))
+	assert.Equal(t, crypto.ComputeHMACSHA256(string(single.body), "secret"), single.header.Get("HashSHA256"))
+
+	batch := fake.requests[1]
+	assert.Equal(t, "/updates/", batch.uri)
+	assert.JSONEq(t, `[
+		{"id":"a","type":"counter","delta":1},
+		{"id":"b","type":"counter","delta":-2}
+	]`, string(batch.body))
+}
+
+func TestClient_Delete(t *testing.T) {
+	fake, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	err := runDelete([]string{
+		"-a", addr, "-token", "tok", "-admin-token", "admin", "-tenant", "acme",
+		"counter", "http requests",
+	})
+	require.NoError(t, err)
+
+	require.Len(t, fake.requests, 1)
+	req := fake.requests[0]
+	assert.Equal(t, http.MethodDelete, req.method)
+	assert.Equal(t, "/value/counter/http%20requests?tenant=acme", req.uri)
+	// The admin token replaces the tenant's.
+	assert.Equal(t, "Bearer admin", req.header.Get("Authorization"))
+	assert.Empty(t, req.body)
+}
+
+func TestClient_APIError(t *testing.T) {
+	_, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		if r.URL.Path == "/update/" {
+			http.Error(w, "invalid metric", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":"metric not found"}`)
+	})
+
+	err := runGet(io.Discard, []string{"-a", addr, "gauge", "Alloc"})
+	var apiErr *apiError
+	require.ErrorAs(t, err, &apiErr)
+	assert.EqualError(t, err, "cant get Alloc: 404 Not Found: metric not found")
+
+	err = runPush([]string{"-a", addr, "gauge", "Alloc=1"})
+	assert.EqualError(t, err, "400 Bad Request: invalid metric")
+}
+
+func TestClient_Watch(t *testing.T) {
+	fake, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": ping\n\n")
+		fmt.Fprint(w, "event: metric\ndata: {\"id\":\"cpu.a\",\"type\":\"gauge\",\"value\":1}\n\n")
+		fmt.Fprint(w, "event: metric\ndata: {\"id\":\"cpu.b\",\"type\":\"counter\",\"delta\":2}\n\n")
+		fmt.Fprint(w, "event: metric\ndata: {\"id\":\"cpu.c\",\"type\":\"gauge\",\"value\":3}\n\n")
+	})
+
+	var buf bytes.Buffer
+	err := runWatch(&buf, []string{
+		"-a", addr, "-token", "tok", "-tenant", "acme", "-format", "json",
+		"-type", "gauge", "-prefix", "cpu.",
+	})
+	assert.EqualError(t, err, "stream closed by server")
+	assert.Equal(t, `{"id":"cpu.a","type":"gauge","value":1}`+"\n"+
+		`{"id":"cpu.c","type":"gauge","value":3}`+"\n", buf.String())
+
+	require.Len(t, fake.requests, 1)
+	req := fake.requests[0]
+	assert.Equal(t, http.MethodGet, req.method)
+	assert.Equal(t, "/api/v1/stream?prefix=cpu.", req.uri)
+	assert.Equal(t, "text/event-stream", req.header.Get("Accept"))
+	assert.Equal(t, "Bearer tok", req.header.Get("Authorization"))
+	assert.Equal(t, "acme", req.header.Get(tenant.Header))
+}
+
+func TestClient_WatchError(t *testing.T) {
+	_, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		fmt.Fprint(w, "event: metric\ndata: {\"id\":\"a\",\"type\":\"gauge\",\"value\":1}\n\n")
+		fmt.Fprint(w, "event: error\ndata: {\"error\":\"subscriber too slow\"}\n\n")
+	})
+
+	var got []model.Metric
+	c := (&clientFlags{addr: addr}).client()
+	err := c.watch(context.Background(), "", func(m model.Metric) error {
+		got = append(got, m)
+		return nil
+	})
+	assert.EqualError(t, err, "stream closed by server: subscriber too slow")
+	require.Len(t, got, 1)
+	assert.Equal(t, "a", got[0].ID)
+}
+
+func TestClient_WatchStop(t *testing.T) {
+	_, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		fmt.Fprint(w, "event: metric\ndata: {\"id\":\"a\",\"type\":\"gauge\",\"value\":1}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := (&clientFlags{addr: addr}).client()
+	err := c.watch(ctx, "", func(m model.Metric) error {
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClient_WatchUnsupported(t *testing.T) {
+	_, addr := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, _ []byte) {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, `{"error":"storage has no change feed"}`)
+	})
+
+	c := (&clientFlags{addr: addr}).client()
+	err := c.watch(context.Background(), "", func(model.Metric) error { return nil })
+	assert.EqualError(t, err, "501 Not Implemented: storage has no change feed")
+}
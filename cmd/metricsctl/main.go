@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/randomtoy/gometrics/internal/db"
+	"github.com/randomtoy/gometrics/internal/dump"
+	"github.com/randomtoy/gometrics/internal/filestorage"
+	"github.com/randomtoy/gometrics/internal/memorystorage"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tsdb"
+	"go.uber.org/zap"
+)
+
+const usage = `usage: metricsctl <command> [flags] [args]
+
+storage commands:
+  export   write every metric and its history to a file
+  import   load metrics from a file, setting counters to the stored total
+
+server commands:
+  get <gauge|counter> <name>...               print metrics
+  list                                        print every metric
+  push <gauge|counter> <name>=<value>...      write metrics
+  watch                                       print metrics as they change
+  delete <gauge|counter> <name>...            delete metrics, needs -admin-token
+
+Run metricsctl <command> -h for the flags of a command.
+`
+
+// backendFlags selects the storage like the server does: a DSN wins over a
+// tsdb directory, which wins over a snapshot file.
+type backendFlags struct {
+	dsn      string
+	tsdbPath string
+	filePath string
+	format   string
+}
+
+func (b *backendFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&b.dsn, "d", "", "database dsn")
+	fs.StringVar(&b.tsdbPath, "tsdb-path", "", "embedded tsdb directory")
+	fs.StringVar(&b.filePath, "f", "", "file storage path")
+	fs.StringVar(&b.format, "format", string(dump.FormatJSONL), "jsonl, csv or snapshot")
+}
+
+func (b *backendFlags) check() error {
+	if b.dsn == "" && b.tsdbPath == "" && b.filePath == "" {
+		return errors.New("one of -d, -tsdb-path or -f is required")
+	}
+	return nil
+}
+
+// openSource opens the storage read-only for export. Nothing runs in the
+// background and migrations are left to the server.
+func (b *backendFlags) openSource(l *zap.Logger) (dump.Source, func(), error) {
+	if err := b.check(); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case b.dsn != "":
+		conn, err := db.NewDBConnector(b.dsn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cant connect to database: %w", err)
+		}
+		return conn, conn.Close, nil
+	case b.tsdbPath != "":
+		store, err := tsdb.OpenReadOnly(l.Sugar(), b.tsdbPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store.Close, nil
+	}
+	// A missing file would be exported as empty.
+	if _, err := os.Stat(b.filePath); err != nil {
+		return nil, nil, err
+	}
+	mem := memorystorage.NewInMemoryStorage(l.Sugar(), b.filePath)
+	err := filestorage.NewFileStorage(l.Sugar(), mem, b.filePath).LoadFromFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	return mem, func() {}, nil
+}
+
+// openSink opens the storage for import. The returned func closes it,
+// saving file storage once.
+func (b *backendFlags) openSink(l *zap.Logger) (dump.Sink, func() error, error) {
+	if err := b.check(); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case b.dsn != "":
+		conn, err := db.NewDBConnector(b.dsn)
+		if err == nil {
+			err = conn.InitDB()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("cant open database: %w", err)
+		}
+		return conn, func() error { conn.Close(); return nil }, nil
+	case b.tsdbPath != "":
+		store, err := tsdb.Open(l.Sugar(), b.tsdbPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, func() error { store.Close(); return nil }, nil
+	}
+	mem := memorystorage.NewInMemoryStorage(l.Sugar(), b.filePath)
+	fs := filestorage.NewFileStorage(l.Sugar(), mem, b.filePath)
+	err := fs.LoadFromFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	return mem, fs.SaveToFile, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	log, err := zap.NewProduction()
+	if err != nil {
+		panic(err)
+	}
+	defer log.Sync()
+
+	switch os.Args[1] {
+	case "export":
+		err = runExport(log, os.Args[2:])
+	case "import":
+		err = runImport(log, os.Args[2:])
+	case "get":
+		err = runGet(os.Stdout, os.Args[2:])
+	case "list":
+		err = runList(os.Stdout, os.Args[2:])
+	case "push":
+		err = runPush(os.Args[2:])
+	case "watch":
+		err = runWatch(os.Stdout, os.Args[2:])
+	case "delete":
+		err = runDelete(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "metricsctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func runExport(l *zap.Logger, args []string) error {
+	var b backendFlags
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	b.register(fs)
+	out := fs.String("o", "-", "output file, - for stdout")
+	history := fs.Bool("history", true, "export the history of each metric")
+	fs.Parse(args)
+
+	format, err := dump.ParseFormat(b.format)
+	if err != nil {
+		return err
+	}
+	store, closeStore, err := b.openSource(l)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("cant create output: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	dw, err := dump.NewWriter(format, w)
+	if err != nil {
+		return err
+	}
+	n, err := dump.Export(context.Background(), store, dw, *history)
+	if err != nil {
+		return err
+	}
+	l.Sugar().Infof("exported %d metrics", n)
+	return nil
+}
+
+func runImport(l *zap.Logger, args []string) error {
+	var b backendFlags
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	b.register(fs)
+	in := fs.String("i", "-", "input file, - for stdin")
+	fs.Parse(args)
+
+	format, err := dump.ParseFormat(b.format)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("cant open input: %w", err)
+		}
+		defer file.Close()
+		r = file
+	}
+	dr, err := dump.NewReader(format, r)
+	if err != nil {
+		return err
+	}
+	store, closeStore, err := b.openSink(l)
+	if err != nil {
+		return err
+	}
+	n, err := dump.Import(context.Background(), store, dr)
+	// Closing saves file storage, even what was imported before an error.
+	if cerr := closeStore(); cerr != nil {
+		return fmt.Errorf("cant close storage: %w", cerr)
+	}
+	if err != nil {
+		return fmt.Errorf("%w (%d metrics imported)", err, n)
+	}
+	l.Sugar().Infof("imported %d metrics", n)
+	return nil
+}
+
+// parseTyped reads the metric type and names of get and delete.
+func parseTyped(args []string) (model.MetricType, []string, error) {
+	if len(args) < 2 {
+		return "", nil, errors.New("want <gauge|counter> <name>...")
+	}
+	t := model.MetricType(args[0])
+	if t != model.Gauge && t != model.Counter {
+		return "", nil, fmt.Errorf("unknown metric type %q", args[0])
+	}
+	return t, args[1:], nil
+}
+
+func runGet(w io.Writer, args []string) error {
+	var f clientFlags
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	f.register(fs)
+	fs.Parse(args)
+
+	o, err := parseOutput(f.format)
+	if err != nil {
+		return err
+	}
+	t, names, err := parseTyped(fs.Args())
+	if err != nil {
+		return err
+	}
+	c := f.client()
+	metrics := make([]model.Metric, 0, len(names))
+	for _, name := range names {
+		m, err := c.get(context.Background(), t, name)
+		if err != nil {
+			return fmt.Errorf("cant get %s: %w", name, err)
+		}
+		metrics = append(metrics, m)
+	}
+	return writeMetrics(w, o, metrics)
+}
+
+func runList(w io.Writer, args []string) error {
+	var f clientFlags
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	f.register(fs)
+	t := fs.String("type", "", "only list metrics of this type")
+	prefix := fs.String("prefix", "", "only list metrics starting with prefix")
+	fs.Parse(args)
+
+	o, err := parseOutput(f.format)
+	if err != nil {
+		return err
+	}
+	metrics, err := f.client().list(context.Background(), model.MetricType(*t), *prefix)
+	if err != nil {
+		return err
+	}
+	return writeMetrics(w, o, metrics)
+}
+
+func runPush(args []string) error {
+	var f clientFlags
+	fs := flag.NewFlagSet("push", flag.ExitOnError)
+	f.register(fs)
+	fs.Parse(args)
+
+	t, pairs, err := parseTyped(fs.Args())
+	if err != nil {
+		return errors.New("want <gauge|counter> <name>=<value>...")
+	}
+	metrics := make([]model.Metric, 0, len(pairs))
+	for _, pair := range pairs {
+		name, raw, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid metric %q, want name=value", pair)
+		}
+		m := model.Metric{ID: name, Type: t}
+		if t == model.Gauge {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return fmt.Errorf("invalid gauge value of %s: %w", name, err)
+			}
+			m.Value = &v
+		} else {
+			d, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid counter value of %s: %w", name, err)
+			}
+			m.Delta = &d
+		}
+		metrics = append(metrics, m)
+	}
+	return f.client().push(context.Background(), metrics)
+}
+
+func runWatch(w io.Writer, args []string) error {
+	var f clientFlags
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	f.register(fs)
+	t := fs.String("type", "", "only watch metrics of this type")
+	prefix := fs.String("prefix", "", "only watch metrics starting with prefix")
+	fs.Parse(args)
+
+	o, err := parseOutput(f.format)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// The stream can't be filtered by type, the rest is dropped here.
+	err = f.client().watch(ctx, *prefix, func(m model.Metric) error {
+		if *t != "" && m.Type != model.MetricType(*t) {
+			return nil
+		}
+		return writeUpdate(w, o, m)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func runDelete(args []string) error {
+	var f clientFlags
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	f.register(fs)
+	fs.Parse(args)
+
+	t, names, err := parseTyped(fs.Args())
+	if err != nil {
+		return err
+	}
+	c := f.client()
+	for _, name := range names {
+		err = c.delete(context.Background(), t, name)
+		if err != nil {
+			return fmt.Errorf("cant delete %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+)
+
+type output string
+
+const (
+	outputTable output = "table"
+	outputJSON  output = "json"
+	// outputProm is the Prometheus text exposition format.
+	outputProm output = "prom"
+)
+
+func parseOutput(s string) (output, error) {
+	switch o := output(s); o {
+	case outputTable, outputJSON, outputProm:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown format %q, want table, json or prom", s)
+}
+
+func writeMetrics(w io.Writer, o output, metrics []model.Metric) error {
+	switch o {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if metrics == nil {
+			metrics = []model.Metric{}
+		}
+		return enc.Encode(metrics)
+	case outputProm:
+		return writeProm(w, metrics)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tVALUE\tUPDATED")
+	for _, m := range metrics {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.ID, m.Type, m.String(), updated(m))
+	}
+	return tw.Flush()
+}
+
+// writeUpdate prints one metric of a stream as soon as it arrives: a line of
+// JSON, a Prometheus sample or a table row led by the update time.
+func writeUpdate(w io.Writer, o output, m model.Metric) error {
+	switch o {
+	case outputJSON:
+		return json.NewEncoder(w).Encode(m)
+	case outputProm:
+		return writeProm(w, []model.Metric{m})
+	}
+	_, err := fmt.Fprintf(w, "%s  %s  %s  %s\n", updated(m), m.Type, m.ID, m.String())
+	return err
+}
+
+func updated(m model.Metric) string {
+	if m.UpdatedAt == nil {
+		return "-"
+	}
+	return m.UpdatedAt.Local().Format(time.DateTime)
+}
+
+// promInvalid matches what Prometheus does not allow in metric names.
+var promInvalid = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+func promName(id string) string {
+	name := promInvalid.ReplaceAllString(id, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func writeProm(w io.Writer, metrics []model.Metric) error {
+	for _, m := range metrics {
+		name := promName(m.ID)
+		var value string
+		switch m.Type {
+		case model.Counter:
+			value = strconv.FormatInt(m.DerefInt64(m.Delta), 10)
+		default:
+			value = strconv.FormatFloat(m.DerefFloat64(m.Value), 'g', -1, 64)
+		}
+		line := fmt.Sprintf("# TYPE %s %s\n%s %s", name, m.Type, name, value)
+		if m.UpdatedAt != nil {
+			line += " " + strconv.FormatInt(m.UpdatedAt.UnixMilli(), 10)
+		}
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+func int64Ptr(v int64) *int64       { return &v }
+
+func testMetrics() []model.Metric {
+	at := time.UnixMilli(1700000000123)
+	return []model.Metric{
+		{ID: "Alloc", Type: model.Gauge, Value: float64Ptr(1.5), UpdatedAt: &at},
+		{ID: "http.requests-total", Type: model.Counter, Delta: int64Ptr(42)},
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	local := time.UnixMilli(1700000000123).Local().Format(time.DateTime)
+	tests := []struct {
+		name    string
+		output  output
+		metrics []model.Metric
+		want    string
+	}{
+		{
+			name:    "table",
+			output:  outputTable,
+			metrics: testMetrics(),
+			want: "ID                   TYPE     VALUE  UPDATED\n" +
+				"Alloc                gauge    1.5    " + local + "\n" +
+				"http.requests-total  counter  42     -\n",
+		},
+		{
+			name:    "json",
+			output:  outputJSON,
+			metrics: testMetrics(),
+			want: `[
+  {
+    "id": "Alloc",
+    "type": "gauge",
+    "value": 1.5,
+    "updated_at": "` + time.UnixMilli(1700000000123).Format(time.RFC3339Nano) + `"
+  },
+  {
+    "id": "http.requests-total",
+    "type": "counter",
+    "delta": 42
+  }
+]
+`,
+		},
+		{
+			name:   "empty json",
+			output: outputJSON,
+			want:   "[]\n",
+		},
+		{
+			name:    "prom",
+			output:  outputProm,
+			metrics: testMetrics(),
+			want: "# TYPE Alloc gauge\nAlloc 1.5 1700000000123\n" +
+				"# TYPE http_requests_total counter\nhttp_requests_total 42\n",
+		},
+		{
+			name:    "prom name starting with a digit",
+			output:  outputProm,
+			metrics: []model.Metric{{ID: "5xx", Type: model.Counter, Delta: int64Ptr(1)}},
+			want:    "# TYPE _5xx counter\n_5xx 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, writeMetrics(&buf, tt.output, tt.metrics))
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestWriteUpdate(t *testing.T) {
+	m := testMetrics()[0]
+	local := m.UpdatedAt.Local().Format(time.DateTime)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeUpdate(&buf, outputTable, m))
+	assert.Equal(t, local+"  gauge  Alloc  1.5\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeUpdate(&buf, outputJSON, m))
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":1.5,"updated_at":"`+
+		m.UpdatedAt.Format(time.RFC3339Nano)+`"}`, buf.String())
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("\n")))
+
+	buf.Reset()
+	require.NoError(t, writeUpdate(&buf, outputProm, m))
+	assert.Equal(t, "# TYPE Alloc gauge\nAlloc 1.5 1700000000123\n", buf.String())
+}
+
+func TestParseOutput(t *testing.T) {
+	o, err := parseOutput("prom")
+	require.NoError(t, err)
+	assert.Equal(t, outputProm, o)
+
+	_, err = parseOutput("yaml")
+	assert.Error(t, err)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"github.com/randomtoy/gometrics/internal/config"
 	"github.com/randomtoy/gometrics/internal/handlers"
+	"github.com/randomtoy/gometrics/internal/janitor"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/ratelimit"
 	"github.com/randomtoy/gometrics/internal/server"
 	"github.com/randomtoy/gometrics/internal/storage"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"github.com/randomtoy/gometrics/internal/validation"
 	"go.uber.org/zap"
 )
 
@@ -31,7 +38,47 @@ func main() {
 	}
 	defer store.Close()
 
-	handler := handlers.NewHandler(store, handlers.WithLogger(l))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	overrides, err := janitor.ParseOverrides(conf.Server.ExpireOverrides)
+	if err != nil {
+		panic(err)
+	}
+	expiry := janitor.Policy{TTL: conf.Server.ExpireTTL, Overrides: overrides}
+	if expiry.Enabled() {
+		j := janitor.NewJanitor(l.Sugar(), store, expiry, conf.Server.ExpireInterval)
+		go j.Run(ctx)
+	}
+
+	retention, err := model.ParseRetention(conf.Server.Retention)
+	if err != nil {
+		panic(err)
+	}
+	if retention.Enabled() {
+		c := janitor.NewCompactor(l.Sugar(), store, retention, conf.Server.CompactInterval)
+		go c.Run(ctx)
+	}
+
+	policy := validation.DefaultPolicy()
+	policy.AllowNonFinite = conf.Server.AllowNonFinite
+	hopts := []handlers.Option{
+		handlers.WithLogger(l),
+		handlers.WithValidationPolicy(policy),
+		handlers.WithRetention(retention),
+	}
+	limiter := ratelimit.NewLimiter(ratelimit.Config{
+		Rate:      conf.Server.IngestRate,
+		Burst:     conf.Server.IngestBurst,
+		MaxSeries: conf.Server.ClientSeries,
+	})
+	if limiter.Enabled() {
+		hopts = append(hopts, handlers.WithRateLimiter(limiter))
+	}
+	if conf.Server.WSOrigins != "" {
+		hopts = append(hopts, handlers.WithAllowedOrigins(strings.Split(conf.Server.WSOrigins, ",")))
+	}
+	handler := handlers.NewHandler(store, hopts...)
 
 	opts := []server.Option{}
 
@@ -39,6 +86,12 @@ func main() {
 		fmt.Println("use hmac option")
 		opts = append(opts, server.WithHMAC(conf.Server.Key))
 	}
+	tokens, err := tenant.ParseTokens(conf.Server.TenantTokens)
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, server.WithTenantTokens(tokens), server.WithAdminToken(conf.Server.AdminToken))
+
 	srv := server.NewServer(l.Sugar(), handler, opts...)
 
 	err = srv.Run(conf.Server.Addr)
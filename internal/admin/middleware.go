@@ -0,0 +1,25 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TokenAuth guards the /admin routes. An empty token disables them entirely.
+func TokenAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return c.JSON(http.StatusForbidden, echo.Map{"error": "Admin API is disabled"})
+			}
+			received := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(received), []byte(token)) != 1 {
+				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid admin token"})
+			}
+			return next(c)
+		}
+	}
+}
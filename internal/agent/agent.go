@@ -4,8 +4,13 @@ import (
 	"context"
 	"sync"
 
+	"github.com/randomtoy/gometrics/internal/cgroup"
 	"github.com/randomtoy/gometrics/internal/collector"
+	"github.com/randomtoy/gometrics/internal/ingest"
+	"github.com/randomtoy/gometrics/internal/logtail"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/procstat"
+	"github.com/randomtoy/gometrics/internal/script"
 	"github.com/randomtoy/gometrics/internal/sender"
 	"go.uber.org/zap"
 )
@@ -36,6 +41,42 @@ func (a *Agent) Run() {
 
 	go collector.Run(ctx, &wg)
 	go sender.Run(ctx, &wg)
+	if a.config.IngestAddr != "" || a.config.IngestSocket != "" {
+		wg.Add(1)
+		go ingest.NewListener(a.log, a.config, collector).Run(ctx, &wg)
+	}
+	if len(a.config.ExecCommands) > 0 {
+		wg.Add(1)
+		go script.NewSource(a.log, a.config, collector).Run(ctx, &wg)
+	}
+	if a.config.LogConfig != "" {
+		logs, err := logtail.NewSource(a.log, a.config, collector)
+		if err != nil {
+			a.log.Errorf("log collector disabled: %v", err)
+		} else {
+			wg.Add(1)
+			go logs.Run(ctx, &wg)
+		}
+	}
+	if len(a.config.Processes) > 0 {
+		procs, err := procstat.NewSource(a.log, a.config, collector)
+		if err != nil {
+			a.log.Errorf("process collector disabled: %v", err)
+		} else {
+			wg.Add(1)
+			go procs.Run(ctx, &wg)
+		}
+	}
+	if a.config.CgroupRoot != "" {
+		dir, err := cgroup.Detect(a.config.CgroupRoot, "/proc/self/cgroup")
+		if err != nil {
+			a.log.Infof("cgroup collector disabled: %v", err)
+		} else {
+			a.log.Infof("collecting cgroup metrics from %s", dir)
+			wg.Add(1)
+			go cgroup.NewSource(a.log, a.config, dir, collector).Run(ctx, &wg)
+		}
+	}
 	wg.Wait()
 
 }
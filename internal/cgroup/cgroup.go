@@ -0,0 +1,221 @@
+// Package cgroup reports the usage and limits of the cgroup v2 the agent
+// runs in, which inside a container are what host totals don't show.
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"go.uber.org/zap"
+)
+
+var ErrNotFound = errors.New("no cgroup v2 found")
+
+// Sink receives the metrics of each poll.
+type Sink interface {
+	Ingest(metrics []model.Metric)
+}
+
+// Detect returns the cgroup v2 directory of the process described by
+// procCgroup, usually /proc/self/cgroup, under root. With a cgroup
+// namespace the process sees its own cgroup as the root.
+func Detect(root, procCgroup string) (string, error) {
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	var candidates []string
+	data, err := os.ReadFile(procCgroup)
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			// The unified hierarchy is the 0:: line.
+			if path, ok := strings.CutPrefix(line, "0::"); ok {
+				candidates = append(candidates, filepath.Join(root, filepath.Clean("/"+path)))
+			}
+		}
+	}
+	candidates = append(candidates, root)
+	for _, dir := range candidates {
+		// The host's root cgroup has no memory.current, it isn't a limit.
+		_, err = os.Stat(filepath.Join(dir, "memory.current"))
+		if err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no memory.current under %s", ErrNotFound, root)
+}
+
+// Source reads memory.current, memory.max, cpu.stat, io.stat, pids.current
+// and pids.max. Files of controllers not enabled are skipped, as are
+// unlimited maximums.
+type Source struct {
+	log      *zap.SugaredLogger
+	dir      string
+	interval time.Duration
+	sink     Sink
+
+	// lastUsage and lastTime give CPU % since the previous poll.
+	lastUsage float64
+	lastTime  time.Time
+}
+
+func NewSource(l *zap.SugaredLogger, config model.AgentConfig, dir string, sink Sink) *Source {
+	s := &Source{
+		log:      l,
+		dir:      dir,
+		interval: time.Duration(config.PollInterval) * time.Second,
+		sink:     sink,
+	}
+	if s.interval <= 0 {
+		s.interval = 2 * time.Second
+	}
+	return s
+}
+
+func (s *Source) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sink.Ingest(s.collect(time.Now()))
+		}
+	}
+}
+
+func (s *Source) collect(now time.Time) []model.Metric {
+	values := make(map[string]float64)
+	s.readValue(values, "memory.current", "CgroupMemoryCurrent")
+	s.readValue(values, "memory.max", "CgroupMemoryMax")
+	s.readValue(values, "pids.current", "CgroupPidsCurrent")
+	s.readValue(values, "pids.max", "CgroupPidsMax")
+
+	cpu, err := s.readKeyed("cpu.stat")
+	if err == nil {
+		for key, name := range map[string]string{
+			"usage_usec":     "CgroupCPUUsageUsec",
+			"user_usec":      "CgroupCPUUserUsec",
+			"system_usec":    "CgroupCPUSystemUsec",
+			"nr_throttled":   "CgroupCPUThrottled",
+			"throttled_usec": "CgroupCPUThrottledUsec",
+		} {
+			if v, ok := cpu[key]; ok {
+				values[name] = v
+			}
+		}
+		if usage, ok := cpu["usage_usec"]; ok {
+			if !s.lastTime.IsZero() && now.After(s.lastTime) {
+				elapsed := float64(now.Sub(s.lastTime).Microseconds())
+				values["CgroupCPUPercent"] = max(usage-s.lastUsage, 0) / elapsed * 100
+			}
+			s.lastUsage, s.lastTime = usage, now
+		}
+	} else {
+		s.skip("cpu.stat", err)
+	}
+
+	io, err := s.readIO()
+	if err == nil {
+		for key, name := range map[string]string{
+			"rbytes": "CgroupIOReadBytes",
+			"wbytes": "CgroupIOWriteBytes",
+			"rios":   "CgroupIOReadOps",
+			"wios":   "CgroupIOWriteOps",
+		} {
+			values[name] = io[key]
+		}
+	} else {
+		s.skip("io.stat", err)
+	}
+
+	metrics := make([]model.Metric, 0, len(values))
+	for name, v := range values {
+		metrics = append(metrics, model.Metric{ID: name, Type: model.Gauge, Value: &v})
+	}
+	return metrics
+}
+
+func (s *Source) skip(file string, err error) {
+	if !errors.Is(err, os.ErrNotExist) {
+		s.log.Warnf("cant read %s: %v", file, err)
+	}
+}
+
+// readValue reads a single value file, "max" meaning unlimited.
+func (s *Source) readValue(values map[string]float64, file, name string) {
+	data, err := os.ReadFile(filepath.Join(s.dir, file))
+	if err != nil {
+		s.skip(file, err)
+		return
+	}
+	raw := string(bytes.TrimSpace(data))
+	if raw == "max" {
+		return
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		s.log.Warnf("cant parse %s: %v", file, err)
+		return
+	}
+	values[name] = v
+}
+
+// readKeyed reads "key value" lines such as cpu.stat.
+func (s *Source) readKeyed(file string) (map[string]float64, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, file))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, raw, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err == nil {
+			res[key] = v
+		}
+	}
+	return res, scanner.Err()
+}
+
+// readIO sums the "8:0 rbytes=1 wbytes=2 ..." lines of io.stat over
+// devices.
+func (s *Source) readIO() (map[string]float64, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, "io.stat"))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for _, field := range fields[min(1, len(fields)):] {
+			key, raw, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(raw, 64)
+			if err == nil {
+				res[key] += v
+			}
+		}
+	}
+	return res, scanner.Err()
+}
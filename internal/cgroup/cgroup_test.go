@@ -0,0 +1,99 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeCgroupfs lays out files relative to a temporary root.
+func fakeCgroupfs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return root
+}
+
+func TestDetect(t *testing.T) {
+	root := fakeCgroupfs(t, map[string]string{
+		"cgroup.controllers":                      "cpu io memory pids\n",
+		"system.slice/app.service/memory.current": "1\n",
+		"self": "0::/system.slice/app.service\n",
+	})
+	dir, err := Detect(root, filepath.Join(root, "self"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "system.slice/app.service"), dir)
+
+	// In a cgroup namespace the own cgroup is the root.
+	ns := fakeCgroupfs(t, map[string]string{
+		"cgroup.controllers": "memory\n",
+		"memory.current":     "1\n",
+		"self":               "0::/\n",
+	})
+	dir, err = Detect(ns, filepath.Join(ns, "self"))
+	require.NoError(t, err)
+	assert.Equal(t, ns, dir)
+
+	// The host root cgroup and cgroup v1 are not reported.
+	host := fakeCgroupfs(t, map[string]string{"cgroup.controllers": "memory\n", "self": "0::/\n"})
+	_, err = Detect(host, filepath.Join(host, "self"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = Detect(t.TempDir(), "/nonexistent")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSource_Collect(t *testing.T) {
+	dir := fakeCgroupfs(t, map[string]string{
+		"memory.current": "104857600\n",
+		"memory.max":     "max\n",
+		"pids.current":   "12\n",
+		"pids.max":       "100\n",
+		"cpu.stat":       "usage_usec 1000000\nuser_usec 700000\nsystem_usec 300000\nnr_throttled 2\nthrottled_usec 500\n",
+		"io.stat":        "8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=50 wbytes=0 rios=3 wios=0 dbytes=0 dios=0\n",
+	})
+	s := NewSource(zap.NewNop().Sugar(), model.AgentConfig{}, dir, nil)
+
+	now := time.Now()
+	got := values(s.collect(now))
+	assert.Equal(t, map[string]float64{
+		"CgroupMemoryCurrent":    104857600,
+		"CgroupPidsCurrent":      12,
+		"CgroupPidsMax":          100,
+		"CgroupCPUUsageUsec":     1000000,
+		"CgroupCPUUserUsec":      700000,
+		"CgroupCPUSystemUsec":    300000,
+		"CgroupCPUThrottled":     2,
+		"CgroupCPUThrottledUsec": 500,
+		"CgroupIOReadBytes":      150,
+		"CgroupIOWriteBytes":     200,
+		"CgroupIOReadOps":        4,
+		"CgroupIOWriteOps":       2,
+	}, got)
+
+	// Half a CPU over the next two seconds.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cpu.stat"), []byte("usage_usec 2000000\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.max"), []byte("268435456\n"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "io.stat")))
+	got = values(s.collect(now.Add(2 * time.Second)))
+	assert.InDelta(t, 50, got["CgroupCPUPercent"], 0.001)
+	assert.Equal(t, 268435456.0, got["CgroupMemoryMax"])
+	assert.NotContains(t, got, "CgroupIOReadBytes")
+}
+
+func values(metrics []model.Metric) map[string]float64 {
+	res := make(map[string]float64)
+	for _, m := range metrics {
+		res[m.ID] = *m.Value
+	}
+	return res
+}
@@ -3,6 +3,7 @@ package collector
 import (
 	"context"
 	"fmt"
+	"maps"
 	"math/rand/v2"
 	"runtime"
 	"sync"
@@ -14,11 +15,22 @@ import (
 	"go.uber.org/zap"
 )
 
+// Collector sends a batch every poll. Counters in a batch are totals since
+// the agent started, the sender turns them into deltas.
 type Collector struct {
 	log         *zap.SugaredLogger
 	config      model.AgentConfig
 	metricsChan chan<- []model.Metric
 	pollCount   int64
+
+	mu sync.Mutex
+	// ingested holds gauges pushed by local apps and sources until the next
+	// poll, totals the sum of every counter delta they pushed.
+	ingested map[string]model.Metric
+	totals   map[string]int64
+	// types is the type of every metric polled or ingested so far, the
+	// server would refuse a batch changing one.
+	types map[string]model.MetricType
 }
 
 func NewCollector(log *zap.SugaredLogger, config model.AgentConfig, metricsChan chan<- []model.Metric) *Collector {
@@ -27,9 +39,116 @@ func NewCollector(log *zap.SugaredLogger, config model.AgentConfig, metricsChan
 		config:      config,
 		metricsChan: metricsChan,
 		pollCount:   0,
+		ingested:    make(map[string]model.Metric),
+		totals:      make(map[string]int64),
+		types:       make(map[string]model.MetricType),
+	}
+}
+
+// merge adds m to metrics: counters are summed, anything else replaces the
+// stored metric.
+func merge(metrics map[string]model.Metric, m model.Metric) {
+	existing, found := metrics[m.ID]
+	if found && existing.Type == model.Counter && m.Type == model.Counter {
+		d := existing.DerefInt64(existing.Delta) + m.DerefInt64(m.Delta)
+		m.Delta = &d
+	}
+	metrics[m.ID] = m
+}
+
+// Ingest queues metrics for the next batch. Counters carry deltas, which
+// are added to their totals, and the last value of a gauge wins. Metrics
+// changing the type of a known one are dropped.
+func (c *Collector) Ingest(metrics []model.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range metrics {
+		if err := c.conflict(m); err != nil {
+			c.log.Warnf("dropping ingested metric: %v", err)
+			continue
+		}
+		c.add(m)
 	}
 }
 
+// Accept is Ingest for apps, which are told about a type conflict: the
+// whole batch is refused with model.ErrTypeConflict.
+func (c *Collector) Accept(metrics []model.Metric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	batch := make(map[string]model.MetricType, len(metrics))
+	for _, m := range metrics {
+		if t, ok := batch[m.ID]; ok && t != m.Type {
+			return model.TypeConflict(m.ID, t, m.Type)
+		}
+		if err := c.conflict(m); err != nil {
+			return err
+		}
+		batch[m.ID] = m.Type
+	}
+	for _, m := range metrics {
+		c.add(m)
+	}
+	return nil
+}
+
+// conflict reports whether m changes the type of a known metric. Caller
+// must hold mu.
+func (c *Collector) conflict(m model.Metric) error {
+	if t, ok := c.types[m.ID]; ok && t != m.Type {
+		return model.TypeConflict(m.ID, t, m.Type)
+	}
+	return nil
+}
+
+// add queues m. Caller must hold mu.
+func (c *Collector) add(m model.Metric) {
+	c.types[m.ID] = m.Type
+	if m.Type == model.Counter {
+		c.totals[m.ID] += m.DerefInt64(m.Delta)
+		return
+	}
+	c.ingested[m.ID] = m
+}
+
+// withIngested merges the queued gauges and every ingested counter total
+// into a polled batch.
+func (c *Collector) withIngested(polled []model.Metric) []model.Metric {
+	c.mu.Lock()
+	// Polled metrics win over ones ingested before their first poll.
+	for _, m := range polled {
+		if t, ok := c.types[m.ID]; ok && t != m.Type {
+			c.log.Warnf("dropping ingested metric: %v", model.TypeConflict(m.ID, m.Type, t))
+			delete(c.ingested, m.ID)
+			delete(c.totals, m.ID)
+		}
+		c.types[m.ID] = m.Type
+	}
+	ingested := c.ingested
+	c.ingested = make(map[string]model.Metric)
+	totals := maps.Clone(c.totals)
+	c.mu.Unlock()
+	if len(ingested) == 0 && len(totals) == 0 {
+		return polled
+	}
+
+	batch := make(map[string]model.Metric, len(polled)+len(ingested)+len(totals))
+	for _, m := range polled {
+		merge(batch, m)
+	}
+	for _, m := range ingested {
+		merge(batch, m)
+	}
+	for id, total := range totals {
+		merge(batch, model.Metric{ID: id, Type: model.Counter, Delta: &total})
+	}
+	metrics := make([]model.Metric, 0, len(batch))
+	for _, m := range batch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
 func (c *Collector) Run(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	ticker := time.NewTicker(time.Duration(c.config.PollInterval) * time.Second)
@@ -40,7 +159,7 @@ func (c *Collector) Run(ctx context.Context, wg *sync.WaitGroup) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			metrics := c.collectMetrics()
+			metrics := c.withIngested(c.collectMetrics())
 			c.metricsChan <- metrics
 		}
 	}
@@ -0,0 +1,66 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCollector_Ingest(t *testing.T) {
+	c := NewCollector(zap.NewNop().Sugar(), model.AgentConfig{}, nil)
+	d1, d2 := int64(2), int64(3)
+	v1, v2 := 1.0, 5.0
+	c.Ingest([]model.Metric{
+		{ID: "Orders", Type: model.Counter, Delta: &d1},
+		{ID: "Queue", Type: model.Gauge, Value: &v1},
+	})
+	c.Ingest([]model.Metric{
+		{ID: "Orders", Type: model.Counter, Delta: &d2},
+		{ID: "Queue", Type: model.Gauge, Value: &v2},
+	})
+
+	pc := int64(1)
+	batch := c.withIngested([]model.Metric{{ID: "PollCount", Type: model.Counter, Delta: &pc}})
+	got := make(map[string]model.Metric)
+	for _, m := range batch {
+		got[m.ID] = m
+	}
+	assert.Len(t, got, 3)
+	assert.Equal(t, int64(5), *got["Orders"].Delta)
+	assert.Equal(t, 5.0, *got["Queue"].Value)
+	assert.Equal(t, int64(1), *got["PollCount"].Delta)
+
+	// Gauges are sent once, counters keep their total.
+	batch = c.withIngested(nil)
+	require.Len(t, batch, 1)
+	assert.Equal(t, int64(5), *batch[0].Delta)
+}
+
+func TestCollector_TypeConflict(t *testing.T) {
+	c := NewCollector(zap.NewNop().Sugar(), model.AgentConfig{}, nil)
+	d := int64(1)
+	v := 2.0
+
+	// A counter ingested before the first poll gives way to the polled gauge.
+	require.NoError(t, c.Accept([]model.Metric{{ID: "Alloc", Type: model.Counter, Delta: &d}}))
+	batch := c.withIngested([]model.Metric{{ID: "Alloc", Type: model.Gauge, Value: &v}})
+	require.Len(t, batch, 1)
+	assert.Equal(t, model.Gauge, batch[0].Type)
+
+	// Apps are told once the type is known, sources are dropped.
+	err := c.Accept([]model.Metric{
+		{ID: "Orders", Type: model.Counter, Delta: &d},
+		{ID: "Alloc", Type: model.Counter, Delta: &d},
+	})
+	assert.ErrorIs(t, err, model.ErrTypeConflict)
+	err = c.Accept([]model.Metric{
+		{ID: "Queue", Type: model.Counter, Delta: &d},
+		{ID: "Queue", Type: model.Gauge, Value: &v},
+	})
+	assert.ErrorIs(t, err, model.ErrTypeConflict)
+	c.Ingest([]model.Metric{{ID: "Alloc", Type: model.Counter, Delta: &d}})
+	assert.Empty(t, c.withIngested(nil))
+}
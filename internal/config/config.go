@@ -4,6 +4,8 @@ import (
 	"flag"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/randomtoy/gometrics/internal/model"
 )
@@ -27,6 +29,21 @@ func parseAgentFlags(config *model.Config) {
 	flag.IntVar(&config.Agent.PollInterval, "p", 2, "poll interval")
 	flag.StringVar(&config.Agent.Key, "k", "", "key")
 	flag.IntVar(&config.Agent.RateLimit, "l", 10, "rate limit")
+	flag.StringVar(&config.Agent.IngestAddr, "ingest-addr", "", "local address accepting metrics from apps")
+	flag.StringVar(&config.Agent.IngestSocket, "ingest-socket", "", "unix socket accepting metrics from apps")
+	flag.StringVar(&config.Agent.IngestToken, "ingest-token", "", "bearer token required from apps, needed for a non-loopback ingest address")
+	flag.Func("exec", "command printing metrics, repeatable", func(s string) error {
+		config.Agent.ExecCommands = append(config.Agent.ExecCommands, s)
+		return nil
+	})
+	flag.IntVar(&config.Agent.ExecInterval, "exec-interval", 10, "interval of exec commands")
+	flag.IntVar(&config.Agent.ExecTimeout, "exec-timeout", 5, "timeout of exec commands")
+	flag.StringVar(&config.Agent.LogConfig, "log-config", "", "rules deriving metrics from log files")
+	flag.Func("process", "alias=name:<regexp>, alias=cmdline:<regexp> or alias=pidfile:<path>, repeatable", func(s string) error {
+		config.Agent.Processes = append(config.Agent.Processes, s)
+		return nil
+	})
+	flag.StringVar(&config.Agent.CgroupRoot, "cgroup-root", model.DefaultCgroupRoot, "cgroup v2 mount, empty disables cgroup metrics")
 
 	flag.Parse()
 }
@@ -63,16 +80,87 @@ func parseAgentEnvironment(config *model.Config) {
 			config.Agent.RateLimit = rateLimit
 		}
 	}
+	ingestAddr, ok := os.LookupEnv("INGEST_ADDRESS")
+	if ok {
+		config.Agent.IngestAddr = ingestAddr
+	}
+	ingestSocket, ok := os.LookupEnv("INGEST_SOCKET")
+	if ok {
+		config.Agent.IngestSocket = ingestSocket
+	}
+	ingestToken, ok := os.LookupEnv("INGEST_TOKEN")
+	if ok {
+		config.Agent.IngestToken = ingestToken
+	}
+	commands, ok := os.LookupEnv("EXEC_COMMANDS")
+	if ok {
+		config.Agent.ExecCommands = splitLines(commands)
+	}
+	execInterval, ok := os.LookupEnv("EXEC_INTERVAL")
+	if ok {
+		interval, err := strconv.Atoi(execInterval)
+		if err == nil {
+			config.Agent.ExecInterval = interval
+		}
+	}
+	execTimeout, ok := os.LookupEnv("EXEC_TIMEOUT")
+	if ok {
+		timeout, err := strconv.Atoi(execTimeout)
+		if err == nil {
+			config.Agent.ExecTimeout = timeout
+		}
+	}
+	logConfig, ok := os.LookupEnv("LOG_CONFIG")
+	if ok {
+		config.Agent.LogConfig = logConfig
+	}
+	processes, ok := os.LookupEnv("PROCESSES")
+	if ok {
+		config.Agent.Processes = splitLines(processes)
+	}
+	cgroupRoot, ok := os.LookupEnv("CGROUP_ROOT")
+	if ok {
+		config.Agent.CgroupRoot = cgroupRoot
+	}
 
 }
 
+// splitLines reads list variables, one non-blank item per line.
+func splitLines(s string) []string {
+	var res []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
 func parseServerFlags(config *model.Config) {
 	flag.StringVar(&config.Server.DatabaseDSN, "d", "", "PGconnection string")
 	flag.StringVar(&config.Server.Addr, "a", "localhost:8080", "endpoint address")
 	flag.IntVar(&config.Server.StoreInterval, "i", 10, "Store metric niterval")
 	flag.StringVar(&config.Server.FilePath, "f", "", "file path")
+	flag.StringVar(&config.Server.TSDBPath, "tsdb-path", "", "directory of the embedded time-series storage")
 	flag.BoolVar(&config.Server.Restore, "r", true, "Restore metrics")
 	flag.StringVar(&config.Server.Key, "k", "", "Key")
+	flag.StringVar(&config.Server.TenantTokens, "tenant-tokens", "", "tenant tokens as token:tenant,token:tenant")
+	flag.StringVar(&config.Server.AdminToken, "admin-token", "", "admin API token")
+	flag.Float64Var(&config.Server.IngestRate, "ingest-rate", 0, "metric updates per second per client, 0 disables")
+	flag.IntVar(&config.Server.IngestBurst, "ingest-burst", 0, "ingestion burst per client, defaults to ingest rate")
+	flag.IntVar(&config.Server.ClientSeries, "max-client-series", 0, "distinct series per client, 0 disables")
+	flag.IntVar(&config.Server.MaxSeries, "max-series", 0, "total series limit, 0 disables")
+	flag.IntVar(&config.Server.MaxPrefixSeries, "max-prefix-series", 0, "series limit per name prefix, 0 disables")
+	flag.StringVar(&config.Server.SeriesOverflow, "series-overflow", "reject", "behavior over series limit: reject, drop or log")
+	flag.BoolVar(&config.Server.AllowNonFinite, "allow-non-finite", false, "accept NaN and Inf gauge values")
+	flag.DurationVar(&config.Server.ExpireTTL, "expire-ttl", 0, "expire series not written for this long, 0 disables")
+	flag.StringVar(&config.Server.ExpireOverrides, "expire-overrides", "", "per-prefix TTLs as prefix=duration,prefix=duration")
+	flag.DurationVar(&config.Server.ExpireInterval, "expire-interval", time.Minute, "how often stale series are expired")
+	flag.IntVar(&config.Server.StreamBuffer, "stream-buffer", 256, "events buffered per stream subscriber before it is dropped")
+	flag.StringVar(&config.Server.Retention, "retention", model.DefaultRetentionSpec, "history retention as raw=duration,resolution=duration,...")
+	flag.DurationVar(&config.Server.CompactInterval, "compact-interval", time.Minute, "how often history is rolled up")
+	flag.StringVar(&config.Server.WSOrigins, "ws-origins", "", "other origins allowed to open the WebSocket stream as origin,origin")
 
 	flag.Parse()
 }
@@ -90,6 +178,10 @@ func parseServerEnvironment(config *model.Config) {
 	if ok {
 		config.Server.FilePath = fsp
 	}
+	tsdb, ok := os.LookupEnv("TSDB_PATH")
+	if ok {
+		config.Server.TSDBPath = tsdb
+	}
 	r, ok := os.LookupEnv("RESTORE")
 	if ok {
 		config.Server.Restore, _ = strconv.ParseBool(r)
@@ -102,4 +194,74 @@ func parseServerEnvironment(config *model.Config) {
 	if ok {
 		config.Server.Key = key
 	}
+	tt, ok := os.LookupEnv("TENANT_TOKENS")
+	if ok {
+		config.Server.TenantTokens = tt
+	}
+	at, ok := os.LookupEnv("ADMIN_TOKEN")
+	if ok {
+		config.Server.AdminToken = at
+	}
+	ir, ok := os.LookupEnv("INGEST_RATE")
+	if ok {
+		config.Server.IngestRate, _ = strconv.ParseFloat(ir, 64)
+	}
+	ib, ok := os.LookupEnv("INGEST_BURST")
+	if ok {
+		config.Server.IngestBurst, _ = strconv.Atoi(ib)
+	}
+	cs, ok := os.LookupEnv("MAX_CLIENT_SERIES")
+	if ok {
+		config.Server.ClientSeries, _ = strconv.Atoi(cs)
+	}
+	ms, ok := os.LookupEnv("MAX_SERIES")
+	if ok {
+		config.Server.MaxSeries, _ = strconv.Atoi(ms)
+	}
+	mps, ok := os.LookupEnv("MAX_PREFIX_SERIES")
+	if ok {
+		config.Server.MaxPrefixSeries, _ = strconv.Atoi(mps)
+	}
+	so, ok := os.LookupEnv("SERIES_OVERFLOW")
+	if ok {
+		config.Server.SeriesOverflow = so
+	}
+	nf, ok := os.LookupEnv("ALLOW_NON_FINITE")
+	if ok {
+		config.Server.AllowNonFinite, _ = strconv.ParseBool(nf)
+	}
+	ttl, ok := os.LookupEnv("EXPIRE_TTL")
+	if ok {
+		config.Server.ExpireTTL, _ = time.ParseDuration(ttl)
+	}
+	eo, ok := os.LookupEnv("EXPIRE_OVERRIDES")
+	if ok {
+		config.Server.ExpireOverrides = eo
+	}
+	ei, ok := os.LookupEnv("EXPIRE_INTERVAL")
+	if ok {
+		interval, err := time.ParseDuration(ei)
+		if err == nil && interval > 0 {
+			config.Server.ExpireInterval = interval
+		}
+	}
+	sb, ok := os.LookupEnv("STREAM_BUFFER")
+	if ok {
+		config.Server.StreamBuffer, _ = strconv.Atoi(sb)
+	}
+	ret, ok := os.LookupEnv("RETENTION")
+	if ok {
+		config.Server.Retention = ret
+	}
+	ci, ok := os.LookupEnv("COMPACT_INTERVAL")
+	if ok {
+		interval, err := time.ParseDuration(ci)
+		if err == nil && interval > 0 {
+			config.Server.CompactInterval = interval
+		}
+	}
+	wso, ok := os.LookupEnv("WS_ORIGINS")
+	if ok {
+		config.Server.WSOrigins = wso
+	}
 }
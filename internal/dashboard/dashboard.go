@@ -0,0 +1,172 @@
+// Package dashboard renders the HTML pages served on / and /metric/:name.
+// Templates and static assets are embedded into the binary.
+package dashboard
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+)
+
+//go:embed templates/*.html
+var templates embed.FS
+
+//go:embed static
+var static embed.FS
+
+// Static holds the assets served under /static/.
+var Static, _ = fs.Sub(static, "static")
+
+var pages = template.Must(template.New("").Funcs(template.FuncMap{
+	"since": since,
+}).ParseFS(templates, "templates/*.html"))
+
+// Sort keys accepted by the index page.
+const (
+	SortName    = "name"
+	SortType    = "type"
+	SortUpdated = "updated"
+)
+
+type Row struct {
+	Name      string
+	Type      model.MetricType
+	Value     string
+	UpdatedAt *time.Time
+}
+
+type IndexPage struct {
+	Rows   []Row
+	Total  int
+	Search string
+	Sort   string
+}
+
+type MetricPage struct {
+	Row
+	Window    time.Duration
+	Sparkline Sparkline
+	Samples   int
+	Min, Max  float64
+}
+
+// Sparkline is an SVG polyline scaled to Width x Height.
+type Sparkline struct {
+	Width, Height int
+	Points        string
+}
+
+// NewIndexPage filters metrics by a case-insensitive substring of the name
+// and sorts them by key. Ties are broken by name so the order is stable.
+func NewIndexPage(metrics map[string]model.Metric, search, key string) IndexPage {
+	page := IndexPage{Total: len(metrics), Search: search, Sort: key}
+	needle := strings.ToLower(search)
+	for _, m := range metrics {
+		if needle != "" && !strings.Contains(strings.ToLower(m.ID), needle) {
+			continue
+		}
+		page.Rows = append(page.Rows, NewRow(m))
+	}
+	sort.Slice(page.Rows, func(i, j int) bool {
+		a, b := page.Rows[i], page.Rows[j]
+		switch key {
+		case SortType:
+			if a.Type != b.Type {
+				return a.Type < b.Type
+			}
+		case SortUpdated:
+			ta, tb := updated(a), updated(b)
+			if !ta.Equal(tb) {
+				return ta.After(tb)
+			}
+		}
+		return a.Name < b.Name
+	})
+	return page
+}
+
+func NewRow(m model.Metric) Row {
+	return Row{Name: m.ID, Type: m.Type, Value: m.String(), UpdatedAt: m.UpdatedAt}
+}
+
+// NewSparkline scales samples into a width x height box. Fewer than two
+// samples produce an empty line.
+func NewSparkline(samples []model.Sample, width, height int) Sparkline {
+	s := Sparkline{Width: width, Height: height}
+	if len(samples) < 2 {
+		return s
+	}
+	lo, hi := bounds(samples)
+	t0 := samples[0].Time
+	span := samples[len(samples)-1].Time.Sub(t0).Seconds()
+	points := make([]string, 0, len(samples))
+	for _, p := range samples {
+		x := 0.0
+		if span > 0 {
+			x = p.Time.Sub(t0).Seconds() / span * float64(width)
+		}
+		y := float64(height) / 2
+		if hi > lo {
+			y = float64(height) - (p.Value-lo)/(hi-lo)*float64(height)
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	s.Points = strings.Join(points, " ")
+	return s
+}
+
+func NewMetricPage(m model.Metric, samples []model.Sample, window time.Duration) MetricPage {
+	page := MetricPage{
+		Row:       NewRow(m),
+		Window:    window,
+		Sparkline: NewSparkline(samples, 600, 120),
+		Samples:   len(samples),
+	}
+	if len(samples) > 0 {
+		page.Min, page.Max = bounds(samples)
+	}
+	return page
+}
+
+func RenderIndex(w io.Writer, page IndexPage) error {
+	return pages.ExecuteTemplate(w, "index.html", page)
+}
+
+func RenderMetric(w io.Writer, page MetricPage) error {
+	return pages.ExecuteTemplate(w, "metric.html", page)
+}
+
+func bounds(samples []model.Sample) (float64, float64) {
+	lo, hi := samples[0].Value, samples[0].Value
+	for _, p := range samples[1:] {
+		lo = min(lo, p.Value)
+		hi = max(hi, p.Value)
+	}
+	return lo, hi
+}
+
+func updated(r Row) time.Time {
+	if r.UpdatedAt == nil {
+		return time.Time{}
+	}
+	return *r.UpdatedAt
+}
+
+// since formats the age of t for the "last updated" column.
+func since(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	d := time.Since(*t)
+	if d < time.Second {
+		return "just now"
+	}
+	return d.Truncate(time.Second).String() + " ago"
+}
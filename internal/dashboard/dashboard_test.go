@@ -0,0 +1,54 @@
+package dashboard
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIndexPage(t *testing.T) {
+	value := float64(1)
+	delta := int64(2)
+	now := time.Now()
+	older := now.Add(-time.Minute)
+	metrics := map[string]model.Metric{
+		"Alloc":     {ID: "Alloc", Type: model.Gauge, Value: &value, UpdatedAt: &older},
+		"PollCount": {ID: "PollCount", Type: model.Counter, Delta: &delta, UpdatedAt: &now},
+		"Frees":     {ID: "Frees", Type: model.Gauge, Value: &value},
+	}
+	names := func(p IndexPage) []string {
+		var res []string
+		for _, r := range p.Rows {
+			res = append(res, r.Name)
+		}
+		return res
+	}
+
+	assert.Equal(t, []string{"Alloc", "Frees", "PollCount"}, names(NewIndexPage(metrics, "", "")))
+	assert.Equal(t, []string{"PollCount", "Alloc", "Frees"}, names(NewIndexPage(metrics, "", SortType)))
+	assert.Equal(t, []string{"PollCount", "Alloc", "Frees"}, names(NewIndexPage(metrics, "", SortUpdated)))
+
+	page := NewIndexPage(metrics, "poll", "")
+	assert.Equal(t, []string{"PollCount"}, names(page))
+	assert.Equal(t, 3, page.Total)
+
+	var buf bytes.Buffer
+	assert.NoError(t, RenderIndex(&buf, page))
+	assert.Contains(t, buf.String(), `href="/metric/PollCount"`)
+}
+
+func TestNewSparkline(t *testing.T) {
+	start := time.Unix(0, 0)
+	samples := []model.Sample{
+		{Time: start, Value: 0},
+		{Time: start.Add(time.Second), Value: 10},
+		{Time: start.Add(2 * time.Second), Value: 5},
+	}
+	s := NewSparkline(samples, 100, 10)
+	assert.Equal(t, "0.0,10.0 50.0,0.0 100.0,5.0", s.Points)
+
+	assert.Empty(t, NewSparkline(samples[:1], 100, 10).Points)
+}
@@ -0,0 +1,20 @@
+// Reloads the page every few seconds while the auto-refresh box is ticked.
+// The choice survives reloads via localStorage.
+(function () {
+  var key = "gometrics.autoRefresh";
+  var interval = 5000;
+  var box = document.getElementById("auto-refresh");
+  var timer = null;
+
+  function update() {
+    localStorage.setItem(key, box.checked ? "1" : "");
+    clearTimeout(timer);
+    if (box.checked) {
+      timer = setTimeout(function () { location.reload(); }, interval);
+    }
+  }
+
+  box.checked = localStorage.getItem(key) === "1";
+  box.addEventListener("change", update);
+  update();
+})();
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"time"
 
 	"github.com/jackc/pgerrcode"
@@ -13,7 +15,10 @@ import (
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/pressly/goose/v3"
 	sqlc "github.com/randomtoy/gometrics/internal/db/sqlc"
+	"github.com/randomtoy/gometrics/internal/dump"
+	"github.com/randomtoy/gometrics/internal/migrations"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
 )
 
 type DBStorage struct {
@@ -45,12 +50,14 @@ func NewDBConnector(dsn string) (*DBStorage, error) {
 	return dbconn, nil
 }
 
+// InitDB applies the migrations embedded in the binary.
 func (db DBStorage) InitDB() error {
 	err := goose.SetDialect("postgres")
 	if err != nil {
 		return fmt.Errorf("cat initialise goose dialect: %w", err)
 	}
-	err = goose.Up(db.DB, "internal/migrations")
+	goose.SetBaseFS(migrations.FS)
+	err = goose.Up(db.DB, ".")
 	if err != nil {
 		return fmt.Errorf("can't apply migrations")
 	}
@@ -58,32 +65,166 @@ func (db DBStorage) InitDB() error {
 }
 
 func (db DBStorage) UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error) {
-	if metric.Type == model.Counter {
-		m, err := db.GetMetric(ctx, metric.ID)
-		if err == nil {
-			metric.Summ(m.Delta)
-		}
+	res, err := db.upsertMetric(ctx, db.Queries, metric)
+	if err != nil {
+		return model.Metric{}, err
 	}
-	err := db.Queries.InsertOrUpdateMetric(ctx, sqlc.InsertOrUpdateMetricParams{
-		ID:    metric.ID,
-		Type:  string(metric.Type),
-		Value: sql.NullFloat64{Float64: metric.DerefFloat64(metric.Value), Valid: metric.Value != nil},
-		Delta: sql.NullInt64{Int64: metric.DerefInt64(metric.Delta), Valid: metric.Delta != nil},
-	})
+	err = db.insertSample(ctx, db.Queries, res.Sample(*res.UpdatedAt), res.ID)
+	if err != nil {
+		return model.Metric{}, err
+	}
+	return res, nil
+}
 
+// upsertMetric writes metric and returns what is stored, counters summed.
+// The type is checked by the statement itself, so concurrent writers of
+// different types can't flip it.
+func (db DBStorage) upsertMetric(ctx context.Context, q *sqlc.Queries, metric model.Metric) (model.Metric, error) {
+	m, err := q.InsertOrUpdateMetric(ctx, sqlc.InsertOrUpdateMetricParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     metric.ID,
+		Type:   string(metric.Type),
+		Value:  sql.NullFloat64{Float64: metric.DerefFloat64(metric.Value), Valid: metric.Value != nil},
+		Delta:  sql.NullInt64{Int64: metric.DerefInt64(metric.Delta), Valid: metric.Delta != nil},
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Metric{}, db.typeConflict(ctx, q, metric)
+	}
 	if err != nil {
 		return model.Metric{}, fmt.Errorf("cant write metric: %w", err)
 	}
+	res := model.Metric{
+		ID:   m.ID,
+		Type: model.MetricType(m.Type),
+	}
+	res.Value = toFloat64Ptr(m.Value)
+	res.Delta = toInt64Ptr(m.Delta)
+	res.Touch(m.UpdatedAt)
+	return res, nil
+}
 
-	res, err := db.GetMetric(ctx, metric.ID)
+// typeConflict builds the error of a write the stored type refused.
+func (db DBStorage) typeConflict(ctx context.Context, q *sqlc.Queries, metric model.Metric) error {
+	stored, err := q.GetMetric(ctx, sqlc.GetMetricParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     metric.ID,
+	})
 	if err != nil {
-		return model.Metric{}, fmt.Errorf("cant get metric after writing: %w", err)
+		return fmt.Errorf("cant get metric after type conflict: %w", err)
 	}
-	return res, nil
+	return model.TypeConflict(metric.ID, model.MetricType(stored.Type), metric.Type)
+}
+
+// PutSeries stores metric as given and replaces the stored samples in the
+// time range of samples, all in one transaction.
+func (db DBStorage) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = db.inTx(tx).putSeries(ctx, metric, samples)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// inTx returns a storage whose queries run in tx.
+func (db DBStorage) inTx(tx *sql.Tx) *DBStorage {
+	return &DBStorage{Queries: db.Queries.WithTx(tx), DB: db.DB}
+}
+
+func (db DBStorage) putSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	if metric.UpdatedAt == nil {
+		metric.Touch(time.Now())
+	}
+	n, err := db.Queries.PutMetric(ctx, sqlc.PutMetricParams{
+		Tenant:    tenant.FromContext(ctx),
+		ID:        metric.ID,
+		Type:      string(metric.Type),
+		Value:     sql.NullFloat64{Float64: metric.DerefFloat64(metric.Value), Valid: metric.Value != nil},
+		Delta:     sql.NullInt64{Int64: metric.DerefInt64(metric.Delta), Valid: metric.Delta != nil},
+		UpdatedAt: *metric.UpdatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("cant write metric: %w", err)
+	}
+	if n == 0 {
+		return db.typeConflict(ctx, db.Queries, metric)
+	}
+	if len(samples) > 0 {
+		err = db.Queries.DeleteSamplesBetween(ctx, sqlc.DeleteSamplesBetweenParams{
+			Tenant: tenant.FromContext(ctx),
+			ID:     metric.ID,
+			Ts:     samples[0].Time,
+			Ts_2:   samples[len(samples)-1].Time,
+		})
+		if err != nil {
+			return fmt.Errorf("cant delete samples: %w", err)
+		}
+	}
+	for _, s := range samples {
+		err = db.insertSample(ctx, db.Queries, s, metric.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backup reads every series in one repeatable read transaction, so the
+// backup is a point in time view while writes go on.
+func (db DBStorage) Backup(ctx context.Context, w dump.Writer) error {
+	tx, err := db.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("can't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = dump.Export(ctx, db.inTx(tx), w, true)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Restore stores the records of r in one transaction, first deleting every
+// series when replace is set.
+func (db DBStorage) Restore(ctx context.Context, r dump.Reader, replace bool) (int, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("can't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	view := db.inTx(tx)
+	if replace {
+		_, err = view.Queries.DeleteAllMetrics(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("cant delete metrics: %w", err)
+		}
+	}
+	n, err := dump.Import(ctx, dump.SinkFuncs{Series: view.putSeries, Rollups: view.putRollups}, r)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("cant commit restore: %w", err)
+	}
+	return n, nil
 }
 
 func (db DBStorage) GetMetric(ctx context.Context, id string) (model.Metric, error) {
-	m, err := db.Queries.GetMetric(ctx, id)
+	m, err := db.Queries.GetMetric(ctx, sqlc.GetMetricParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
 	if err != nil {
 		return model.Metric{}, fmt.Errorf("cant get metric: %w", err)
 	}
@@ -93,12 +234,13 @@ func (db DBStorage) GetMetric(ctx context.Context, id string) (model.Metric, err
 	}
 	metric.Value = toFloat64Ptr(m.Value)
 	metric.Delta = toInt64Ptr(m.Delta)
+	metric.Touch(m.UpdatedAt)
 
 	return metric, nil
 }
 
 func (db *DBStorage) GetAllMetrics(ctx context.Context) (map[string]model.Metric, error) {
-	metricsList, err := db.Queries.GetAllMetrics(ctx)
+	metricsList, err := db.Queries.GetAllMetrics(ctx, tenant.FromContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("cant get all metrics: %w", err)
 	}
@@ -112,15 +254,187 @@ func (db *DBStorage) GetAllMetrics(ctx context.Context) (map[string]model.Metric
 		}
 		metric.Value = toFloat64Ptr(m.Value)
 		metric.Delta = toInt64Ptr(m.Delta)
+		metric.Touch(m.UpdatedAt)
 		metrics[m.ID] = metric
 	}
 
 	return metrics, nil
 }
 
+func (db DBStorage) RetypeMetric(ctx context.Context, id string, t model.MetricType) (model.Metric, error) {
+	m, err := db.GetMetric(ctx, id)
+	if err != nil {
+		return model.Metric{}, err
+	}
+	m = m.Convert(t)
+	n, err := db.Queries.RetypeMetric(ctx, sqlc.RetypeMetricParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     m.ID,
+		Type:   string(m.Type),
+		Value:  sql.NullFloat64{Float64: m.DerefFloat64(m.Value), Valid: m.Value != nil},
+		Delta:  sql.NullInt64{Int64: m.DerefInt64(m.Delta), Valid: m.Delta != nil},
+	})
+	if err != nil {
+		return model.Metric{}, fmt.Errorf("cant retype metric: %w", err)
+	}
+	if n == 0 {
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	// Old samples have the other type's meaning.
+	err = db.Queries.DeleteSamples(ctx, sqlc.DeleteSamplesParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+	})
+	if err != nil {
+		return model.Metric{}, fmt.Errorf("cant delete samples: %w", err)
+	}
+	err = db.Queries.DeleteRollups(ctx, sqlc.DeleteRollupsParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+	})
+	if err != nil {
+		return model.Metric{}, fmt.Errorf("cant delete rollups: %w", err)
+	}
+	return m, nil
+}
+
+func (db DBStorage) DeleteMetric(ctx context.Context, id string) error {
+	n, err := db.Queries.DeleteMetric(ctx, sqlc.DeleteMetricParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+	})
+	if err != nil {
+		return fmt.Errorf("cant delete metric: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	return nil
+}
+
+func (db DBStorage) ExpireMetric(ctx context.Context, id string, before time.Time) (bool, error) {
+	n, err := db.Queries.ExpireMetric(ctx, sqlc.ExpireMetricParams{
+		Tenant:    tenant.FromContext(ctx),
+		ID:        id,
+		UpdatedAt: before,
+	})
+	if err != nil {
+		return false, fmt.Errorf("cant expire metric: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (db DBStorage) DeleteByPrefix(ctx context.Context, prefix string) ([]string, error) {
+	ids, err := db.Queries.DeleteMetricsByPrefix(ctx, sqlc.DeleteMetricsByPrefixParams{
+		Tenant:     tenant.FromContext(ctx),
+		StartsWith: prefix,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant delete metrics by prefix: %w", err)
+	}
+	return ids, nil
+}
+
+// ResetCounter zeroes a counter and records the zero like a write does.
+func (db DBStorage) ResetCounter(ctx context.Context, id string) (model.Metric, error) {
+	r, err := db.Queries.ResetCounter(ctx, sqlc.ResetCounterParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		m, err := db.GetMetric(ctx, id)
+		if err != nil {
+			return model.Metric{}, err
+		}
+		return model.Metric{}, model.TypeConflict(id, m.Type, model.Counter)
+	}
+	if err != nil {
+		return model.Metric{}, fmt.Errorf("cant reset counter: %w", err)
+	}
+	m := model.Metric{
+		ID:   r.ID,
+		Type: model.MetricType(r.Type),
+	}
+	m.Value = toFloat64Ptr(r.Value)
+	m.Delta = toInt64Ptr(r.Delta)
+	m.Touch(r.UpdatedAt)
+	err = db.insertSample(ctx, db.Queries, m.Sample(*m.UpdatedAt), m.ID)
+	if err != nil {
+		return model.Metric{}, err
+	}
+	return m, nil
+}
+
+// listPage is how many rows ListMetrics reads at a time when it filters
+// them by regex.
+const listPage = 1000
+
+// ListMetrics pushes filtering and paging down to Postgres, in byte order
+// like the other backends. The regex is matched in Go, so it has the same
+// RE2 syntax everywhere, and pages are read until the limit is filled.
+func (db *DBStorage) ListMetrics(ctx context.Context, filter model.ListFilter) ([]model.Metric, error) {
+	var re *regexp.Regexp
+	if filter.Regex != "" {
+		var err error
+		re, err = regexp.Compile(filter.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	limit := int64(filter.Limit)
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	page := limit
+	if re != nil {
+		page = max(page, listPage)
+	}
+	metrics := []model.Metric{}
+	after := filter.After
+	for {
+		rows, err := db.Queries.ListMetrics(ctx, sqlc.ListMetricsParams{
+			Tenant: tenant.FromContext(ctx),
+			Type:   string(filter.Type),
+			Prefix: filter.Prefix,
+			After:  after,
+			Lim:    page,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cant list metrics: %w", err)
+		}
+		for _, m := range rows {
+			after = m.ID
+			if re != nil && !re.MatchString(m.ID) {
+				continue
+			}
+			metric := model.Metric{
+				ID:   m.ID,
+				Type: model.MetricType(m.Type),
+			}
+			metric.Value = toFloat64Ptr(m.Value)
+			metric.Delta = toInt64Ptr(m.Delta)
+			metric.Touch(m.UpdatedAt)
+			metrics = append(metrics, metric)
+			if int64(len(metrics)) == limit {
+				return metrics, nil
+			}
+		}
+		if int64(len(rows)) < page {
+			return metrics, nil
+		}
+	}
+}
+
+func (db *DBStorage) ListTenants(ctx context.Context) ([]string, error) {
+	tenants, err := db.Queries.ListTenants(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cant list tenants: %w", err)
+	}
+	return tenants, nil
+}
+
 func (db DBStorage) Close() {
 	if db.DB != nil {
-		fmt.Println("Closing DB cconnection...")
 		db.DB.Close()
 	}
 }
@@ -135,6 +449,9 @@ func (db DBStorage) UpdateMetricBatch(ctx context.Context, metrics []model.Metri
 	for _, metric := range metrics {
 		existing, found := groupedMetrics[metric.ID]
 		if found {
+			if existing.Type != metric.Type {
+				return model.TypeConflict(metric.ID, existing.Type, metric.Type)
+			}
 			if metric.Type == model.Counter {
 				metric.Summ(existing.Delta)
 			}
@@ -170,21 +487,193 @@ func (db *DBStorage) insertBatch(ctx context.Context, gMetrics map[string]model.
 
 	query := db.Queries.WithTx(tx)
 
+	now := time.Now()
 	for _, metric := range gMetrics {
-		if metric.Type == model.Counter {
-			m, err := db.GetMetric(ctx, metric.ID)
-			if err == nil {
-				metric.Summ(m.Delta)
-			}
+		res, err := db.upsertMetric(ctx, query, metric)
+		if err != nil {
+			return err
 		}
-		err := query.InsertOrUpdateMetric(ctx, sqlc.InsertOrUpdateMetricParams{
-			ID:    metric.ID,
-			Type:  string(metric.Type),
-			Value: sql.NullFloat64{Float64: metric.DerefFloat64(metric.Value), Valid: metric.Value != nil},
-			Delta: sql.NullInt64{Int64: metric.DerefInt64(metric.Delta), Valid: metric.Delta != nil},
+		err = db.insertSample(ctx, query, res.Sample(now), res.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DBStorage) insertSample(ctx context.Context, q *sqlc.Queries, s model.Sample, id string) error {
+	err := q.InsertSample(ctx, sqlc.InsertSampleParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+		Ts:     s.Time,
+		Value:  s.Value,
+	})
+	if err != nil {
+		return fmt.Errorf("cant write sample: %w", err)
+	}
+	return nil
+}
+
+func (db DBStorage) GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error) {
+	_, err := db.GetMetric(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Queries.GetSamples(ctx, sqlc.GetSamplesParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+		Ts:     start,
+		Ts_2:   end,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant get samples: %w", err)
+	}
+	samples := make([]model.Sample, 0, len(rows))
+	for _, r := range rows {
+		samples = append(samples, model.Sample{Time: r.Ts, Value: r.Value})
+	}
+	return samples, nil
+}
+
+func (db DBStorage) GetRollups(ctx context.Context, id string, res time.Duration, start, end time.Time) ([]model.Rollup, error) {
+	_, err := db.GetMetric(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Queries.GetRollups(ctx, sqlc.GetRollupsParams{
+		Tenant:     tenant.FromContext(ctx),
+		ID:         id,
+		Resolution: int64(res.Seconds()),
+		Ts:         start,
+		Ts_2:       end,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant get rollups: %w", err)
+	}
+	rollups := make([]model.Rollup, 0, len(rows))
+	for _, r := range rows {
+		rollups = append(rollups, model.Rollup{
+			Time:  r.Ts,
+			Min:   r.Min,
+			Max:   r.Max,
+			Avg:   r.Avg,
+			Last:  r.Last,
+			Count: r.Count,
 		})
+	}
+	return rollups, nil
+}
+
+// GetAllRollups returns the rollups of id by resolution.
+func (db DBStorage) GetAllRollups(ctx context.Context, id string) (map[time.Duration][]model.Rollup, error) {
+	_, err := db.GetMetric(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Queries.GetAllRollups(ctx, sqlc.GetAllRollupsParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant get rollups: %w", err)
+	}
+	rollups := make(map[time.Duration][]model.Rollup)
+	for _, r := range rows {
+		res := time.Duration(r.Resolution) * time.Second
+		rollups[res] = append(rollups[res], model.Rollup{
+			Time:  r.Ts,
+			Min:   r.Min,
+			Max:   r.Max,
+			Avg:   r.Avg,
+			Last:  r.Last,
+			Count: r.Count,
+		})
+	}
+	return rollups, nil
+}
+
+// PutRollups replaces the rollups of id in one transaction.
+func (db DBStorage) PutRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = db.inTx(tx).putRollups(ctx, id, rollups)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db DBStorage) putRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	_, err := db.GetMetric(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = db.Queries.DeleteRollups(ctx, sqlc.DeleteRollupsParams{
+		Tenant: tenant.FromContext(ctx),
+		ID:     id,
+	})
+	if err != nil {
+		return fmt.Errorf("cant delete rollups: %w", err)
+	}
+	for res, rs := range rollups {
+		for _, r := range rs {
+			err = db.Queries.InsertRollup(ctx, sqlc.InsertRollupParams{
+				Tenant:     tenant.FromContext(ctx),
+				ID:         id,
+				Resolution: int64(res.Seconds()),
+				Ts:         r.Time,
+				Min:        r.Min,
+				Max:        r.Max,
+				Avg:        r.Avg,
+				Last:       r.Last,
+				Count:      r.Count,
+			})
+			if err != nil {
+				return fmt.Errorf("cant write rollup: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Compact builds each tier from the one below it in a single transaction.
+// Resolutions are stored in whole seconds; date_bin needs PostgreSQL 14.
+func (db *DBStorage) Compact(ctx context.Context, now time.Time, r model.Retention) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	query := db.Queries.WithTx(tx)
+
+	var source int64
+	for _, tier := range r.Tiers {
+		res := int64(tier.Resolution.Seconds())
+		until := now.Truncate(tier.Resolution)
+		if source == 0 {
+			_, err = query.CompactSamples(ctx, sqlc.CompactSamplesParams{Resolution: res, Until: until})
+		} else {
+			_, err = query.CompactRollups(ctx, sqlc.CompactRollupsParams{Resolution: res, Source: source, Until: until})
+		}
+		if err != nil {
+			return fmt.Errorf("cant compact %s rollups: %w", tier.Resolution, err)
+		}
+		if tier.Retention > 0 {
+			_, err = query.DeleteRollupsBefore(ctx, sqlc.DeleteRollupsBeforeParams{Resolution: res, Ts: now.Add(-tier.Retention)})
+			if err != nil {
+				return fmt.Errorf("cant delete %s rollups: %w", tier.Resolution, err)
+			}
+		}
+		source = res
+	}
+	if r.Raw > 0 {
+		_, err = query.DeleteSamplesBefore(ctx, now.Add(-r.Raw))
 		if err != nil {
-			return fmt.Errorf("can't write metric to DB: %w", err)
+			return fmt.Errorf("cant delete samples: %w", err)
 		}
 	}
 	return tx.Commit()
@@ -1,17 +1,124 @@
--- name: InsertOrUpdateMetric :exec
-INSERT INTO metrics (id, type, value, delta)
-VALUES ($1, $2, $3, $4)
-ON CONFLICT (id) DO UPDATE 
-SET value = EXCLUDED.value, delta = EXCLUDED.delta;
+-- name: InsertOrUpdateMetric :one
+INSERT INTO metrics (tenant, id, type, value, delta)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (tenant, id) DO UPDATE
+SET value = EXCLUDED.value,
+    delta = CASE WHEN metrics.type = 'counter' THEN COALESCE(metrics.delta, 0) + EXCLUDED.delta ELSE EXCLUDED.delta END,
+    updated_at = now()
+WHERE metrics.type = EXCLUDED.type
+RETURNING tenant, id, type, value, delta, updated_at;
 
 -- name: GetMetric :one
-SELECT id, type, value, delta FROM metrics WHERE id = $1;
+SELECT tenant, id, type, value, delta, updated_at FROM metrics WHERE tenant = $1 AND id = $2;
 
 -- name: GetAllMetrics :many
-SELECT id, type, value, delta FROM metrics;
+SELECT tenant, id, type, value, delta, updated_at FROM metrics WHERE tenant = $1;
 
--- name: InsertOrUpdateMetricBatch :execparams
-INSERT INTO metrics (id, type, value, delta)
-VALUES ($1, $2, $3, $4)
-ON CONFLICT (id) DO UPDATE
-SET value = EXCLUDED.value, delta = EXCLUDED.delta;
\ No newline at end of file
+-- name: DeleteMetric :execrows
+DELETE FROM metrics WHERE tenant = $1 AND id = $2;
+
+-- name: DeleteAllMetrics :execrows
+DELETE FROM metrics;
+
+-- name: DeleteMetricsByPrefix :many
+DELETE FROM metrics WHERE tenant = $1 AND starts_with(id, $2) RETURNING id;
+
+-- name: RetypeMetric :execrows
+UPDATE metrics SET type = $3, value = $4, delta = $5, updated_at = now()
+WHERE tenant = $1 AND id = $2;
+
+-- name: ResetCounter :one
+UPDATE metrics SET delta = 0, updated_at = now()
+WHERE tenant = $1 AND id = $2 AND type = 'counter'
+RETURNING tenant, id, type, value, delta, updated_at;
+
+-- name: ExpireMetric :execrows
+DELETE FROM metrics WHERE tenant = $1 AND id = $2 AND updated_at < $3;
+
+-- name: InsertSample :exec
+INSERT INTO metric_samples (tenant, id, ts, value)
+VALUES ($1, $2, $3, $4);
+
+-- name: GetSamples :many
+SELECT ts, value FROM metric_samples
+WHERE tenant = $1 AND id = $2 AND ts >= $3 AND ts <= $4
+ORDER BY ts;
+
+-- name: DeleteSamples :exec
+DELETE FROM metric_samples WHERE tenant = $1 AND id = $2;
+
+-- name: DeleteSamplesBetween :exec
+DELETE FROM metric_samples WHERE tenant = $1 AND id = $2 AND ts >= $3 AND ts <= $4;
+
+-- name: DeleteRollups :exec
+DELETE FROM metric_rollups WHERE tenant = $1 AND id = $2;
+
+-- name: CompactSamples :execrows
+INSERT INTO metric_rollups (tenant, id, resolution, ts, min, max, avg, last, count)
+SELECT s.tenant, s.id, @resolution::bigint,
+       date_bin(make_interval(secs => @resolution::bigint), s.ts, to_timestamp(0)) AS bucket,
+       min(s.value), max(s.value), avg(s.value),
+       (array_agg(s.value ORDER BY s.ts DESC))[1], count(*)
+FROM metric_samples s
+WHERE s.ts < @until::timestamptz
+  AND s.ts >= COALESCE((
+      SELECT max(r.ts) + make_interval(secs => @resolution::bigint) FROM metric_rollups r
+      WHERE r.tenant = s.tenant AND r.id = s.id AND r.resolution = @resolution::bigint
+  ), '-infinity')
+GROUP BY s.tenant, s.id, bucket
+ON CONFLICT DO NOTHING;
+
+-- name: CompactRollups :execrows
+INSERT INTO metric_rollups (tenant, id, resolution, ts, min, max, avg, last, count)
+SELECT r.tenant, r.id, @resolution::bigint,
+       date_bin(make_interval(secs => @resolution::bigint), r.ts, to_timestamp(0)) AS bucket,
+       min(r.min), max(r.max), sum(r.avg * r.count) / sum(r.count),
+       (array_agg(r.last ORDER BY r.ts DESC))[1], sum(r.count)::bigint
+FROM metric_rollups r
+WHERE r.resolution = @source::bigint
+  AND r.ts < @until::timestamptz
+  AND r.ts >= COALESCE((
+      SELECT max(t.ts) + make_interval(secs => @resolution::bigint) FROM metric_rollups t
+      WHERE t.tenant = r.tenant AND t.id = r.id AND t.resolution = @resolution::bigint
+  ), '-infinity')
+GROUP BY r.tenant, r.id, bucket
+ON CONFLICT DO NOTHING;
+
+-- name: DeleteSamplesBefore :execrows
+DELETE FROM metric_samples WHERE ts < $1;
+
+-- name: DeleteRollupsBefore :execrows
+DELETE FROM metric_rollups WHERE resolution = $1 AND ts < $2;
+
+-- name: GetRollups :many
+SELECT ts, min, max, avg, last, count FROM metric_rollups
+WHERE tenant = $1 AND id = $2 AND resolution = $3 AND ts >= $4 AND ts <= $5
+ORDER BY ts;
+
+-- name: GetAllRollups :many
+SELECT resolution, ts, min, max, avg, last, count FROM metric_rollups
+WHERE tenant = $1 AND id = $2
+ORDER BY resolution, ts;
+
+-- name: InsertRollup :exec
+INSERT INTO metric_rollups (tenant, id, resolution, ts, min, max, avg, last, count)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+
+-- name: ListMetrics :many
+SELECT tenant, id, type, value, delta, updated_at FROM metrics
+WHERE tenant = @tenant
+  AND (@type::text = '' OR type = @type)
+  AND starts_with(id, @prefix::text)
+  AND id COLLATE "C" > @after::text
+ORDER BY id COLLATE "C"
+LIMIT @lim;
+
+-- name: ListTenants :many
+SELECT DISTINCT tenant FROM metrics ORDER BY tenant;
+
+-- name: PutMetric :execrows
+INSERT INTO metrics (tenant, id, type, value, delta, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (tenant, id) DO UPDATE
+SET value = EXCLUDED.value, delta = EXCLUDED.delta, updated_at = EXCLUDED.updated_at
+WHERE metrics.type = EXCLUDED.type;
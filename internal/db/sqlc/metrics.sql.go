@@ -8,26 +8,307 @@ package db
 import (
 	"context"
 	"database/sql"
+	"time"
 )
 
+const compactRollups = `-- name: CompactRollups :execrows
+INSERT INTO metric_rollups (tenant, id, resolution, ts, min, max, avg, last, count)
+SELECT r.tenant, r.id, $1::bigint,
+       date_bin(make_interval(secs => $1::bigint), r.ts, to_timestamp(0)) AS bucket,
+       min(r.min), max(r.max), sum(r.avg * r.count) / sum(r.count),
+       (array_agg(r.last ORDER BY r.ts DESC))[1], sum(r.count)::bigint
+FROM metric_rollups r
+WHERE r.resolution = $2::bigint
+  AND r.ts < $3::timestamptz
+  AND r.ts >= COALESCE((
+      SELECT max(t.ts) + make_interval(secs => $1::bigint) FROM metric_rollups t
+      WHERE t.tenant = r.tenant AND t.id = r.id AND t.resolution = $1::bigint
+  ), '-infinity')
+GROUP BY r.tenant, r.id, bucket
+ON CONFLICT DO NOTHING
+`
+
+type CompactRollupsParams struct {
+	Resolution int64
+	Source     int64
+	Until      time.Time
+}
+
+func (q *Queries) CompactRollups(ctx context.Context, arg CompactRollupsParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, compactRollups, arg.Resolution, arg.Source, arg.Until)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const compactSamples = `-- name: CompactSamples :execrows
+INSERT INTO metric_rollups (tenant, id, resolution, ts, min, max, avg, last, count)
+SELECT s.tenant, s.id, $1::bigint,
+       date_bin(make_interval(secs => $1::bigint), s.ts, to_timestamp(0)) AS bucket,
+       min(s.value), max(s.value), avg(s.value),
+       (array_agg(s.value ORDER BY s.ts DESC))[1], count(*)
+FROM metric_samples s
+WHERE s.ts < $2::timestamptz
+  AND s.ts >= COALESCE((
+      SELECT max(r.ts) + make_interval(secs => $1::bigint) FROM metric_rollups r
+      WHERE r.tenant = s.tenant AND r.id = s.id AND r.resolution = $1::bigint
+  ), '-infinity')
+GROUP BY s.tenant, s.id, bucket
+ON CONFLICT DO NOTHING
+`
+
+type CompactSamplesParams struct {
+	Resolution int64
+	Until      time.Time
+}
+
+func (q *Queries) CompactSamples(ctx context.Context, arg CompactSamplesParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, compactSamples, arg.Resolution, arg.Until)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteAllMetrics = `-- name: DeleteAllMetrics :execrows
+DELETE FROM metrics
+`
+
+func (q *Queries) DeleteAllMetrics(ctx context.Context) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteAllMetrics)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteMetric = `-- name: DeleteMetric :execrows
+DELETE FROM metrics WHERE tenant = $1 AND id = $2
+`
+
+type DeleteMetricParams struct {
+	Tenant string
+	ID     string
+}
+
+func (q *Queries) DeleteMetric(ctx context.Context, arg DeleteMetricParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteMetric, arg.Tenant, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteMetricsByPrefix = `-- name: DeleteMetricsByPrefix :many
+DELETE FROM metrics WHERE tenant = $1 AND starts_with(id, $2) RETURNING id
+`
+
+type DeleteMetricsByPrefixParams struct {
+	Tenant     string
+	StartsWith string
+}
+
+func (q *Queries) DeleteMetricsByPrefix(ctx context.Context, arg DeleteMetricsByPrefixParams) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, deleteMetricsByPrefix, arg.Tenant, arg.StartsWith)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteRollups = `-- name: DeleteRollups :exec
+DELETE FROM metric_rollups WHERE tenant = $1 AND id = $2
+`
+
+type DeleteRollupsParams struct {
+	Tenant string
+	ID     string
+}
+
+func (q *Queries) DeleteRollups(ctx context.Context, arg DeleteRollupsParams) error {
+	_, err := q.db.ExecContext(ctx, deleteRollups, arg.Tenant, arg.ID)
+	return err
+}
+
+const deleteRollupsBefore = `-- name: DeleteRollupsBefore :execrows
+DELETE FROM metric_rollups WHERE resolution = $1 AND ts < $2
+`
+
+type DeleteRollupsBeforeParams struct {
+	Resolution int64
+	Ts         time.Time
+}
+
+func (q *Queries) DeleteRollupsBefore(ctx context.Context, arg DeleteRollupsBeforeParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteRollupsBefore, arg.Resolution, arg.Ts)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteSamples = `-- name: DeleteSamples :exec
+DELETE FROM metric_samples WHERE tenant = $1 AND id = $2
+`
+
+type DeleteSamplesParams struct {
+	Tenant string
+	ID     string
+}
+
+func (q *Queries) DeleteSamples(ctx context.Context, arg DeleteSamplesParams) error {
+	_, err := q.db.ExecContext(ctx, deleteSamples, arg.Tenant, arg.ID)
+	return err
+}
+
+const deleteSamplesBefore = `-- name: DeleteSamplesBefore :execrows
+DELETE FROM metric_samples WHERE ts < $1
+`
+
+func (q *Queries) DeleteSamplesBefore(ctx context.Context, ts time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteSamplesBefore, ts)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteSamplesBetween = `-- name: DeleteSamplesBetween :exec
+DELETE FROM metric_samples WHERE tenant = $1 AND id = $2 AND ts >= $3 AND ts <= $4
+`
+
+type DeleteSamplesBetweenParams struct {
+	Tenant string
+	ID     string
+	Ts     time.Time
+	Ts_2   time.Time
+}
+
+func (q *Queries) DeleteSamplesBetween(ctx context.Context, arg DeleteSamplesBetweenParams) error {
+	_, err := q.db.ExecContext(ctx, deleteSamplesBetween,
+		arg.Tenant,
+		arg.ID,
+		arg.Ts,
+		arg.Ts_2,
+	)
+	return err
+}
+
+const expireMetric = `-- name: ExpireMetric :execrows
+DELETE FROM metrics WHERE tenant = $1 AND id = $2 AND updated_at < $3
+`
+
+type ExpireMetricParams struct {
+	Tenant    string
+	ID        string
+	UpdatedAt time.Time
+}
+
+func (q *Queries) ExpireMetric(ctx context.Context, arg ExpireMetricParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, expireMetric, arg.Tenant, arg.ID, arg.UpdatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const getAllMetrics = `-- name: GetAllMetrics :many
-SELECT id, type, value, delta FROM metrics
+SELECT tenant, id, type, value, delta, updated_at FROM metrics WHERE tenant = $1
 `
 
-func (q *Queries) GetAllMetrics(ctx context.Context) ([]Metric, error) {
-	rows, err := q.db.QueryContext(ctx, getAllMetrics)
+type GetAllMetricsRow struct {
+	Tenant    string
+	ID        string
+	Type      string
+	Value     sql.NullFloat64
+	Delta     sql.NullInt64
+	UpdatedAt time.Time
+}
+
+func (q *Queries) GetAllMetrics(ctx context.Context, tenant string) ([]GetAllMetricsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getAllMetrics, tenant)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []Metric
+	var items []GetAllMetricsRow
 	for rows.Next() {
-		var i Metric
+		var i GetAllMetricsRow
 		if err := rows.Scan(
+			&i.Tenant,
 			&i.ID,
 			&i.Type,
 			&i.Value,
 			&i.Delta,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getAllRollups = `-- name: GetAllRollups :many
+SELECT resolution, ts, min, max, avg, last, count FROM metric_rollups
+WHERE tenant = $1 AND id = $2
+ORDER BY resolution, ts
+`
+
+type GetAllRollupsParams struct {
+	Tenant string
+	ID     string
+}
+
+type GetAllRollupsRow struct {
+	Resolution int64
+	Ts         time.Time
+	Min        float64
+	Max        float64
+	Avg        float64
+	Last       float64
+	Count      int64
+}
+
+func (q *Queries) GetAllRollups(ctx context.Context, arg GetAllRollupsParams) ([]GetAllRollupsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getAllRollups, arg.Tenant, arg.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetAllRollupsRow
+	for rows.Next() {
+		var i GetAllRollupsRow
+		if err := rows.Scan(
+			&i.Resolution,
+			&i.Ts,
+			&i.Min,
+			&i.Max,
+			&i.Avg,
+			&i.Last,
+			&i.Count,
 		); err != nil {
 			return nil, err
 		}
@@ -43,41 +324,423 @@ func (q *Queries) GetAllMetrics(ctx context.Context) ([]Metric, error) {
 }
 
 const getMetric = `-- name: GetMetric :one
-SELECT id, type, value, delta FROM metrics WHERE id = $1
+SELECT tenant, id, type, value, delta, updated_at FROM metrics WHERE tenant = $1 AND id = $2
 `
 
-func (q *Queries) GetMetric(ctx context.Context, id string) (Metric, error) {
-	row := q.db.QueryRowContext(ctx, getMetric, id)
-	var i Metric
+type GetMetricParams struct {
+	Tenant string
+	ID     string
+}
+
+type GetMetricRow struct {
+	Tenant    string
+	ID        string
+	Type      string
+	Value     sql.NullFloat64
+	Delta     sql.NullInt64
+	UpdatedAt time.Time
+}
+
+func (q *Queries) GetMetric(ctx context.Context, arg GetMetricParams) (GetMetricRow, error) {
+	row := q.db.QueryRowContext(ctx, getMetric, arg.Tenant, arg.ID)
+	var i GetMetricRow
 	err := row.Scan(
+		&i.Tenant,
 		&i.ID,
 		&i.Type,
 		&i.Value,
 		&i.Delta,
+		&i.UpdatedAt,
 	)
 	return i, err
 }
 
-const insertOrUpdateMetric = `-- name: InsertOrUpdateMetric :exec
-INSERT INTO metrics (id, type, value, delta)
-VALUES ($1, $2, $3, $4)
-ON CONFLICT (id) DO UPDATE 
-SET value = EXCLUDED.value, delta = EXCLUDED.delta
+const getRollups = `-- name: GetRollups :many
+SELECT ts, min, max, avg, last, count FROM metric_rollups
+WHERE tenant = $1 AND id = $2 AND resolution = $3 AND ts >= $4 AND ts <= $5
+ORDER BY ts
+`
+
+type GetRollupsParams struct {
+	Tenant     string
+	ID         string
+	Resolution int64
+	Ts         time.Time
+	Ts_2       time.Time
+}
+
+type GetRollupsRow struct {
+	Ts    time.Time
+	Min   float64
+	Max   float64
+	Avg   float64
+	Last  float64
+	Count int64
+}
+
+func (q *Queries) GetRollups(ctx context.Context, arg GetRollupsParams) ([]GetRollupsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getRollups,
+		arg.Tenant,
+		arg.ID,
+		arg.Resolution,
+		arg.Ts,
+		arg.Ts_2,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetRollupsRow
+	for rows.Next() {
+		var i GetRollupsRow
+		if err := rows.Scan(
+			&i.Ts,
+			&i.Min,
+			&i.Max,
+			&i.Avg,
+			&i.Last,
+			&i.Count,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSamples = `-- name: GetSamples :many
+SELECT ts, value FROM metric_samples
+WHERE tenant = $1 AND id = $2 AND ts >= $3 AND ts <= $4
+ORDER BY ts
+`
+
+type GetSamplesParams struct {
+	Tenant string
+	ID     string
+	Ts     time.Time
+	Ts_2   time.Time
+}
+
+type GetSamplesRow struct {
+	Ts    time.Time
+	Value float64
+}
+
+func (q *Queries) GetSamples(ctx context.Context, arg GetSamplesParams) ([]GetSamplesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getSamples,
+		arg.Tenant,
+		arg.ID,
+		arg.Ts,
+		arg.Ts_2,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetSamplesRow
+	for rows.Next() {
+		var i GetSamplesRow
+		if err := rows.Scan(&i.Ts, &i.Value); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertOrUpdateMetric = `-- name: InsertOrUpdateMetric :one
+INSERT INTO metrics (tenant, id, type, value, delta)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (tenant, id) DO UPDATE
+SET value = EXCLUDED.value,
+    delta = CASE WHEN metrics.type = 'counter' THEN COALESCE(metrics.delta, 0) + EXCLUDED.delta ELSE EXCLUDED.delta END,
+    updated_at = now()
+WHERE metrics.type = EXCLUDED.type
+RETURNING tenant, id, type, value, delta, updated_at
 `
 
 type InsertOrUpdateMetricParams struct {
-	ID    string
-	Type  string
-	Value sql.NullFloat64
-	Delta sql.NullInt64
+	Tenant string
+	ID     string
+	Type   string
+	Value  sql.NullFloat64
+	Delta  sql.NullInt64
 }
 
-func (q *Queries) InsertOrUpdateMetric(ctx context.Context, arg InsertOrUpdateMetricParams) error {
-	_, err := q.db.ExecContext(ctx, insertOrUpdateMetric,
+type InsertOrUpdateMetricRow struct {
+	Tenant    string
+	ID        string
+	Type      string
+	Value     sql.NullFloat64
+	Delta     sql.NullInt64
+	UpdatedAt time.Time
+}
+
+func (q *Queries) InsertOrUpdateMetric(ctx context.Context, arg InsertOrUpdateMetricParams) (InsertOrUpdateMetricRow, error) {
+	row := q.db.QueryRowContext(ctx, insertOrUpdateMetric,
+		arg.Tenant,
 		arg.ID,
 		arg.Type,
 		arg.Value,
 		arg.Delta,
 	)
+	var i InsertOrUpdateMetricRow
+	err := row.Scan(
+		&i.Tenant,
+		&i.ID,
+		&i.Type,
+		&i.Value,
+		&i.Delta,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const insertRollup = `-- name: InsertRollup :exec
+INSERT INTO metric_rollups (tenant, id, resolution, ts, min, max, avg, last, count)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+type InsertRollupParams struct {
+	Tenant     string
+	ID         string
+	Resolution int64
+	Ts         time.Time
+	Min        float64
+	Max        float64
+	Avg        float64
+	Last       float64
+	Count      int64
+}
+
+func (q *Queries) InsertRollup(ctx context.Context, arg InsertRollupParams) error {
+	_, err := q.db.ExecContext(ctx, insertRollup,
+		arg.Tenant,
+		arg.ID,
+		arg.Resolution,
+		arg.Ts,
+		arg.Min,
+		arg.Max,
+		arg.Avg,
+		arg.Last,
+		arg.Count,
+	)
+	return err
+}
+
+const insertSample = `-- name: InsertSample :exec
+INSERT INTO metric_samples (tenant, id, ts, value)
+VALUES ($1, $2, $3, $4)
+`
+
+type InsertSampleParams struct {
+	Tenant string
+	ID     string
+	Ts     time.Time
+	Value  float64
+}
+
+func (q *Queries) InsertSample(ctx context.Context, arg InsertSampleParams) error {
+	_, err := q.db.ExecContext(ctx, insertSample,
+		arg.Tenant,
+		arg.ID,
+		arg.Ts,
+		arg.Value,
+	)
 	return err
 }
+
+const listMetrics = `-- name: ListMetrics :many
+SELECT tenant, id, type, value, delta, updated_at FROM metrics
+WHERE tenant = $1
+  AND ($2::text = '' OR type = $2)
+  AND starts_with(id, $3::text)
+  AND id COLLATE "C" > $4::text
+ORDER BY id COLLATE "C"
+LIMIT $5
+`
+
+type ListMetricsParams struct {
+	Tenant string
+	Type   string
+	Prefix string
+	After  string
+	Lim    int64
+}
+
+type ListMetricsRow struct {
+	Tenant    string
+	ID        string
+	Type      string
+	Value     sql.NullFloat64
+	Delta     sql.NullInt64
+	UpdatedAt time.Time
+}
+
+func (q *Queries) ListMetrics(ctx context.Context, arg ListMetricsParams) ([]ListMetricsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listMetrics,
+		arg.Tenant,
+		arg.Type,
+		arg.Prefix,
+		arg.After,
+		arg.Lim,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListMetricsRow
+	for rows.Next() {
+		var i ListMetricsRow
+		if err := rows.Scan(
+			&i.Tenant,
+			&i.ID,
+			&i.Type,
+			&i.Value,
+			&i.Delta,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTenants = `-- name: ListTenants :many
+SELECT DISTINCT tenant FROM metrics ORDER BY tenant
+`
+
+func (q *Queries) ListTenants(ctx context.Context) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, listTenants)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var tenant string
+		if err := rows.Scan(&tenant); err != nil {
+			return nil, err
+		}
+		items = append(items, tenant)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const putMetric = `-- name: PutMetric :execrows
+INSERT INTO metrics (tenant, id, type, value, delta, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (tenant, id) DO UPDATE
+SET value = EXCLUDED.value, delta = EXCLUDED.delta, updated_at = EXCLUDED.updated_at
+WHERE metrics.type = EXCLUDED.type
+`
+
+type PutMetricParams struct {
+	Tenant    string
+	ID        string
+	Type      string
+	Value     sql.NullFloat64
+	Delta     sql.NullInt64
+	UpdatedAt time.Time
+}
+
+func (q *Queries) PutMetric(ctx context.Context, arg PutMetricParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, putMetric,
+		arg.Tenant,
+		arg.ID,
+		arg.Type,
+		arg.Value,
+		arg.Delta,
+		arg.UpdatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const resetCounter = `-- name: ResetCounter :one
+UPDATE metrics SET delta = 0, updated_at = now()
+WHERE tenant = $1 AND id = $2 AND type = 'counter'
+RETURNING tenant, id, type, value, delta, updated_at
+`
+
+type ResetCounterParams struct {
+	Tenant string
+	ID     string
+}
+
+type ResetCounterRow struct {
+	Tenant    string
+	ID        string
+	Type      string
+	Value     sql.NullFloat64
+	Delta     sql.NullInt64
+	UpdatedAt time.Time
+}
+
+func (q *Queries) ResetCounter(ctx context.Context, arg ResetCounterParams) (ResetCounterRow, error) {
+	row := q.db.QueryRowContext(ctx, resetCounter, arg.Tenant, arg.ID)
+	var i ResetCounterRow
+	err := row.Scan(
+		&i.Tenant,
+		&i.ID,
+		&i.Type,
+		&i.Value,
+		&i.Delta,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const retypeMetric = `-- name: RetypeMetric :execrows
+UPDATE metrics SET type = $3, value = $4, delta = $5, updated_at = now()
+WHERE tenant = $1 AND id = $2
+`
+
+type RetypeMetricParams struct {
+	Tenant string
+	ID     string
+	Type   string
+	Value  sql.NullFloat64
+	Delta  sql.NullInt64
+}
+
+func (q *Queries) RetypeMetric(ctx context.Context, arg RetypeMetricParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, retypeMetric,
+		arg.Tenant,
+		arg.ID,
+		arg.Type,
+		arg.Value,
+		arg.Delta,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
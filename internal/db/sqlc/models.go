@@ -6,11 +6,33 @@ package db
 
 import (
 	"database/sql"
+	"time"
 )
 
 type Metric struct {
-	ID    string
-	Type  string
-	Value sql.NullFloat64
-	Delta sql.NullInt64
+	ID        string
+	Type      string
+	Value     sql.NullFloat64
+	Delta     sql.NullInt64
+	Tenant    string
+	UpdatedAt time.Time
+}
+
+type MetricRollup struct {
+	Tenant     string
+	ID         string
+	Resolution int64
+	Ts         time.Time
+	Min        float64
+	Max        float64
+	Avg        float64
+	Last       float64
+	Count      int64
+}
+
+type MetricSample struct {
+	Tenant string
+	ID     string
+	Ts     time.Time
+	Value  float64
 }
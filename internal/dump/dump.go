@@ -0,0 +1,311 @@
+// Package dump moves metrics and their history between storages as JSON
+// lines, CSV or the snapshot format FileStorage persists.
+package dump
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"github.com/randomtoy/gometrics/internal/validation"
+)
+
+var ErrInvalidRecord = errors.New("invalid record")
+
+type Format string
+
+const (
+	// FormatJSONL writes one Record per line.
+	FormatJSONL Format = "jsonl"
+	// FormatCSV writes one metric per row and carries no history.
+	FormatCSV Format = "csv"
+	// FormatSnapshot is the FileStorage file. It is written on Close.
+	FormatSnapshot Format = "snapshot"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSONL, FormatCSV, FormatSnapshot:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q, want jsonl, csv or snapshot", s)
+}
+
+// Record is a metric of a tenant with its history and rollups by
+// resolution. Counters hold their total, which is set rather than added on
+// import.
+type Record struct {
+	Tenant string `json:"tenant"`
+	model.Metric
+	Samples []model.Sample                   `json:"samples,omitempty"`
+	Rollups map[time.Duration][]model.Rollup `json:"rollups,omitempty"`
+}
+
+type Writer interface {
+	Write(r Record) error
+	// Close flushes buffered records. It does not close the underlying
+	// writer.
+	Close() error
+}
+
+type Reader interface {
+	// Read returns the next record or io.EOF.
+	Read() (Record, error)
+}
+
+func NewWriter(f Format, w io.Writer) (Writer, error) {
+	switch f {
+	case FormatJSONL:
+		return &jsonlWriter{enc: json.NewEncoder(w)}, nil
+	case FormatCSV:
+		return newCSVWriter(w)
+	case FormatSnapshot:
+		return &snapshotWriter{w: w, snap: NewSnapshot()}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", f)
+}
+
+func NewReader(f Format, r io.Reader) (Reader, error) {
+	switch f {
+	case FormatJSONL:
+		return &jsonlReader{dec: json.NewDecoder(r)}, nil
+	case FormatCSV:
+		return newCSVReader(r)
+	case FormatSnapshot:
+		return newSnapshotReader(r)
+	}
+	return nil, fmt.Errorf("unknown format %q", f)
+}
+
+// Source is the part of storage.Storage Export reads from.
+type Source interface {
+	ListTenants(ctx context.Context) ([]string, error)
+	GetAllMetrics(ctx context.Context) (map[string]model.Metric, error)
+	GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error)
+}
+
+// RollupSource is implemented by sources keeping rollups, Export reads
+// them along with the history.
+type RollupSource interface {
+	GetAllRollups(ctx context.Context, id string) (map[time.Duration][]model.Rollup, error)
+}
+
+// Sink is the part of storage.Storage Import writes to.
+type Sink interface {
+	PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error
+}
+
+// RollupSink is implemented by sinks keeping rollups. PutRollups replaces
+// the rollups of id and is called after PutSeries. Other sinks rebuild
+// them on their next compaction.
+type RollupSink interface {
+	PutRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error
+}
+
+// SinkFuncs adapts functions to Sink and RollupSink.
+type SinkFuncs struct {
+	Series  func(ctx context.Context, metric model.Metric, samples []model.Sample) error
+	Rollups func(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error
+}
+
+func (f SinkFuncs) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	return f.Series(ctx, metric, samples)
+}
+
+func (f SinkFuncs) PutRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	return f.Rollups(ctx, id, rollups)
+}
+
+// forever bounds history reads; it fits every backend's time range.
+var forever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Export writes every metric of every tenant of src to w, in tenant and ID
+// order, and returns how many were written. History and rollups are read
+// only when history is set.
+func Export(ctx context.Context, src Source, w Writer, history bool) (int, error) {
+	rollups, _ := src.(RollupSource)
+	tenants, err := src.ListTenants(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cant list tenants: %w", err)
+	}
+	n := 0
+	for _, t := range tenants {
+		tctx := tenant.WithTenant(ctx, t)
+		metrics, err := src.GetAllMetrics(tctx)
+		if err != nil {
+			return n, fmt.Errorf("cant get metrics of %s: %w", t, err)
+		}
+		ids := make([]string, 0, len(metrics))
+		for id := range metrics {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			rec := Record{Tenant: t, Metric: metrics[id]}
+			if history {
+				rec.Samples, err = src.GetSamples(tctx, id, time.Time{}, forever)
+				if err != nil && !errors.Is(err, model.ErrNotFound) {
+					return n, fmt.Errorf("cant get history of %s: %w", id, err)
+				}
+			}
+			if history && rollups != nil {
+				rec.Rollups, err = rollups.GetAllRollups(tctx, id)
+				if err != nil && !errors.Is(err, model.ErrNotFound) {
+					return n, fmt.Errorf("cant get rollups of %s: %w", id, err)
+				}
+			}
+			err = w.Write(rec)
+			if err != nil {
+				return n, fmt.Errorf("cant write %s: %w", id, err)
+			}
+			n++
+		}
+	}
+	return n, w.Close()
+}
+
+// importPolicy accepts whatever a storage may hold, only the shape of the
+// metric is checked.
+var importPolicy = validation.Policy{AllowNonFinite: true}
+
+// Import stores every record of r in dst and returns how many were
+// stored. Counters are set to the exported total.
+func Import(ctx context.Context, dst Sink, r Reader) (int, error) {
+	rollups, _ := dst.(RollupSink)
+	n := 0
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err == nil {
+			err = tenant.Validate(rec.Tenant)
+		}
+		if err == nil {
+			err = importPolicy.Metric(rec.Metric)
+		}
+		if err != nil {
+			return n, fmt.Errorf("%w %d: %w", ErrInvalidRecord, n+1, err)
+		}
+		sort.SliceStable(rec.Samples, func(i, j int) bool { return rec.Samples[i].Time.Before(rec.Samples[j].Time) })
+		tctx := tenant.WithTenant(ctx, rec.Tenant)
+		err = dst.PutSeries(tctx, rec.Metric, rec.Samples)
+		if err == nil && rollups != nil && len(rec.Rollups) > 0 {
+			for _, rs := range rec.Rollups {
+				sort.SliceStable(rs, func(i, j int) bool { return rs[i].Time.Before(rs[j].Time) })
+			}
+			err = rollups.PutRollups(tctx, rec.ID, rec.Rollups)
+		}
+		if err != nil {
+			return n, fmt.Errorf("cant store %s of %s: %w", rec.ID, rec.Tenant, err)
+		}
+		n++
+	}
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (jw *jsonlWriter) Write(r Record) error {
+	return jw.enc.Encode(&r)
+}
+
+func (jw *jsonlWriter) Close() error {
+	return nil
+}
+
+type jsonlReader struct {
+	dec *json.Decoder
+}
+
+func (jr *jsonlReader) Read() (Record, error) {
+	var r Record
+	err := jr.dec.Decode(&r)
+	return r, err
+}
+
+var csvHeader = []string{"tenant", "id", "type", "value", "updated_at"}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w)}
+	err := cw.w.Write(csvHeader)
+	if err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(r Record) error {
+	var updated string
+	if r.UpdatedAt != nil {
+		updated = r.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	return cw.w.Write([]string{r.Tenant, r.ID, string(r.Type), r.String(), updated})
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type csvReader struct {
+	r *csv.Reader
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	cr := &csvReader{r: csv.NewReader(r)}
+	cr.r.FieldsPerRecord = len(csvHeader)
+	header, err := cr.r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cant read csv header: %w", err)
+	}
+	for i, name := range csvHeader {
+		if header[i] != name {
+			return nil, fmt.Errorf("unexpected csv header %q, want %q", header[i], name)
+		}
+	}
+	return cr, nil
+}
+
+func (cr *csvReader) Read() (Record, error) {
+	row, err := cr.r.Read()
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{Tenant: row[0], Metric: model.Metric{ID: row[1], Type: model.MetricType(row[2])}}
+	switch rec.Type {
+	case model.Gauge:
+		v, err := strconv.ParseFloat(row[3], 64)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid value of %s: %w", rec.ID, err)
+		}
+		rec.Value = &v
+	case model.Counter:
+		d, err := strconv.ParseInt(row[3], 10, 64)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid value of %s: %w", rec.ID, err)
+		}
+		rec.Delta = &d
+	}
+	if row[4] != "" {
+		t, err := time.Parse(time.RFC3339Nano, row[4])
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid updated_at of %s: %w", rec.ID, err)
+		}
+		rec.Touch(t)
+	}
+	return rec, nil
+}
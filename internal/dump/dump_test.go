@@ -0,0 +1,124 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore keeps series by storage key and sets them as given.
+type fakeStore struct {
+	metrics map[string]model.Metric
+	history map[string][]model.Sample
+	rollups map[string]map[time.Duration][]model.Rollup
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		metrics: make(map[string]model.Metric),
+		history: make(map[string][]model.Sample),
+		rollups: make(map[string]map[time.Duration][]model.Rollup),
+	}
+}
+
+func (s *fakeStore) ListTenants(ctx context.Context) ([]string, error) {
+	return []string{tenant.Default, "team-a"}, nil
+}
+
+func (s *fakeStore) GetAllMetrics(ctx context.Context) (map[string]model.Metric, error) {
+	res := make(map[string]model.Metric)
+	for k, m := range s.metrics {
+		if t, _, _ := tenant.SplitKey(k); t == tenant.FromContext(ctx) {
+			res[m.ID] = m
+		}
+	}
+	return res, nil
+}
+
+func (s *fakeStore) GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error) {
+	return s.history[tenant.Key(tenant.FromContext(ctx), id)], nil
+}
+
+func (s *fakeStore) GetAllRollups(ctx context.Context, id string) (map[time.Duration][]model.Rollup, error) {
+	return s.rollups[tenant.Key(tenant.FromContext(ctx), id)], nil
+}
+
+func (s *fakeStore) PutRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	s.rollups[tenant.Key(tenant.FromContext(ctx), id)] = rollups
+	return nil
+}
+
+func (s *fakeStore) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	key := tenant.Key(tenant.FromContext(ctx), metric.ID)
+	s.metrics[key] = metric
+	s.history[key] = samples
+	return nil
+}
+
+func seed() *fakeStore {
+	store := newFakeStore()
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, tn := range []string{tenant.Default, "team-a"} {
+		v, d := 2.5, int64(6)
+		store.PutSeries(tenant.WithTenant(context.Background(), tn), model.Metric{ID: "Alloc", Type: model.Gauge, Value: &v}, nil)
+		store.PutSeries(tenant.WithTenant(context.Background(), tn), model.Metric{ID: "PollCount", Type: model.Counter, Delta: &d}, []model.Sample{
+			{Time: start, Value: 2},
+			{Time: start.Add(time.Second), Value: 4},
+			{Time: start.Add(2 * time.Second), Value: 6},
+		})
+		store.rollups[tenant.Key(tn, "PollCount")] = map[time.Duration][]model.Rollup{
+			time.Minute: {{Time: start, Min: 2, Max: 6, Avg: 4, Last: 6, Count: 3}},
+		}
+	}
+	return store
+}
+
+func TestExportImport(t *testing.T) {
+	for _, f := range []Format{FormatJSONL, FormatCSV, FormatSnapshot} {
+		t.Run(string(f), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(f, &buf)
+			require.NoError(t, err)
+			n, err := Export(context.Background(), seed(), w, true)
+			require.NoError(t, err)
+			assert.Equal(t, 4, n)
+
+			dst := newFakeStore()
+			r, err := NewReader(f, &buf)
+			require.NoError(t, err)
+			n, err = Import(context.Background(), dst, r)
+			require.NoError(t, err)
+			assert.Equal(t, 4, n)
+
+			m := dst.metrics[tenant.Key("team-a", "PollCount")]
+			assert.Equal(t, int64(6), *m.Delta)
+			m = dst.metrics[tenant.Key("team-a", "Alloc")]
+			assert.Equal(t, 2.5, *m.Value)
+			if f != FormatCSV {
+				assert.Len(t, dst.history[tenant.Key("team-a", "PollCount")], 3)
+				rollups := dst.rollups[tenant.Key("team-a", "PollCount")][time.Minute]
+				require.Len(t, rollups, 1)
+				assert.Equal(t, int64(3), rollups[0].Count)
+			}
+		})
+	}
+}
+
+func TestImport_Invalid(t *testing.T) {
+	dst := newFakeStore()
+	r, err := NewReader(FormatJSONL, bytes.NewBufferString(`{"tenant":"default","id":"x","type":"counter","value":1}`+"\n"))
+	require.NoError(t, err)
+	_, err = Import(context.Background(), dst, r)
+	assert.Error(t, err)
+
+	_, err = NewReader(FormatCSV, bytes.NewBufferString("id,type\n"))
+	assert.Error(t, err)
+	_, err = ParseFormat("xml")
+	assert.Error(t, err)
+}
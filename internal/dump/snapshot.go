@@ -0,0 +1,132 @@
+package dump
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/gorilla"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+)
+
+// SnapshotVersion 2 adds history and 3 rollups. Version 1 files are a bare
+// metrics map.
+const SnapshotVersion = 3
+
+// Snapshot is the FileStorage file format: the metrics by storage key, the
+// history of each key as a Gorilla block, with timestamps rounded to
+// milliseconds, and its rollups by resolution.
+type Snapshot struct {
+	Version int                                         `json:"version"`
+	Metrics map[string]model.Metric                     `json:"metrics"`
+	History map[string][]byte                           `json:"history,omitempty"`
+	Rollups map[string]map[time.Duration][]model.Rollup `json:"rollups,omitempty"`
+}
+
+func NewSnapshot() Snapshot {
+	return Snapshot{
+		Version: SnapshotVersion,
+		Metrics: make(map[string]model.Metric),
+		History: make(map[string][]byte),
+		Rollups: make(map[string]map[time.Duration][]model.Rollup),
+	}
+}
+
+// Add stores the metric, history and rollups of key.
+func (s Snapshot) Add(key string, m model.Metric, samples []model.Sample, rollups map[time.Duration][]model.Rollup) {
+	s.Metrics[key] = m
+	if len(samples) > 0 {
+		s.History[key] = gorilla.EncodeSamples(samples)
+	}
+	for res, r := range rollups {
+		if len(r) == 0 {
+			continue
+		}
+		if s.Rollups[key] == nil {
+			s.Rollups[key] = make(map[time.Duration][]model.Rollup)
+		}
+		s.Rollups[key][res] = r
+	}
+}
+
+// ReadSnapshot decodes a snapshot, falling back to the version 1 format.
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("cant read snapshot: %w", err)
+	}
+	var snap Snapshot
+	err = json.Unmarshal(data, &snap)
+	if err != nil || snap.Version == 0 {
+		snap = Snapshot{}
+		err = json.Unmarshal(data, &snap.Metrics)
+	}
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("cant decode snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+type snapshotWriter struct {
+	w    io.Writer
+	snap Snapshot
+}
+
+func (sw *snapshotWriter) Write(r Record) error {
+	sw.snap.Add(tenant.Key(r.Tenant, r.ID), r.Metric, r.Samples, r.Rollups)
+	return nil
+}
+
+// Close writes the snapshot, which can only be encoded once complete.
+func (sw *snapshotWriter) Close() error {
+	return json.NewEncoder(sw.w).Encode(&sw.snap)
+}
+
+type snapshotReader struct {
+	snap Snapshot
+	keys []string
+}
+
+func newSnapshotReader(r io.Reader) (*snapshotReader, error) {
+	snap, err := ReadSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(snap.Metrics))
+	for key := range snap.Metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &snapshotReader{snap: snap, keys: keys}, nil
+}
+
+func (sr *snapshotReader) Read() (Record, error) {
+	if len(sr.keys) == 0 {
+		return Record{}, io.EOF
+	}
+	key := sr.keys[0]
+	sr.keys = sr.keys[1:]
+
+	m := sr.snap.Metrics[key]
+	rec := Record{Tenant: tenant.Default, Metric: m}
+	// Version 1 keys are bare IDs.
+	if key != m.ID {
+		t, _, ok := tenant.SplitKey(key)
+		if !ok {
+			return Record{}, fmt.Errorf("invalid snapshot key %q", key)
+		}
+		rec.Tenant = t
+	}
+	if block, ok := sr.snap.History[key]; ok {
+		samples, err := gorilla.DecodeSamples(block)
+		if err != nil {
+			return Record{}, fmt.Errorf("cant decode history of %s: %w", key, err)
+		}
+		rec.Samples = samples
+	}
+	rec.Rollups = sr.snap.Rollups[key]
+	return rec, nil
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/randomtoy/gometrics/internal/dump"
+	"github.com/randomtoy/gometrics/internal/gorilla"
 	"github.com/randomtoy/gometrics/internal/memorystorage"
 	"github.com/randomtoy/gometrics/internal/model"
 	"go.uber.org/zap"
@@ -35,8 +38,12 @@ func (fs *FileStorage) SaveToFile() error {
 	}
 	defer file.Close()
 
+	snap := dump.NewSnapshot()
+	for key, m := range fs.memoryStorage.Metrics {
+		snap.Add(key, m, fs.memoryStorage.History[key], fs.memoryStorage.RollupsOf(key))
+	}
 	encoder := json.NewEncoder(file)
-	return encoder.Encode(&fs.memoryStorage.Metrics)
+	return encoder.Encode(&snap)
 }
 
 func (fs *FileStorage) LoadFromFile() error {
@@ -52,14 +59,40 @@ func (fs *FileStorage) LoadFromFile() error {
 	}
 	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	return decoder.Decode(&fs.memoryStorage.Metrics)
+	snap, err := dump.ReadSnapshot(file)
+	if err != nil {
+		return fmt.Errorf("error while decoding file: %w", err)
+	}
+	if snap.Metrics != nil {
+		fs.memoryStorage.Metrics = snap.Metrics
+	}
+	for key, block := range snap.History {
+		samples, err := gorilla.DecodeSamples(block)
+		if err != nil {
+			return fmt.Errorf("error while decoding history of %s: %w", key, err)
+		}
+		fs.memoryStorage.History[key] = samples
+	}
+	for key, rollups := range snap.Rollups {
+		for res, r := range rollups {
+			if fs.memoryStorage.Rollups[res] == nil {
+				fs.memoryStorage.Rollups[res] = make(map[string][]model.Rollup)
+			}
+			fs.memoryStorage.Rollups[res][key] = r
+		}
+	}
+	fs.memoryStorage.Migrate()
+	return nil
 }
 
 func (fs *FileStorage) UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error) {
 	return fs.memoryStorage.UpdateMetric(ctx, metric)
 }
 
+func (fs *FileStorage) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	return fs.memoryStorage.PutSeries(ctx, metric, samples)
+}
+
 func (fs *FileStorage) GetMetric(ctx context.Context, metric string) (model.Metric, error) {
 	return fs.memoryStorage.GetMetric(ctx, metric)
 }
@@ -72,6 +105,54 @@ func (fs *FileStorage) UpdateMetricBatch(ctx context.Context, metrics []model.Me
 	return fs.memoryStorage.UpdateMetricBatch(ctx, metrics)
 }
 
+func (fs *FileStorage) RetypeMetric(ctx context.Context, id string, t model.MetricType) (model.Metric, error) {
+	return fs.memoryStorage.RetypeMetric(ctx, id, t)
+}
+
+func (fs *FileStorage) DeleteMetric(ctx context.Context, id string) error {
+	return fs.memoryStorage.DeleteMetric(ctx, id)
+}
+
+func (fs *FileStorage) ExpireMetric(ctx context.Context, id string, before time.Time) (bool, error) {
+	return fs.memoryStorage.ExpireMetric(ctx, id, before)
+}
+
+func (fs *FileStorage) GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error) {
+	return fs.memoryStorage.GetSamples(ctx, id, start, end)
+}
+
+func (fs *FileStorage) DeleteByPrefix(ctx context.Context, prefix string) ([]string, error) {
+	return fs.memoryStorage.DeleteByPrefix(ctx, prefix)
+}
+
+func (fs *FileStorage) ResetCounter(ctx context.Context, id string) (model.Metric, error) {
+	return fs.memoryStorage.ResetCounter(ctx, id)
+}
+
+func (fs *FileStorage) GetRollups(ctx context.Context, id string, res time.Duration, start, end time.Time) ([]model.Rollup, error) {
+	return fs.memoryStorage.GetRollups(ctx, id, res, start, end)
+}
+
+func (fs *FileStorage) GetAllRollups(ctx context.Context, id string) (map[time.Duration][]model.Rollup, error) {
+	return fs.memoryStorage.GetAllRollups(ctx, id)
+}
+
+func (fs *FileStorage) PutRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	return fs.memoryStorage.PutRollups(ctx, id, rollups)
+}
+
+func (fs *FileStorage) Compact(ctx context.Context, now time.Time, r model.Retention) error {
+	return fs.memoryStorage.Compact(ctx, now, r)
+}
+
+func (fs *FileStorage) ListMetrics(ctx context.Context, filter model.ListFilter) ([]model.Metric, error) {
+	return fs.memoryStorage.ListMetrics(ctx, filter)
+}
+
+func (fs *FileStorage) ListTenants(ctx context.Context) ([]string, error) {
+	return fs.memoryStorage.ListTenants(ctx)
+}
+
 func (fs *FileStorage) Ping(ctx context.Context) error {
 	return fs.memoryStorage.Ping(ctx)
 }
@@ -82,3 +163,11 @@ func (fs *FileStorage) Close() {
 		fs.log.Infof("error saving metrics: %v", err)
 	}
 }
+
+func (fs *FileStorage) Backup(ctx context.Context, w dump.Writer) error {
+	return fs.memoryStorage.Backup(ctx, w)
+}
+
+func (fs *FileStorage) Restore(ctx context.Context, r dump.Reader, replace bool) (int, error) {
+	return fs.memoryStorage.Restore(ctx, r, replace)
+}
@@ -0,0 +1,82 @@
+package filestorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/memorystorage"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFileStorage_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	store := NewFileStorage(l, memorystorage.NewInMemoryStorage(l, path), path)
+	start := time.Now().Add(-time.Second)
+	for i := 0; i < 3; i++ {
+		v := float64(i)
+		_, err := store.UpdateMetric(ctx, model.Metric{ID: "Alloc", Type: model.Gauge, Value: &v})
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.SaveToFile())
+
+	restored := NewFileStorage(l, memorystorage.NewInMemoryStorage(l, path), path)
+	require.NoError(t, restored.LoadFromFile())
+	m, err := restored.GetMetric(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), *m.Value)
+	samples, err := restored.GetSamples(ctx, "Alloc", start, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, samples, 3)
+}
+
+func TestFileStorage_LoadLegacy(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"PollCount":{"id":"PollCount","type":"counter","delta":5}}`), 0o644))
+
+	store := NewFileStorage(l, memorystorage.NewInMemoryStorage(l, path), path)
+	require.NoError(t, store.LoadFromFile())
+	m, err := store.GetMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *m.Delta)
+}
+
+func TestFileStorage_RollupsSurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	store := NewFileStorage(l, memorystorage.NewInMemoryStorage(l, path), path)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := float64(1)
+	metric := model.Metric{ID: "Alloc", Type: model.Gauge, Value: &v}
+	metric.Touch(base.Add(3 * time.Hour))
+	require.NoError(t, store.PutSeries(ctx, metric, []model.Sample{
+		{Time: base, Value: 1},
+		{Time: base.Add(time.Minute), Value: 3},
+	}))
+	retention := model.Retention{Raw: time.Hour, Tiers: []model.Tier{{Resolution: time.Hour, Retention: 720 * time.Hour}}}
+	require.NoError(t, store.Compact(ctx, base.Add(3*time.Hour), retention))
+	require.NoError(t, store.SaveToFile())
+
+	restored := NewFileStorage(l, memorystorage.NewInMemoryStorage(l, path), path)
+	require.NoError(t, restored.LoadFromFile())
+	samples, err := restored.GetSamples(ctx, "Alloc", base, base.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+	rollups, err := restored.GetRollups(ctx, "Alloc", time.Hour, base, base.Add(3*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, rollups, 1)
+	assert.Equal(t, float64(2), rollups[0].Avg)
+	assert.Equal(t, int64(2), rollups[0].Count)
+}
@@ -0,0 +1,319 @@
+// Package gorilla compresses time series as described in Facebook's Gorilla
+// paper: timestamps are stored as delta-of-delta and values XORed with their
+// predecessor, so regular polls of slowly changing values take a few bits
+// per sample.
+//
+// An encoded block is the sample count as a uvarint followed by the bit
+// stream. Timestamps are plain int64s; EncodeSamples uses milliseconds.
+package gorilla
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+)
+
+var ErrCorrupt = errors.New("corrupt gorilla block")
+
+type bitWriter struct {
+	b     []byte
+	count uint8 // bits free in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.count == 0 {
+		w.b = append(w.b, 0)
+		w.count = 8
+	}
+	w.count--
+	if bit {
+		w.b[len(w.b)-1] |= 1 << w.count
+	}
+}
+
+func (w *bitWriter) writeBits(u uint64, n int) {
+	for n > 0 {
+		n--
+		w.writeBit(u>>uint(n)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	b   []byte
+	pos int // bit position
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.b)*8 {
+		return false, ErrCorrupt
+	}
+	bit := r.b[r.pos/8]>>(7-uint(r.pos%8))&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var u uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
+
+// dodBuckets are the bit widths tried for a delta-of-delta, each announced
+// by one more leading 1 bit. Wider values fall back to 64 bits.
+var dodBuckets = []int{7, 9, 12}
+
+// Encoder appends samples, which must be in time order, to a block.
+type Encoder struct {
+	w                bitWriter
+	n                int
+	prevT, prevDelta int64
+	prevV            uint64
+	leading          uint8
+	trailing         uint8
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{leading: 0xff}
+}
+
+func (e *Encoder) Append(t int64, v float64) {
+	u := math.Float64bits(v)
+	switch e.n {
+	case 0:
+		e.w.writeBits(uint64(t), 64)
+		e.w.writeBits(u, 64)
+	case 1:
+		e.prevDelta = t - e.prevT
+		e.w.writeBits(uint64(e.prevDelta), 64)
+		e.writeXOR(u ^ e.prevV)
+	default:
+		delta := t - e.prevT
+		e.writeDod(delta - e.prevDelta)
+		e.prevDelta = delta
+		e.writeXOR(u ^ e.prevV)
+	}
+	e.prevT, e.prevV = t, u
+	e.n++
+}
+
+func (e *Encoder) Len() int {
+	return e.n
+}
+
+// Bytes returns the encoded block. The encoder can keep appending after.
+func (e *Encoder) Bytes() []byte {
+	b := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(e.w.b)), uint64(e.n))
+	return append(b, e.w.b...)
+}
+
+func (e *Encoder) writeDod(dod int64) {
+	if dod == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	for _, n := range dodBuckets {
+		if dod >= -(1<<(n-1))+1 && dod <= 1<<(n-1) {
+			e.w.writeBit(true)
+			e.w.writeBit(false)
+			e.w.writeBits(uint64(dod), n)
+			return
+		}
+		e.w.writeBit(true)
+	}
+	e.w.writeBit(true)
+	e.w.writeBits(uint64(dod), 64)
+}
+
+// writeXOR stores xor, reusing the previous window of meaningful bits when
+// it fits.
+func (e *Encoder) writeXOR(xor uint64) {
+	if xor == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	e.w.writeBit(true)
+	l := uint8(bits.LeadingZeros64(xor))
+	t := uint8(bits.TrailingZeros64(xor))
+	if l > 31 {
+		l = 31
+	}
+	if e.leading != 0xff && l >= e.leading && t >= e.trailing {
+		e.w.writeBit(false)
+		e.w.writeBits(xor>>e.trailing, 64-int(e.leading)-int(e.trailing))
+		return
+	}
+	e.w.writeBit(true)
+	sig := 64 - l - t
+	e.w.writeBits(uint64(l), 5)
+	// 64 significant bits do not fit in 6 bits and are stored as 0.
+	e.w.writeBits(uint64(sig&63), 6)
+	e.w.writeBits(xor>>t, int(sig))
+	e.leading, e.trailing = l, t
+}
+
+// Iterator walks the samples of a block.
+type Iterator struct {
+	r                 bitReader
+	n, i              uint64
+	t, delta          int64
+	v                 uint64
+	leading, trailing uint8
+	err               error
+}
+
+func NewIterator(b []byte) *Iterator {
+	n, size := binary.Uvarint(b)
+	if size <= 0 {
+		return &Iterator{err: ErrCorrupt}
+	}
+	return &Iterator{r: bitReader{b: b[size:]}, n: n}
+}
+
+// Next advances to the next sample and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.i >= it.n {
+		return false
+	}
+	it.err = it.next()
+	if it.err != nil {
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *Iterator) next() error {
+	switch it.i {
+	case 0:
+		t, err := it.r.readBits(64)
+		if err != nil {
+			return err
+		}
+		it.t = int64(t)
+		it.v, err = it.r.readBits(64)
+		return err
+	case 1:
+		delta, err := it.r.readBits(64)
+		if err != nil {
+			return err
+		}
+		it.delta = int64(delta)
+	default:
+		dod, err := it.readDod()
+		if err != nil {
+			return err
+		}
+		it.delta += dod
+	}
+	it.t += it.delta
+	xor, err := it.readXOR()
+	if err != nil {
+		return err
+	}
+	it.v ^= xor
+	return nil
+}
+
+func (it *Iterator) readDod() (int64, error) {
+	ones := 0
+	for ones <= len(dodBuckets) {
+		bit, err := it.r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		ones++
+	}
+	if ones == 0 {
+		return 0, nil
+	}
+	if ones > len(dodBuckets) {
+		u, err := it.r.readBits(64)
+		return int64(u), err
+	}
+	n := dodBuckets[ones-1]
+	u, err := it.r.readBits(n)
+	if err != nil {
+		return 0, err
+	}
+	if u > 1<<(n-1) {
+		return int64(u) - 1<<n, nil
+	}
+	return int64(u), nil
+}
+
+func (it *Iterator) readXOR() (uint64, error) {
+	bit, err := it.r.readBit()
+	if err != nil || !bit {
+		return 0, err
+	}
+	fresh, err := it.r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if fresh {
+		l, err := it.r.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		sig, err := it.r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if sig == 0 {
+			sig = 64
+		}
+		it.leading = uint8(l)
+		it.trailing = uint8(64 - l - sig)
+	}
+	u, err := it.r.readBits(64 - int(it.leading) - int(it.trailing))
+	if err != nil {
+		return 0, err
+	}
+	return u << it.trailing, nil
+}
+
+// At returns the current sample.
+func (it *Iterator) At() (int64, float64) {
+	return it.t, math.Float64frombits(it.v)
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// EncodeSamples encodes samples with millisecond timestamps.
+func EncodeSamples(samples []model.Sample) []byte {
+	e := NewEncoder()
+	for _, s := range samples {
+		e.Append(s.Time.UnixMilli(), s.Value)
+	}
+	return e.Bytes()
+}
+
+func DecodeSamples(b []byte) ([]model.Sample, error) {
+	it := NewIterator(b)
+	// Samples take at least two bits, a corrupt count can't make us
+	// allocate more than the block could hold.
+	samples := make([]model.Sample, 0, min(it.n, uint64(len(b))*8/2))
+	for it.Next() {
+		t, v := it.At()
+		samples = append(samples, model.Sample{Time: time.UnixMilli(t), Value: v})
+	}
+	return samples, it.Err()
+}
@@ -0,0 +1,122 @@
+package gorilla
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeSamples(t *testing.T) {
+	start := time.UnixMilli(1_700_000_000_000)
+	var samples []model.Sample
+	ts := start
+	for i, gap := range []time.Duration{0, 1, 1, 1, 2, 2, 70, 1, 3000, 1, 1 << 40, 1} {
+		ts = ts.Add(gap * time.Millisecond)
+		v := float64(i) * 1.5
+		switch i {
+		case 3:
+			v = math.Inf(1)
+		case 7:
+			v = -1e300
+		case 9:
+			v = 0.1
+		}
+		samples = append(samples, model.Sample{Time: ts, Value: v})
+	}
+	got, err := DecodeSamples(EncodeSamples(samples))
+	require.NoError(t, err)
+	require.Len(t, got, len(samples))
+	for i := range samples {
+		assert.True(t, samples[i].Time.Equal(got[i].Time), i)
+		assert.Equal(t, samples[i].Value, got[i].Value, i)
+	}
+
+	_, err = DecodeSamples(EncodeSamples(samples)[:10])
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	got, err = DecodeSamples(EncodeSamples(nil))
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestDecodeSamples_HugeCount(t *testing.T) {
+	b := binary.AppendUvarint(nil, math.MaxUint64)
+	b = append(b, 1, 2, 3)
+	samples, err := DecodeSamples(b)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.Empty(t, samples)
+}
+
+func TestEncoder_Bytes(t *testing.T) {
+	e := NewEncoder()
+	e.Append(10, 1)
+	first := e.Bytes()
+	e.Append(20, 2)
+
+	it := NewIterator(first)
+	require.True(t, it.Next())
+	ts, v := it.At()
+	assert.Equal(t, int64(10), ts)
+	assert.Equal(t, float64(1), v)
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+	assert.Equal(t, 2, e.Len())
+}
+
+// pollSeries looks like the agent's runtime gauges: a poll every two
+// seconds with some jitter and a value drifting slightly.
+func pollSeries(n int) []model.Sample {
+	rnd := rand.New(rand.NewSource(1))
+	samples := make([]model.Sample, n)
+	ts := time.UnixMilli(1_700_000_000_000)
+	alloc := 4_000_000.0
+	for i := range samples {
+		ts = ts.Add(2*time.Second + time.Duration(rnd.Intn(5))*time.Millisecond)
+		if rnd.Intn(4) == 0 {
+			alloc += float64(rnd.Intn(64) * 8)
+		}
+		samples[i] = model.Sample{Time: ts, Value: alloc}
+	}
+	return samples
+}
+
+func BenchmarkEncodeSamples(b *testing.B) {
+	samples := pollSeries(1000)
+	var size int
+	for i := 0; i < b.N; i++ {
+		size = len(EncodeSamples(samples))
+	}
+	b.ReportMetric(float64(size)/float64(len(samples)), "bytes/sample")
+}
+
+// BenchmarkJSONSamples is the baseline: samples encoded with encoding/json
+// as SaveToFile writes metrics.
+func BenchmarkJSONSamples(b *testing.B) {
+	samples := pollSeries(1000)
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := json.Marshal(samples)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size)/float64(len(samples)), "bytes/sample")
+}
+
+func BenchmarkDecodeSamples(b *testing.B) {
+	data := EncodeSamples(pollSeries(1000))
+	for i := 0; i < b.N; i++ {
+		_, err := DecodeSamples(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/storage"
+	"github.com/randomtoy/gometrics/internal/tenant"
+)
+
+type retypeRequest struct {
+	Tenant string           `json:"tenant"`
+	ID     string           `json:"id"`
+	Type   model.MetricType `json:"type"`
+}
+
+func (h *Handler) ListTenants(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tenants, err := h.store.ListTenants(ctx)
+	if err != nil {
+		return errorJSON(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, tenants)
+}
+
+func (h *Handler) Cardinality(c echo.Context) error {
+	reporter, ok := h.store.(storage.CardinalityReporter)
+	if !ok {
+		return errorJSON(c, http.StatusNotImplemented, "Storage does not track cardinality")
+	}
+	top := 10
+	if v := c.QueryParam("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errorJSON(c, http.StatusBadRequest, "Invalid top value")
+		}
+		top = n
+	}
+	return c.JSON(http.StatusOK, reporter.Cardinality(top))
+}
+
+// adminContext scopes an admin request to the tenant it names, since admin
+// routes do not go through the tenant middleware. The X-Tenant-ID header is
+// used when the request does not name one.
+func adminContext(c echo.Context, t string) (context.Context, error) {
+	if t == "" {
+		t = c.Request().Header.Get(tenant.Header)
+	}
+	if t == "" {
+		t = tenant.Default
+	}
+	err := tenant.Validate(t)
+	if err != nil {
+		return nil, err
+	}
+	return tenant.WithTenant(c.Request().Context(), t), nil
+}
+
+// RetypeMetric converts a stored series to another type so that writes of
+// the new type stop conflicting with it.
+func (h *Handler) RetypeMetric(c echo.Context) error {
+	var req retypeRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, "Invalid JSON")
+	}
+	err = h.policy.Type(req.Type)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	ctx, err := adminContext(c, req.Tenant)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+
+	m, err := h.store.RetypeMetric(ctx, req.ID, req.Type)
+	if err != nil {
+		return storeError(c, err)
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+func (h *Handler) AdminDeleteMetric(c echo.Context) error {
+	ctx, err := adminContext(c, c.QueryParam("tenant"))
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+
+	err = h.store.DeleteMetric(ctx, c.Param("id"))
+	if err != nil {
+		return storeError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
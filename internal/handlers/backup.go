@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/randomtoy/gometrics/internal/dump"
+)
+
+type restoreResponse struct {
+	Mode     string `json:"mode"`
+	Restored int    `json:"restored"`
+}
+
+// Backup streams a point in time copy of every series of every tenant as
+// gzip'd JSON lines. A failure after the first byte cannot change the
+// status, so the stream is cut without the gzip trailer instead.
+func (h *Handler) Backup(c echo.Context) error {
+	res := c.Response()
+	name := fmt.Sprintf("metrics-%s.jsonl.gz", time.Now().UTC().Format("20060102T150405Z"))
+	res.Header().Set(echo.HeaderContentType, "application/gzip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+	res.WriteHeader(http.StatusOK)
+
+	gz := gzip.NewWriter(res)
+	w, err := dump.NewWriter(dump.FormatJSONL, gz)
+	if err != nil {
+		return err
+	}
+	err = h.store.Backup(c.Request().Context(), w)
+	if err != nil {
+		h.log.Error("backup failed", zap.Error(err))
+		return nil
+	}
+	return gz.Close()
+}
+
+// Restore loads a backup stream, gzip'd or not. mode=replace deletes every
+// series first, the default mode=merge overwrites only the series in the
+// stream.
+func (h *Handler) Restore(c echo.Context) error {
+	mode := c.QueryParam("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		return errorJSON(c, http.StatusBadRequest, "Invalid mode, want merge or replace")
+	}
+
+	body := bufio.NewReader(c.Request().Body)
+	var r io.Reader = body
+	if magic, _ := body.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return errorJSON(c, http.StatusBadRequest, "Invalid gzip stream")
+		}
+		defer gz.Close()
+		r = gz
+	}
+	dr, err := dump.NewReader(dump.FormatJSONL, r)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	n, err := h.store.Restore(c.Request().Context(), dr, mode == "replace")
+	if err != nil {
+		return storeError(c, err)
+	}
+	return c.JSON(http.StatusOK, restoreResponse{Mode: mode, Restored: n})
+}
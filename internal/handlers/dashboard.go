@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/randomtoy/gometrics/internal/dashboard"
+)
+
+const sparklineWindow = time.Hour
+
+// wantsHTML reports whether the client prefers HTML. Browsers list
+// text/html explicitly, curl sends */*.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+// render buffers the page so a template error still yields a clean 500.
+func (h *Handler) render(c echo.Context, fn func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := fn(&buf); err != nil {
+		h.log.Error("cant render page", zap.Error(err))
+		return errorJSON(c, http.StatusInternalServerError, "Cant render page")
+	}
+	return c.HTMLBlob(http.StatusOK, buf.Bytes())
+}
+
+// MetricPage serves GET /metric/:name with a sparkline of the last hour.
+func (h *Handler) MetricPage(c echo.Context) error {
+	ctx := c.Request().Context()
+	name := c.Param("name")
+
+	metric, err := h.store.GetMetric(ctx, name)
+	if err != nil {
+		return storeError(c, err)
+	}
+	if !wantsHTML(c.Request()) {
+		return c.String(http.StatusOK, metric.String())
+	}
+	end := time.Now()
+	samples, err := h.store.GetSamples(ctx, name, end.Add(-sparklineWindow), end)
+	if err != nil {
+		return storeError(c, err)
+	}
+	page := dashboard.NewMetricPage(metric, samples, sparklineWindow)
+	return h.render(c, func(w io.Writer) error { return dashboard.RenderMetric(w, page) })
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/validation"
+)
+
+type deleteRequest struct {
+	Tenant   string         `json:"tenant"`
+	Metrics  []model.Metric `json:"metrics"`
+	Prefixes []string       `json:"prefixes"`
+}
+
+type deleteResponse struct {
+	Deleted []string               `json:"deleted"`
+	Details []validation.ItemError `json:"details,omitempty"`
+}
+
+// deleteTyped removes id only if it is stored with type t, so a typo in the
+// type part of the URL can't delete an unrelated series.
+func (h *Handler) deleteTyped(ctx context.Context, id string, t model.MetricType) error {
+	m, err := h.store.GetMetric(ctx, id)
+	if err != nil {
+		return err
+	}
+	if m.Type != t {
+		return fmt.Errorf("%w: %s %s", model.ErrNotFound, t, id)
+	}
+	return h.store.DeleteMetric(ctx, id)
+}
+
+func (h *Handler) DeleteMetric(c echo.Context) error {
+	ctx, err := adminContext(c, c.QueryParam("tenant"))
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	t := model.MetricType(c.Param("type"))
+	err = h.policy.Type(t)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+
+	err = h.deleteTyped(ctx, c.Param("name"), t)
+	if err != nil {
+		return storeError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// BatchDeleteHandler deletes the listed series and every series whose name
+// starts with one of the prefixes. Missing series are reported per item.
+func (h *Handler) BatchDeleteHandler(c echo.Context) error {
+	var req deleteRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, "Invalid JSON")
+	}
+	if len(req.Metrics) == 0 && len(req.Prefixes) == 0 {
+		return errorJSON(c, http.StatusBadRequest, "Nothing to delete")
+	}
+	var invalid []validation.ItemError
+	for i, m := range req.Metrics {
+		err := h.policy.Name(m.ID)
+		if err == nil {
+			err = h.policy.Type(m.Type)
+		}
+		if err != nil {
+			invalid = append(invalid, validation.ItemError{Index: i, ID: m.ID, Message: err.Error()})
+		}
+	}
+	for _, p := range req.Prefixes {
+		if p == "" {
+			return errorJSON(c, http.StatusBadRequest, "Empty prefix would delete every series")
+		}
+	}
+	if len(invalid) > 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   fmt.Sprintf("%d of %d metrics are invalid", len(invalid), len(req.Metrics)),
+			Details: invalid,
+		})
+	}
+	ctx, err := adminContext(c, req.Tenant)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+
+	resp := deleteResponse{Deleted: []string{}}
+	for i, m := range req.Metrics {
+		err := h.deleteTyped(ctx, m.ID, m.Type)
+		if err != nil {
+			resp.Details = append(resp.Details, validation.ItemError{Index: i, ID: m.ID, Message: err.Error()})
+			continue
+		}
+		resp.Deleted = append(resp.Deleted, m.ID)
+	}
+	for _, p := range req.Prefixes {
+		ids, err := h.store.DeleteByPrefix(ctx, p)
+		if err != nil {
+			return storeError(c, err)
+		}
+		resp.Deleted = append(resp.Deleted, ids...)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) ResetCounter(c echo.Context) error {
+	ctx, err := adminContext(c, c.QueryParam("tenant"))
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+
+	m, err := h.store.ResetCounter(ctx, c.Param("name"))
+	if err != nil {
+		return storeError(c, err)
+	}
+	return c.JSON(http.StatusOK, m)
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/randomtoy/gometrics/internal/dump"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/storage"
+	"github.com/randomtoy/gometrics/internal/validation"
+)
+
+// ErrorResponse is the body of every error returned by the handlers.
+// Details is only set for batch requests and lists each rejected entry.
+type ErrorResponse struct {
+	Error   string                 `json:"error"`
+	Details []validation.ItemError `json:"details,omitempty"`
+}
+
+func errorJSON(c echo.Context, status int, msg string) error {
+	return c.JSON(status, ErrorResponse{Error: msg})
+}
+
+// storeError maps storage errors to HTTP statuses.
+func storeError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, dump.ErrInvalidRecord):
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, storage.ErrSeriesDropped):
+		// Accepted but not stored, the client shouldn't retry.
+		return errorJSON(c, http.StatusAccepted, err.Error())
+	case errors.Is(err, storage.ErrSeriesLimit):
+		return errorJSON(c, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, model.ErrTypeConflict):
+		return errorJSON(c, http.StatusConflict, err.Error())
+	case errors.Is(err, model.ErrNotFound):
+		return errorJSON(c, http.StatusNotFound, err.Error())
+	default:
+		return errorJSON(c, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -2,17 +2,28 @@ package handlers
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 
+	"github.com/randomtoy/gometrics/internal/dashboard"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/ratelimit"
 	"github.com/randomtoy/gometrics/internal/storage"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"github.com/randomtoy/gometrics/internal/validation"
 )
 
+// HeaderMetricsDropped tells how many metrics of a batch were dropped over
+// the series limit.
+const HeaderMetricsDropped = "X-Metrics-Dropped"
+
 type HandlerAction string
 
 const (
@@ -21,9 +32,13 @@ const (
 )
 
 type Handler struct {
-	store storage.Storage
-	log   *zap.Logger
-	key   string
+	store     storage.Storage
+	log       *zap.Logger
+	key       string
+	limiter   *ratelimit.Limiter
+	policy    validation.Policy
+	retention model.Retention
+	origins   []string
 }
 
 type pathParts struct {
@@ -38,8 +53,9 @@ type Option func(h *Handler)
 func NewHandler(store storage.Storage, opts ...Option) *Handler {
 	logger := zap.NewNop()
 	h := &Handler{
-		store: store,
-		log:   logger,
+		store:  store,
+		log:    logger,
+		policy: validation.DefaultPolicy(),
 	}
 	for _, o := range opts {
 		o(h)
@@ -52,6 +68,57 @@ func WithLogger(l *zap.Logger) Option {
 	}
 }
 
+func WithValidationPolicy(p validation.Policy) Option {
+	return func(h *Handler) {
+		h.policy = p
+	}
+}
+
+// WithRetention lets range queries read rollups once raw samples are gone.
+func WithRetention(r model.Retention) Option {
+	return func(h *Handler) {
+		h.retention = r
+	}
+}
+
+func WithRateLimiter(l *ratelimit.Limiter) Option {
+	return func(h *Handler) {
+		h.limiter = l
+	}
+}
+
+// WithAllowedOrigins lets pages of other origins, such as
+// https://dash.example.com, open the WebSocket stream.
+func WithAllowedOrigins(origins []string) Option {
+	return func(h *Handler) {
+		for _, o := range origins {
+			o = strings.TrimRight(strings.TrimSpace(o), "/")
+			if o != "" {
+				h.origins = append(h.origins, o)
+			}
+		}
+	}
+}
+
+// allow charges the client for ids. When the client is over its quota the
+// 429 response is already written and returned as err.
+func (h *Handler) allow(c echo.Context, ids ...string) (bool, error) {
+	if h.limiter == nil {
+		return true, nil
+	}
+	// The peer address, not RealIP: forwarding headers are set by the client
+	// and a new value per request would get a fresh quota.
+	clientID := tenant.FromContext(c.Request().Context()) + "@" + echo.ExtractIPDirect()(c.Request())
+	retry, err := h.limiter.Allow(clientID, ids)
+	if err == nil {
+		return true, nil
+	}
+	h.log.Info("client over quota", zap.String("client", clientID), zap.Error(err))
+	seconds := int(math.Ceil(retry.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return false, errorJSON(c, http.StatusTooManyRequests, err.Error())
+}
+
 func (h *Handler) HandleUpdate(c echo.Context) error {
 	ctx := c.Request().Context()
 	path := trimPath(c.Request().URL.Path)
@@ -59,15 +126,15 @@ func (h *Handler) HandleUpdate(c echo.Context) error {
 	// Not sure that is reasonable check, because echo shouldnt routing
 	// to this handler anythnig except ActionUpdate
 	if path.action != string(ActionUpdate) {
-		return c.String(http.StatusNotFound, fmt.Sprintln("Action not found"))
+		return errorJSON(c, http.StatusNotFound, "Action not found")
 	}
 
 	if path.metricName == "" {
-		return c.String(http.StatusNotFound, fmt.Sprintln("Cant find metric name"))
+		return errorJSON(c, http.StatusNotFound, "Cant find metric name")
 	}
 	// Lets check if value exist and return error if not
 	if path.metricValue == "" {
-		return c.String(http.StatusBadRequest, fmt.Sprintln("Incorrect Value"))
+		return errorJSON(c, http.StatusBadRequest, "Incorrect Value")
 
 	}
 
@@ -79,19 +146,28 @@ func (h *Handler) HandleUpdate(c echo.Context) error {
 	case model.Gauge:
 		value, err := strconv.ParseFloat(path.metricValue, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, fmt.Sprintln("Error converting metric"))
+			return errorJSON(c, http.StatusBadRequest, "Error converting metric")
 		}
 		metric.Value = &value
-		_, _ = h.store.UpdateMetric(ctx, metric)
 	case model.Counter:
 		value, err := strconv.ParseInt(path.metricValue, 10, 64)
 		if err != nil {
-			return c.String(http.StatusBadRequest, fmt.Sprintln("Error converting metric"))
+			return errorJSON(c, http.StatusBadRequest, "Error converting metric")
 		}
 		metric.Delta = &value
-		_, _ = h.store.UpdateMetric(ctx, metric)
 	default:
-		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid metric type: %s", path.metricType))
+		return errorJSON(c, http.StatusBadRequest, fmt.Sprintf("Invalid metric type: %s", path.metricType))
+	}
+	err := h.policy.Metric(metric)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	if ok, err := h.allow(c, metric.ID); !ok {
+		return err
+	}
+	_, err = h.store.UpdateMetric(ctx, metric)
+	if err != nil {
+		return storeError(c, err)
 	}
 
 	return c.String(http.StatusOK, fmt.Sprintln("Metric Updated"))
@@ -117,17 +193,31 @@ func getElement(parts []string, index int) string {
 	return parts[index]
 }
 
+// HandleAllMetrics serves the dashboard to browsers and one
+// "id: value (type)" line per metric to everything else, e.g. curl.
 func (h *Handler) HandleAllMetrics(c echo.Context) error {
 	ctx := c.Request().Context()
-	metrics, _ := h.store.GetAllMetrics(ctx)
+	metrics, err := h.store.GetAllMetrics(ctx)
+	if err != nil {
+		return storeError(c, err)
+	}
 
-	var result []string
-	for _, metric := range metrics {
-		result = append(result, fmt.Sprintf("%s: %s (%v)", metric.ID, metric.String(), metric.Type))
+	if wantsHTML(c.Request()) {
+		page := dashboard.NewIndexPage(metrics, c.QueryParam("q"), c.QueryParam("sort"))
+		return h.render(c, func(w io.Writer) error { return dashboard.RenderIndex(w, page) })
 	}
-	response := strings.Join(result, "\n")
 
-	return c.HTML(http.StatusOK, response)
+	ids := make([]string, 0, len(metrics))
+	for id := range metrics {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var b strings.Builder
+	for _, id := range ids {
+		metric := metrics[id]
+		fmt.Fprintf(&b, "%s: %s (%v)\n", metric.ID, metric.String(), metric.Type)
+	}
+	return c.String(http.StatusOK, b.String())
 }
 
 func (h *Handler) HandleMetrics(c echo.Context) error {
@@ -135,18 +225,19 @@ func (h *Handler) HandleMetrics(c echo.Context) error {
 	path := trimPath(c.Request().URL.Path)
 
 	if path.action != string(ActionValue) {
-		return c.String(http.StatusNotFound, fmt.Sprintln("Action not found"))
+		return errorJSON(c, http.StatusNotFound, "Action not found")
 	}
 
 	if path.metricName == "" {
-		return c.String(http.StatusNotFound, fmt.Sprintln("Cant find metric name"))
+		return errorJSON(c, http.StatusNotFound, "Cant find metric name")
 	}
-	if path.metricType != "gauge" && path.metricType != "counter" {
-		return c.String(http.StatusBadRequest, fmt.Sprintf("invalid metric type: %v", path.metricType))
+	err := h.policy.Type(model.MetricType(path.metricType))
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
 	}
 	metric, err := h.store.GetMetric(ctx, path.metricName)
 	if err != nil {
-		return c.String(http.StatusNotFound, fmt.Sprintf("Cant find metric: %s", err))
+		return errorJSON(c, http.StatusNotFound, fmt.Sprintf("Cant find metric: %s", err))
 	}
 
 	return c.String(http.StatusOK, metric.String())
@@ -157,18 +248,21 @@ func (h *Handler) UpdateMetricJSON(c echo.Context) error {
 	var metric model.Metric
 	err := c.Bind(&metric)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid JSON"})
+		return errorJSON(c, http.StatusBadRequest, "Invalid JSON")
 	}
 
-	if metric.ID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid metric name"})
+	err = h.policy.Metric(metric)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
 	}
-
-	if metric.Delta == nil && metric.Value == nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Empty Value"})
+	if ok, err := h.allow(c, metric.ID); !ok {
+		return err
 	}
 
-	m, _ := h.store.UpdateMetric(ctx, metric)
+	m, err := h.store.UpdateMetric(ctx, metric)
+	if err != nil {
+		return storeError(c, err)
+	}
 	return c.JSON(http.StatusOK, echo.Map{"info": m})
 }
 
@@ -177,15 +271,16 @@ func (h *Handler) GetMetricJSON(c echo.Context) error {
 	var metric model.Metric
 	err := c.Bind(&metric)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid JSON"})
+		return errorJSON(c, http.StatusBadRequest, "Invalid JSON")
 	}
 
-	if metric.ID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid metric name"})
+	err = h.policy.Name(metric.ID)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
 	}
 	m, err := h.store.GetMetric(ctx, metric.ID)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, echo.Map{"error": fmt.Sprintf("%v", err)})
+		return errorJSON(c, http.StatusNotFound, err.Error())
 	}
 
 	return c.JSON(http.StatusOK, m)
@@ -197,7 +292,7 @@ func (h *Handler) PingDBHandler(c echo.Context) error {
 
 	err := h.store.Ping(ctx)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB is not OK"})
+		return errorJSON(c, http.StatusInternalServerError, "DB is not OK")
 	}
 	return c.JSON(http.StatusOK, echo.Map{"info": "DB is OK"})
 
@@ -209,11 +304,35 @@ func (h *Handler) BatchHandler(c echo.Context) error {
 
 	err := c.Bind(&metrics)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": err})
+		return errorJSON(c, http.StatusBadRequest, "Invalid JSON")
+	}
+	if len(metrics) == 0 {
+		return errorJSON(c, http.StatusBadRequest, "Empty batch")
+	}
+	if errs := h.policy.Batch(metrics); len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   fmt.Sprintf("%d of %d metrics are invalid", len(errs), len(metrics)),
+			Details: errs,
+		})
+	}
+	ids := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		ids = append(ids, m.ID)
+	}
+	if ok, err := h.allow(c, ids...); !ok {
+		return err
+	}
+	dropped := 0
+	if d, ok := h.store.(storage.BatchDropper); ok {
+		dropped, err = d.UpdateMetricBatchDropped(ctx, metrics)
+	} else {
+		err = h.store.UpdateMetricBatch(ctx, metrics)
 	}
-	err = h.store.UpdateMetricBatch(ctx, metrics)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": fmt.Sprintf("%v", err)})
+		return storeError(c, err)
+	}
+	if dropped > 0 {
+		c.Response().Header().Set(HeaderMetricsDropped, strconv.Itoa(dropped))
 	}
 	return c.JSON(http.StatusOK, metrics)
 }
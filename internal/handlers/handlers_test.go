@@ -2,17 +2,21 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/labstack/echo/v4"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/ratelimit"
 	"github.com/randomtoy/gometrics/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
 )
 
 func TestHandlers_HandleUpdate(t *testing.T) {
@@ -140,6 +144,25 @@ func TestHandler_HandleAllMetrics(t *testing.T) {
 	body, _ := io.ReadAll(rec.Body)
 	assert.Contains(t, string(body), "TestGauge")
 	assert.Contains(t, string(body), "TestCounter")
+	assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), echo.MIMETextPlain))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderAccept, "text/html,application/xhtml+xml")
+	rec = httptest.NewRecorder()
+	assert.NoError(t, handler.HandleAllMetrics(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), echo.MIMETextHTML))
+	assert.Contains(t, rec.Body.String(), `<a href="/metric/TestGauge">TestGauge</a>`)
+
+	req = httptest.NewRequest(http.MethodGet, "/metric/TestCounter", nil)
+	req.Header.Set(echo.HeaderAccept, "text/html")
+	rec = httptest.NewRecorder()
+	ctx = e.NewContext(req, rec)
+	ctx.SetParamNames("name")
+	ctx.SetParamValues("TestCounter")
+	assert.NoError(t, handler.MetricPage(ctx))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<h1>TestCounter")
 }
 
 func TestHandler_HandleGetMetric(t *testing.T) {
@@ -232,3 +255,236 @@ func TestHandler_HandleGetMetric(t *testing.T) {
 	})
 
 }
+
+func TestHandler_BatchHandler(t *testing.T) {
+	l := zap.NewNop()
+	e := echo.New()
+	store, err := storage.NewStorage(l, model.Config{})
+	assert.NoError(t, err)
+	handler := NewHandler(store)
+
+	t.Run("Invalid entries are reported", func(t *testing.T) {
+		body := `[{"id":"Alloc","type":"gauge","value":1},{"id":"Bad","type":"gauge","delta":1},{"id":"","type":"counter","delta":1}]`
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		err := handler.BatchHandler(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		var resp ErrorResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Len(t, resp.Details, 2)
+		assert.Equal(t, 1, resp.Details[0].Index)
+		assert.Equal(t, 2, resp.Details[1].Index)
+
+		_, err = store.GetMetric(context.Background(), "Alloc")
+		assert.Error(t, err)
+	})
+
+	t.Run("Valid batch", func(t *testing.T) {
+		body := `[{"id":"Alloc","type":"gauge","value":1},{"id":"PollCount","type":"counter","delta":1}]`
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		err := handler.BatchHandler(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		_, err = store.GetMetric(context.Background(), "Alloc")
+		assert.NoError(t, err)
+		assert.JSONEq(t, body, rec.Body.String())
+		assert.Empty(t, rec.Header().Get(HeaderMetricsDropped))
+	})
+
+	t.Run("Dropped series are reported", func(t *testing.T) {
+		config := model.Config{}
+		config.Server.MaxSeries = 1
+		config.Server.SeriesOverflow = string(storage.OverflowDrop)
+		store, err := storage.NewStorage(l, config)
+		assert.NoError(t, err)
+		handler := NewHandler(store)
+
+		body := `[{"id":"Alloc","type":"gauge","value":1},{"id":"Sys","type":"gauge","value":1},{"id":"Alloc","type":"gauge","value":2}]`
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		err = handler.BatchHandler(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, body, rec.Body.String())
+		assert.Equal(t, "1", rec.Header().Get(HeaderMetricsDropped))
+
+		req = httptest.NewRequest(http.MethodPost, "/update/gauge/HeapSys/1", nil)
+		rec = httptest.NewRecorder()
+		err = handler.HandleUpdate(e.NewContext(req, rec))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.Contains(t, rec.Body.String(), storage.ErrSeriesDropped.Error())
+	})
+}
+
+func TestHandler_RateLimitIgnoresForwardingHeaders(t *testing.T) {
+	e := echo.New()
+	store, err := storage.NewStorage(zap.NewNop(), model.Config{})
+	assert.NoError(t, err)
+	handler := NewHandler(store, WithRateLimiter(ratelimit.NewLimiter(ratelimit.Config{Rate: 0.001, Burst: 1})))
+
+	codes := make([]int, 0, 2)
+	for i := 0; i < 2; i++ {
+		body := `{"id":"Alloc","type":"gauge","value":1}`
+		req := httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, fmt.Sprintf("10.0.0.%d", i))
+		req.Header.Set(echo.HeaderXRealIP, fmt.Sprintf("10.0.1.%d", i))
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler.UpdateMetricJSON(e.NewContext(req, rec)))
+		codes = append(codes, rec.Code)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestHandler_ListMetrics(t *testing.T) {
+	l := zap.NewNop()
+	e := echo.New()
+	store, err := storage.NewStorage(l, model.Config{})
+	assert.NoError(t, err)
+	handler := NewHandler(store)
+
+	value := float64(1)
+	delta := int64(1)
+	ids := []string{"Alloc", "CPUutilization0", "CPUutilization1", "CPUutilization2", "Frees"}
+	for _, id := range ids {
+		_, err := store.UpdateMetric(context.Background(), model.Metric{ID: id, Type: model.Gauge, Value: &value})
+		assert.NoError(t, err)
+	}
+	_, err = store.UpdateMetric(context.Background(), model.Metric{ID: "PollCount", Type: model.Counter, Delta: &delta})
+	assert.NoError(t, err)
+
+	list := func(query string) (int, listResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/metrics?"+query, nil)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler.ListMetrics(e.NewContext(req, rec)))
+		var resp listResponse
+		if rec.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		}
+		return rec.Code, resp
+	}
+	names := func(metrics []model.Metric) []string {
+		var result []string
+		for _, m := range metrics {
+			result = append(result, m.ID)
+		}
+		return result
+	}
+
+	t.Run("Pages in ID order", func(t *testing.T) {
+		var got []string
+		cursor := ""
+		for {
+			code, resp := list("type=gauge&limit=2&cursor=" + cursor)
+			assert.Equal(t, http.StatusOK, code)
+			got = append(got, names(resp.Metrics)...)
+			if resp.NextCursor == "" {
+				break
+			}
+			cursor = resp.NextCursor
+		}
+		assert.Equal(t, ids, got)
+	})
+
+	t.Run("Prefix and regex", func(t *testing.T) {
+		_, resp := list("prefix=CPU&regex=[02]$")
+		assert.Equal(t, []string{"CPUutilization0", "CPUutilization2"}, names(resp.Metrics))
+		assert.Empty(t, resp.NextCursor)
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		code, _ := list("regex=(")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = list("limit=0")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = list("type=histogram")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestHandler_BackupRestore(t *testing.T) {
+	l := zap.NewNop()
+	e := echo.New()
+	src, err := storage.NewStorage(l, model.Config{})
+	assert.NoError(t, err)
+	delta := int64(2)
+	for i := 0; i < 2; i++ {
+		_, err = src.UpdateMetric(context.Background(), model.Metric{ID: "PollCount", Type: model.Counter, Delta: &delta})
+		assert.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, NewHandler(src).Backup(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/gzip", rec.Header().Get(echo.HeaderContentType))
+	backup := rec.Body.Bytes()
+
+	dst, err := storage.NewStorage(l, model.Config{})
+	assert.NoError(t, err)
+	value := float64(1)
+	_, err = dst.UpdateMetric(context.Background(), model.Metric{ID: "Alloc", Type: model.Gauge, Value: &value})
+	assert.NoError(t, err)
+	handler := NewHandler(dst)
+
+	restore := func(query string, body io.Reader) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/restore?"+query, body)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handler.Restore(e.NewContext(req, rec)))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, _ := restore("mode=bogus", strings.NewReader(string(backup)))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = restore("", strings.NewReader(`{"tenant":"default","id":"x","type":"gauge"}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, body := restore("", strings.NewReader(string(backup)))
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"mode":"merge","restored":1}`, body)
+	metrics, _ := dst.GetAllMetrics(context.Background())
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, int64(4), *metrics["PollCount"].Delta)
+
+	code, _ = restore("mode=replace", strings.NewReader(string(backup)))
+	assert.Equal(t, http.StatusOK, code)
+	metrics, _ = dst.GetAllMetrics(context.Background())
+	assert.Len(t, metrics, 1)
+}
+
+func TestHandler_StreamWebSocketOrigin(t *testing.T) {
+	store, err := storage.NewStorage(zap.NewNop(), model.Config{})
+	assert.NoError(t, err)
+	handler := NewHandler(store, WithAllowedOrigins([]string{" https://dash.example.com/ "}))
+	e := echo.New()
+	e.GET("/api/v1/ws", handler.StreamWebSocket)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/ws"
+	for origin, ok := range map[string]bool{
+		srv.URL:                    true,
+		"https://dash.example.com": true,
+		"https://evil.example.com": false,
+		"http://dash.example.com":  false,
+	} {
+		ws, err := websocket.Dial(url, "", origin)
+		if ok {
+			assert.NoError(t, err, origin)
+			ws.Close()
+		} else {
+			assert.Error(t, err, origin)
+		}
+	}
+}
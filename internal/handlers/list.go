@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/randomtoy/gometrics/internal/model"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type listResponse struct {
+	Metrics    []model.Metric `json:"metrics"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// ListMetrics serves GET /api/v1/metrics. Metrics are ordered by ID and
+// paged with an opaque cursor returned as next_cursor.
+func (h *Handler) ListMetrics(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	filter := model.ListFilter{
+		Type:   model.MetricType(c.QueryParam("type")),
+		Prefix: c.QueryParam("prefix"),
+		Regex:  c.QueryParam("regex"),
+		Limit:  defaultPageSize,
+	}
+	if filter.Type != "" {
+		if err := h.policy.Type(filter.Type); err != nil {
+			return errorJSON(c, http.StatusBadRequest, err.Error())
+		}
+	}
+	if filter.Regex != "" {
+		if _, err := regexp.Compile(filter.Regex); err != nil {
+			return errorJSON(c, http.StatusBadRequest, "Invalid regex")
+		}
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return errorJSON(c, http.StatusBadRequest, "Invalid limit")
+		}
+		filter.Limit = limit
+	}
+	if s := c.QueryParam("cursor"); s != "" {
+		after, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return errorJSON(c, http.StatusBadRequest, "Invalid cursor")
+		}
+		filter.After = string(after)
+	}
+
+	// One extra row tells whether another page exists.
+	page := filter.Limit
+	filter.Limit++
+	metrics, err := h.store.ListMetrics(ctx, filter)
+	if err != nil {
+		return storeError(c, err)
+	}
+	resp := listResponse{Metrics: metrics}
+	if len(metrics) > page {
+		resp.Metrics = metrics[:page]
+		last := resp.Metrics[page-1].ID
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
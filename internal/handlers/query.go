@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/query"
+	"github.com/randomtoy/gometrics/internal/series"
+)
+
+const (
+	defaultRange = time.Hour
+	defaultStep  = time.Minute
+	maxPoints    = 11000
+)
+
+type rangeResponse struct {
+	Name        string             `json:"name"`
+	Type        model.MetricType   `json:"type"`
+	Aggregation series.Aggregation `json:"aggregation"`
+	Step        float64            `json:"step"`
+	Points      []model.Sample     `json:"points"`
+}
+
+// parseTime accepts RFC 3339 and unix seconds with optional fraction.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+// parseStep accepts Go durations and plain seconds.
+func parseStep(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid step %q", s)
+	}
+	return d, nil
+}
+
+// QueryRange serves GET /api/v1/query_range. Points are aggregated over
+// buckets of step length starting at start.
+func (h *Handler) QueryRange(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	name := c.QueryParam("name")
+	err := h.policy.Name(name)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	end, err := parseTime(c.QueryParam("end"), time.Now())
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	start, err := parseTime(c.QueryParam("start"), end.Add(-defaultRange))
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	step, err := parseStep(c.QueryParam("step"), defaultStep)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	if step <= 0 || end.Before(start) {
+		return errorJSON(c, http.StatusBadRequest, "step must be positive and end not before start")
+	}
+	if end.Sub(start)/step > maxPoints {
+		return errorJSON(c, http.StatusBadRequest, fmt.Sprintf("query would return more than %d points, increase step", maxPoints))
+	}
+	agg := series.Avg
+	if v := c.QueryParam("agg"); v != "" {
+		agg, err = series.ParseAggregation(v)
+		if err != nil {
+			return errorJSON(c, http.StatusBadRequest, err.Error())
+		}
+	}
+
+	m, err := h.store.GetMetric(ctx, name)
+	if err != nil {
+		return storeError(c, err)
+	}
+	if agg == series.Rate && m.Type != model.Counter {
+		return errorJSON(c, http.StatusBadRequest, "rate is only defined for counters")
+	}
+	points, err := h.rangePoints(ctx, name, start, end, step, agg)
+	if err != nil {
+		return storeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, rangeResponse{
+		Name:        name,
+		Type:        m.Type,
+		Aggregation: agg,
+		Step:        step.Seconds(),
+		Points:      points,
+	})
+}
+
+// rangePoints reads the tier picked by the retention policy. Rollups only
+// cover completed buckets, so the tail after the newest one is filled from
+// raw samples.
+func (h *Handler) rangePoints(ctx context.Context, name string, start, end time.Time, step time.Duration, agg series.Aggregation) ([]model.Sample, error) {
+	// One extra step back gives rate a base value for the first bucket.
+	from, to := start.Add(-step), end.Add(step)
+	res := h.retention.Resolution(time.Now(), start, step)
+	if res == 0 {
+		samples, err := h.store.GetSamples(ctx, name, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return series.Bucket(samples, start, end, step, agg), nil
+	}
+
+	rollups, err := h.store.GetRollups(ctx, name, res, from, to)
+	if err != nil {
+		return nil, err
+	}
+	tail := from
+	if len(rollups) > 0 {
+		tail = rollups[len(rollups)-1].Time.Add(res)
+	}
+	if tail.Before(to) {
+		samples, err := h.store.GetSamples(ctx, name, tail, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples {
+			rollups = append(rollups, model.RollupOf(s))
+		}
+	}
+	return series.BucketRollups(rollups, start, end, step, agg), nil
+}
+
+// Query serves GET /api/v1/query, evaluating an expression of the query
+// package at the given time.
+func (h *Handler) Query(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	q := c.QueryParam("query")
+	if q == "" {
+		return errorJSON(c, http.StatusBadRequest, "query is required")
+	}
+	at, err := parseTime(c.QueryParam("time"), time.Now())
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	res, err := query.Eval(ctx, h.store, q, at)
+	if err != nil {
+		return errorJSON(c, http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+
+	"github.com/randomtoy/gometrics/internal/storage"
+)
+
+const (
+	streamHeartbeat = 15 * time.Second
+	// wsWriteTimeout bounds a write to a stalled WebSocket client. While it
+	// blocks the subscription buffer fills up and the client is dropped.
+	wsWriteTimeout = 10 * time.Second
+)
+
+func streamFilter(c echo.Context) storage.FeedFilter {
+	return storage.FeedFilter{
+		Name:   c.QueryParam("name"),
+		Prefix: c.QueryParam("prefix"),
+	}
+}
+
+func (h *Handler) subscribe(ctx context.Context, filter storage.FeedFilter) (*storage.Subscription, error) {
+	s, ok := h.store.(storage.Subscriber)
+	if !ok {
+		return nil, storage.ErrNoFeed
+	}
+	return s.Subscribe(ctx, filter)
+}
+
+// Stream serves GET /api/v1/stream as Server-Sent Events. Each update is a
+// "metric" event with the metric as JSON. A subscriber that falls behind
+// gets an "error" event and is disconnected.
+func (h *Handler) Stream(c echo.Context) error {
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	sub, err := h.subscribe(ctx, streamFilter(c))
+	if err != nil {
+		return errorJSON(c, http.StatusNotImplemented, err.Error())
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case m, ok := <-sub.C:
+			if !ok {
+				if errors.Is(sub.Err(), storage.ErrSlowConsumer) {
+					data, _ := json.Marshal(ErrorResponse{Error: sub.Err().Error()})
+					fmt.Fprintf(res, "event: error\ndata: %s\n\n", data)
+					res.Flush()
+				}
+				return nil
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				return fmt.Errorf("cant encode metric: %w", err)
+			}
+			fmt.Fprintf(res, "event: metric\ndata: %s\n\n", data)
+			res.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(res, ": ping\n\n")
+			res.Flush()
+		}
+	}
+}
+
+// StreamWebSocket serves GET /api/v1/ws. Every update is sent as a JSON
+// text message; the filters are the same as for Stream.
+func (h *Handler) StreamWebSocket(c echo.Context) error {
+	filter := streamFilter(c)
+	if _, ok := h.store.(storage.Subscriber); !ok {
+		return errorJSON(c, http.StatusNotImplemented, storage.ErrNoFeed.Error())
+	}
+
+	server := websocket.Server{Handshake: h.checkOrigin, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+
+		sub, err := h.subscribe(ctx, filter)
+		if err != nil {
+			return
+		}
+		// Clients are not expected to send anything, reading only notices
+		// when they go away.
+		go func() {
+			_, _ = io.Copy(io.Discard, ws)
+			cancel()
+		}()
+		for m := range sub.C {
+			_ = ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := websocket.JSON.Send(ws, m); err != nil {
+				h.log.Debug("websocket send failed", zap.Error(err))
+				return
+			}
+		}
+		if errors.Is(sub.Err(), storage.ErrSlowConsumer) {
+			_ = ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			_ = websocket.JSON.Send(ws, ErrorResponse{Error: sub.Err().Error()})
+		}
+	}}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// checkOrigin refuses WebSocket handshakes from pages of other origins than
+// the server's own and the allowed ones, so a page can't subscribe with the
+// credentials of its visitor. Clients that send no Origin are not browsers
+// and are let through.
+func (h *Handler) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return nil
+	}
+	if origin.Host == r.Host {
+		return nil
+	}
+	for _, o := range h.origins {
+		if o == origin.Scheme+"://"+origin.Host {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
@@ -0,0 +1,218 @@
+// Package ingest lets apps on the agent's host push metrics through it, so
+// they share its batching, signing and retries.
+package ingest
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/validation"
+	"go.uber.org/zap"
+)
+
+// maxBody caps a request body after decompression.
+const maxBody = 10 << 20
+
+// Sink receives accepted metrics. It refuses a batch changing the type of
+// a metric it knows with model.ErrTypeConflict.
+type Sink interface {
+	Accept(metrics []model.Metric) error
+}
+
+type errorResponse struct {
+	Error   string                 `json:"error"`
+	Details []validation.ItemError `json:"details,omitempty"`
+}
+
+// Listener serves POST /updates/ with the server's batch format and POST
+// /update/ with a single metric, on TCP, a Unix socket or both. With a
+// token, every request must carry it as a bearer token.
+type Listener struct {
+	log    *zap.SugaredLogger
+	addr   string
+	socket string
+	token  string
+	sink   Sink
+	policy validation.Policy
+}
+
+func NewListener(l *zap.SugaredLogger, config model.AgentConfig, sink Sink) *Listener {
+	return &Listener{
+		log:    l,
+		addr:   config.IngestAddr,
+		socket: config.IngestSocket,
+		token:  config.IngestToken,
+		sink:   sink,
+		policy: validation.DefaultPolicy(),
+	}
+}
+
+func (l *Listener) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /updates/", func(w http.ResponseWriter, r *http.Request) {
+		var metrics []model.Metric
+		if !l.decode(w, r, &metrics) {
+			return
+		}
+		invalid := l.policy.Batch(metrics)
+		if len(invalid) > 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Invalid metrics", Details: invalid})
+			return
+		}
+		if !l.accept(w, metrics) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"accepted": len(metrics)})
+	})
+	mux.HandleFunc("POST /update/", func(w http.ResponseWriter, r *http.Request) {
+		var m model.Metric
+		if !l.decode(w, r, &m) {
+			return
+		}
+		if err := l.policy.Metric(m); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		if !l.accept(w, []model.Metric{m}) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"accepted": 1})
+	})
+	if l.token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + l.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "Invalid token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// accept hands metrics to the sink and answers 409 when it refuses them.
+func (l *Listener) accept(w http.ResponseWriter, metrics []model.Metric) bool {
+	err := l.sink.Accept(metrics)
+	switch {
+	case errors.Is(err, model.ErrTypeConflict):
+		writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error()})
+		return false
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return false
+	}
+	return true
+}
+
+// decode reads a JSON body, gzip'd or not, and answers 400 when it can't.
+func (l *Listener) decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Failed to decompress gzip"})
+			return false
+		}
+		defer gz.Close()
+		body = gz
+	}
+	err := json.NewDecoder(io.LimitReader(body, maxBody)).Decode(v)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Invalid JSON"})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (l *Listener) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	if l.addr != "" {
+		// Anyone reaching the address could push metrics signed with the
+		// agent's key, so leaving the host takes a token.
+		if l.token == "" && !loopback(l.addr) {
+			return nil, fmt.Errorf("%s is not a loopback address, set an ingest token to listen on it", l.addr)
+		}
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			return nil, fmt.Errorf("cant listen on %s: %w", l.addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	if l.socket != "" {
+		// A socket left by a previous run would make Listen fail.
+		err := os.Remove(l.socket)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			closeAll(listeners)
+			return nil, fmt.Errorf("cant remove stale socket: %w", err)
+		}
+		ln, err := net.Listen("unix", l.socket)
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("cant listen on %s: %w", l.socket, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// loopback reports whether addr only accepts connections from this host.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// Run serves until ctx is done.
+func (l *Listener) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	listeners, err := l.listen()
+	if err != nil {
+		l.log.Errorf("local ingestion disabled: %v", err)
+		return
+	}
+	srv := &http.Server{Handler: l.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	for _, ln := range listeners {
+		l.log.Infof("accepting local metrics on %s", ln.Addr())
+		go func(ln net.Listener) {
+			err := srv.Serve(ln)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				l.log.Errorf("local ingestion stopped: %v", err)
+			}
+		}(ln)
+	}
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,120 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeSink struct {
+	metrics []model.Metric
+	types   map[string]model.MetricType
+}
+
+func (f *fakeSink) Accept(metrics []model.Metric) error {
+	for _, m := range metrics {
+		if t, ok := f.types[m.ID]; ok && t != m.Type {
+			return model.TypeConflict(m.ID, t, m.Type)
+		}
+	}
+	f.metrics = append(f.metrics, metrics...)
+	return nil
+}
+
+func TestListener_Handler(t *testing.T) {
+	sink := &fakeSink{types: map[string]model.MetricType{"Alloc": model.Gauge}}
+	h := NewListener(zap.NewNop().Sugar(), model.AgentConfig{}, sink).Handler()
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err := w.Write([]byte(`{"id":"Queue","type":"gauge","value":3}`))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	tests := []struct {
+		name     string
+		path     string
+		body     []byte
+		gzip     bool
+		status   int
+		accepted int
+	}{
+		{name: "batch", path: "/updates/", body: []byte(`[{"id":"Orders","type":"counter","delta":2},{"id":"Orders","type":"counter","delta":3}]`), status: http.StatusOK, accepted: 2},
+		{name: "gzip single", path: "/update/", body: gz.Bytes(), gzip: true, status: http.StatusOK, accepted: 1},
+		{name: "invalid json", path: "/updates/", body: []byte(`[{`), status: http.StatusBadRequest},
+		{name: "missing value", path: "/updates/", body: []byte(`[{"id":"Queue","type":"gauge"}]`), status: http.StatusBadRequest},
+		{name: "type conflict", path: "/update/", body: []byte(`{"id":"Alloc","type":"counter","delta":1}`), status: http.StatusConflict},
+		{name: "unknown type", path: "/update/", body: []byte(`{"id":"Queue","type":"histogram","value":1}`), status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink.metrics = nil
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+			assert.Len(t, sink.metrics, tt.accepted)
+		})
+	}
+}
+
+func TestListener_Token(t *testing.T) {
+	sink := &fakeSink{}
+	h := NewListener(zap.NewNop().Sugar(), model.AgentConfig{IngestToken: "secret"}, sink).Handler()
+
+	for _, auth := range []string{"", "Bearer wrong", "Bearer secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader([]byte(`{"id":"Orders","type":"counter","delta":1}`)))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if auth == "Bearer secret" {
+			assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+		}
+	}
+	assert.Len(t, sink.metrics, 1)
+}
+
+func TestListener_Listen(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  string
+		token string
+		ok    bool
+	}{
+		{name: "loopback", addr: "127.0.0.1:0", ok: true},
+		{name: "localhost", addr: "localhost:0", ok: true},
+		{name: "ipv6 loopback", addr: "[::1]:0", ok: true},
+		{name: "all interfaces", addr: ":0"},
+		{name: "all interfaces with token", addr: ":0", token: "secret", ok: true},
+		{name: "unspecified", addr: "0.0.0.0:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewListener(zap.NewNop().Sugar(), model.AgentConfig{IngestAddr: tt.addr, IngestToken: tt.token}, &fakeSink{})
+			listeners, err := l.listen()
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil && tt.addr == "[::1]:0" {
+				t.Skip("no IPv6 loopback")
+			}
+			require.NoError(t, err)
+			closeAll(listeners)
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package janitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Compactor periodically has the storage roll up history and drop what
+// fell out of retention.
+type Compactor struct {
+	log       *zap.SugaredLogger
+	store     storage.Storage
+	retention model.Retention
+	interval  time.Duration
+}
+
+func NewCompactor(l *zap.SugaredLogger, store storage.Storage, retention model.Retention, interval time.Duration) *Compactor {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Compactor{
+		log:       l,
+		store:     store,
+		retention: retention,
+		interval:  interval,
+	}
+}
+
+func (c *Compactor) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			err := c.store.Compact(ctx, start, c.retention)
+			if err != nil {
+				c.log.Errorf("error compacting history: %v", err)
+				continue
+			}
+			c.log.Debugf("compacted history in %s", time.Since(start))
+		}
+	}
+}
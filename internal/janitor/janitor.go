@@ -0,0 +1,135 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/storage"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"go.uber.org/zap"
+)
+
+// Policy maps metric names to how long they may go without a write.
+// Overrides are matched by the longest prefix; a zero TTL never expires.
+type Policy struct {
+	TTL       time.Duration
+	Overrides map[string]time.Duration
+}
+
+func (p Policy) Enabled() bool {
+	if p.TTL > 0 {
+		return true
+	}
+	for _, ttl := range p.Overrides {
+		if ttl > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) TTLFor(id string) time.Duration {
+	ttl := p.TTL
+	longest := -1
+	for prefix, d := range p.Overrides {
+		if strings.HasPrefix(id, prefix) && len(prefix) > longest {
+			ttl = d
+			longest = len(prefix)
+		}
+	}
+	return ttl
+}
+
+// ParseOverrides parses "prefix=duration,prefix=duration".
+func ParseOverrides(s string) (map[string]time.Duration, error) {
+	overrides := make(map[string]time.Duration)
+	if s == "" {
+		return overrides, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		prefix, d, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || prefix == "" {
+			return nil, fmt.Errorf("invalid expire override: %q", pair)
+		}
+		ttl, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expire override %q: %w", pair, err)
+		}
+		overrides[prefix] = ttl
+	}
+	return overrides, nil
+}
+
+// DefaultInterval is used when no positive interval is configured.
+const DefaultInterval = time.Minute
+
+type Janitor struct {
+	log      *zap.SugaredLogger
+	store    storage.Storage
+	policy   Policy
+	interval time.Duration
+}
+
+func NewJanitor(l *zap.SugaredLogger, store storage.Storage, policy Policy, interval time.Duration) *Janitor {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Janitor{
+		log:      l,
+		store:    store,
+		policy:   policy,
+		interval: interval,
+	}
+}
+
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := j.Sweep(ctx, time.Now())
+			if err != nil {
+				j.log.Errorf("error expiring metrics: %v", err)
+			}
+			if n > 0 {
+				j.log.Infof("expired %d stale series", n)
+			}
+		}
+	}
+}
+
+// Sweep expires every series that was not written within its TTL as of now.
+func (j *Janitor) Sweep(ctx context.Context, now time.Time) (int, error) {
+	tenants, err := j.store.ListTenants(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cant list tenants: %w", err)
+	}
+	expired := 0
+	for _, t := range tenants {
+		tctx := tenant.WithTenant(ctx, t)
+		metrics, err := j.store.GetAllMetrics(tctx)
+		if err != nil {
+			return expired, fmt.Errorf("cant get metrics of tenant %s: %w", t, err)
+		}
+		for id, m := range metrics {
+			ttl := j.policy.TTLFor(id)
+			if ttl <= 0 || !m.StaleBefore(now.Add(-ttl)) {
+				continue
+			}
+			ok, err := j.store.ExpireMetric(tctx, id, now.Add(-ttl))
+			if err != nil {
+				return expired, err
+			}
+			if ok {
+				expired++
+			}
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,70 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/memorystorage"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestPolicy_TTLFor(t *testing.T) {
+	p := Policy{
+		TTL: time.Hour,
+		Overrides: map[string]time.Duration{
+			"CPU":            time.Minute,
+			"CPUutilization": 2 * time.Minute,
+			"PollCount":      0,
+		},
+	}
+	assert.Equal(t, time.Hour, p.TTLFor("Alloc"))
+	assert.Equal(t, time.Minute, p.TTLFor("CPUtotal"))
+	assert.Equal(t, 2*time.Minute, p.TTLFor("CPUutilization3"))
+	assert.Equal(t, time.Duration(0), p.TTLFor("PollCount"))
+}
+
+func TestJanitor_Sweep(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	store := memorystorage.NewInMemoryStorage(l, "")
+
+	value := float64(1)
+	store.UpdateMetric(ctx, model.Metric{ID: "Alloc", Type: model.Gauge, Value: &value})
+	store.UpdateMetric(ctx, model.Metric{ID: "CPUutilization0", Type: model.Gauge, Value: &value})
+
+	j := NewJanitor(l, store, Policy{
+		TTL:       time.Hour,
+		Overrides: map[string]time.Duration{"CPU": time.Minute},
+	}, time.Minute)
+
+	n, err := j.Sweep(ctx, time.Now().Add(10*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	metrics, _ := store.GetAllMetrics(ctx)
+	assert.Contains(t, metrics, "Alloc")
+	assert.NotContains(t, metrics, "CPUutilization0")
+}
+
+func TestJanitor_NonPositiveInterval(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		j := NewJanitor(l, memorystorage.NewInMemoryStorage(l, ""), Policy{TTL: time.Hour}, interval)
+		assert.Equal(t, DefaultInterval, j.interval)
+		assert.NotPanics(t, func() { j.Run(ctx) })
+	}
+}
+
+func TestCompactor_NonPositiveInterval(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := NewCompactor(l, memorystorage.NewInMemoryStorage(l, ""), model.Retention{Raw: time.Hour}, 0)
+	assert.Equal(t, DefaultInterval, c.interval)
+	assert.NotPanics(t, func() { c.Run(ctx) })
+}
@@ -3,6 +3,7 @@ package logger
 import (
 	"bytes"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -15,11 +16,21 @@ type responseWriterWithBody struct {
 	body   *bytes.Buffer
 }
 
+// Write keeps a copy of the body for the log line. Event streams never end
+// and backups are binary and large, so neither is copied.
 func (w *responseWriterWithBody) Write(data []byte) (int, error) {
-	_, _ = w.body.Write(data)
+	ct := w.Header().Get(echo.HeaderContentType)
+	if !strings.HasPrefix(ct, "text/event-stream") && ct != "application/gzip" {
+		_, _ = w.body.Write(data)
+	}
 	return w.ResponseWriter.Write(data)
 }
 
+// Unwrap lets http.ResponseController reach Flush and Hijack.
+func (w *responseWriterWithBody) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func ResponseLogger(l zap.SugaredLogger) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
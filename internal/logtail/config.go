@@ -0,0 +1,128 @@
+package logtail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/randomtoy/gometrics/internal/model"
+)
+
+var ErrInvalidConfig = errors.New("invalid log config")
+
+// Config is read from the JSON file given by -log-config:
+//
+//	{
+//	  "state": "/var/lib/gometrics/logtail.json",
+//	  "files": [{
+//	    "path": "/var/log/nginx/access.log",
+//	    "rules": [
+//	      {"name": "NginxRequests_{status}", "pattern": "\" (?P<status>\\d{3}) "},
+//	      {"name": "NginxRequestTime", "type": "gauge", "pattern": "rt=(?P<value>[0-9.]+)"}
+//	    ]
+//	  }]
+//	}
+//
+// State defaults to the config path with a .state suffix.
+type Config struct {
+	State string       `json:"state"`
+	Files []FileConfig `json:"files"`
+}
+
+type FileConfig struct {
+	Path  string `json:"path"`
+	Rules []Rule `json:"rules"`
+}
+
+// Rule turns matching lines into a metric. Counters count matches, gauges
+// take the capture named by Value, "value" by default. Named captures in
+// braces in Name are replaced by what they matched, which is how labels
+// such as the status code end up in the metric.
+type Rule struct {
+	Name    string           `json:"name"`
+	Pattern string           `json:"pattern"`
+	Type    model.MetricType `json:"type"`
+	Value   string           `json:"value"`
+
+	re *regexp.Regexp
+}
+
+var placeholderRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("cant read log config: %w", err)
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	if config.State == "" {
+		config.State = path + ".state"
+	}
+	for i := range config.Files {
+		f := &config.Files[i]
+		if f.Path == "" {
+			return config, fmt.Errorf("%w: file %d has no path", ErrInvalidConfig, i)
+		}
+		for j := range f.Rules {
+			err = f.Rules[j].compile()
+			if err != nil {
+				return config, fmt.Errorf("%w: %s rule %d: %w", ErrInvalidConfig, f.Path, j, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+func (r *Rule) compile() error {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return err
+	}
+	r.re = re
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	switch r.Type {
+	case "":
+		r.Type = model.Counter
+	case model.Counter:
+	case model.Gauge:
+		if r.Value == "" {
+			r.Value = "value"
+		}
+		if re.SubexpIndex(r.Value) < 0 {
+			return fmt.Errorf("pattern has no capture %q", r.Value)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	for _, m := range placeholderRe.FindAllStringSubmatch(r.Name, -1) {
+		if re.SubexpIndex(m[1]) < 0 {
+			return fmt.Errorf("pattern has no capture %q", m[1])
+		}
+	}
+	return nil
+}
+
+// name fills the placeholders of Name from a match, replacing characters
+// not allowed in metric names.
+func (r *Rule) name(match []string) string {
+	return placeholderRe.ReplaceAllStringFunc(r.Name, func(p string) string {
+		v := match[r.re.SubexpIndex(p[1:len(p)-1])]
+		return strings.Map(func(c rune) rune {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+				c == '_', c == '.', c == ':', c == '-':
+				return c
+			}
+			return '_'
+		}, v)
+	})
+}
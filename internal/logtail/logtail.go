@@ -0,0 +1,342 @@
+// Package logtail follows log files and turns lines matching configured
+// rules into metrics.
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"go.uber.org/zap"
+)
+
+const (
+	pollInterval = time.Second
+	// headLen bytes from the start of a file identify it across restarts.
+	headLen = 256
+	// maxLine caps a line, longer ones are dropped.
+	maxLine = 1 << 20
+)
+
+// Sink receives the metrics of each poll.
+type Sink interface {
+	Ingest(metrics []model.Metric)
+}
+
+// position is what the state file keeps per path.
+type position struct {
+	Offset int64  `json:"offset"`
+	Head   uint64 `json:"head"`
+}
+
+type follower struct {
+	path  string
+	rules []Rule
+
+	f      *os.File
+	offset int64
+	// partial is a line not terminated yet, its bytes are past offset.
+	partial []byte
+	// saved is the position restored from the state file, used once.
+	saved   *position
+	started bool
+}
+
+// Source follows the configured files. Files found at start are read from
+// the saved offset, or from the end when there is none, and files appearing
+// later, rotated or truncated are read from the start.
+type Source struct {
+	log       *zap.SugaredLogger
+	followers []*follower
+	statePath string
+	interval  time.Duration
+	sink      Sink
+}
+
+func NewSource(l *zap.SugaredLogger, config model.AgentConfig, sink Sink) (*Source, error) {
+	c, err := LoadConfig(config.LogConfig)
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadState(c.State)
+	if err != nil {
+		return nil, err
+	}
+	s := &Source{
+		log:       l,
+		statePath: c.State,
+		interval:  pollInterval,
+		sink:      sink,
+	}
+	for _, fc := range c.Files {
+		t := &follower{path: fc.Path, rules: fc.Rules}
+		if pos, ok := state[fc.Path]; ok {
+			t.saved = &pos
+		}
+		s.followers = append(s.followers, t)
+	}
+	return s, nil
+}
+
+func (s *Source) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer s.close()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metrics := s.poll()
+			if len(metrics) > 0 {
+				s.sink.Ingest(metrics)
+			}
+			err := s.saveState()
+			if err != nil {
+				s.log.Warnf("cant save log offsets: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Source) close() {
+	err := s.saveState()
+	if err != nil {
+		s.log.Warnf("cant save log offsets: %v", err)
+	}
+	for _, t := range s.followers {
+		if t.f != nil {
+			t.f.Close()
+		}
+	}
+}
+
+// poll reads what was appended to every file since the last poll.
+func (s *Source) poll() []model.Metric {
+	counts := make(map[string]int64)
+	gauges := make(map[string]float64)
+	for _, t := range s.followers {
+		err := t.poll(func(line []byte) {
+			for i := range t.rules {
+				apply(&t.rules[i], line, counts, gauges)
+			}
+		})
+		if err != nil {
+			s.log.Warnf("cant follow %s: %v", t.path, err)
+		}
+	}
+
+	metrics := make([]model.Metric, 0, len(counts)+len(gauges))
+	for name, d := range counts {
+		metrics = append(metrics, model.Metric{ID: name, Type: model.Counter, Delta: &d})
+	}
+	for name, v := range gauges {
+		metrics = append(metrics, model.Metric{ID: name, Type: model.Gauge, Value: &v})
+	}
+	return metrics
+}
+
+func apply(r *Rule, line []byte, counts map[string]int64, gauges map[string]float64) {
+	match := r.re.FindSubmatch(line)
+	if match == nil {
+		return
+	}
+	groups := make([]string, len(match))
+	for i, g := range match {
+		groups[i] = string(g)
+	}
+	name := r.name(groups)
+	if r.Type == model.Counter {
+		counts[name]++
+		return
+	}
+	v, err := strconv.ParseFloat(groups[r.re.SubexpIndex(r.Value)], 64)
+	if err == nil {
+		gauges[name] = v
+	}
+}
+
+func (t *follower) poll(emit func([]byte)) error {
+	info, statErr := os.Stat(t.path)
+	if t.f != nil {
+		current, err := t.f.Stat()
+		if err != nil {
+			return err
+		}
+		switch {
+		case statErr != nil || !os.SameFile(current, info):
+			// Rotated: finish the old file, then move to the new one once
+			// it exists.
+			err = t.read(emit)
+			if statErr != nil {
+				return err
+			}
+			t.f.Close()
+			t.f = nil
+		case info.Size() < t.offset:
+			t.offset = 0
+			t.partial = nil
+		}
+	}
+	if t.f == nil {
+		if statErr != nil {
+			if errors.Is(statErr, os.ErrNotExist) {
+				// Whatever shows up later is new.
+				t.started = true
+				return nil
+			}
+			return statErr
+		}
+		err := t.open()
+		if err != nil {
+			return err
+		}
+	}
+	return t.read(emit)
+}
+
+func (t *follower) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	t.f = f
+	t.offset = 0
+	t.partial = nil
+	if t.started {
+		return nil
+	}
+	t.started = true
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if t.saved == nil {
+		t.offset = info.Size()
+		return nil
+	}
+	if info.Size() >= t.saved.Offset {
+		head, err := headHash(f, t.saved.Offset)
+		if err == nil && head == t.saved.Head {
+			t.offset = t.saved.Offset
+		}
+	}
+	t.saved = nil
+	return nil
+}
+
+func (t *follower) read(emit func([]byte)) error {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := t.f.ReadAt(buf, t.offset)
+		t.offset += int64(n)
+		data := buf[:n]
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if len(t.partial) > 0 {
+				emit(append(t.partial, data[:i]...))
+				t.partial = t.partial[:0]
+			} else {
+				emit(data[:i])
+			}
+			data = data[i+1:]
+		}
+		if len(t.partial)+len(data) > maxLine {
+			t.partial = t.partial[:0]
+		} else {
+			t.partial = append(t.partial, data...)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// committed is the offset of the last full line read.
+func (t *follower) committed() int64 {
+	return t.offset - int64(len(t.partial))
+}
+
+func headHash(f *os.File, offset int64) (uint64, error) {
+	buf := make([]byte, min(offset, headLen))
+	_, err := f.ReadAt(buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	h.Write(buf)
+	return h.Sum64(), nil
+}
+
+func loadState(path string) (map[string]position, error) {
+	state := make(map[string]position)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant read log offsets: %w", err)
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("cant parse log offsets: %w", err)
+	}
+	return state, nil
+}
+
+// saveState writes the offsets of open files, replacing the state file
+// atomically. Files not opened yet keep their saved position.
+func (s *Source) saveState() error {
+	state := make(map[string]position, len(s.followers))
+	for _, t := range s.followers {
+		switch {
+		case t.f != nil:
+			offset := t.committed()
+			head, err := headHash(t.f, offset)
+			if err != nil {
+				return err
+			}
+			state[t.path] = position{Offset: offset, Head: head}
+		case t.saved != nil:
+			state[t.path] = *t.saved
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.statePath), filepath.Base(s.statePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.statePath)
+}
@@ -0,0 +1,115 @@
+package logtail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeConfig(t *testing.T, dir, logPath string) string {
+	t.Helper()
+	config := `{"files": [{"path": "` + logPath + `", "rules": [
+		{"name": "Requests_{status}", "pattern": "status=(?P<status>\\d+)"},
+		{"name": "RequestTime", "type": "gauge", "pattern": "rt=(?P<value>[0-9.]+)"}
+	]}]}`
+	path := filepath.Join(dir, "logtail.json")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+	return path
+}
+
+func appendLines(t *testing.T, path, lines string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(lines)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// values flattens a poll into counter deltas and gauge values.
+func values(metrics []model.Metric) map[string]float64 {
+	res := make(map[string]float64)
+	for _, m := range metrics {
+		if m.Type == model.Counter {
+			res[m.ID] = float64(*m.Delta)
+		} else {
+			res[m.ID] = *m.Value
+		}
+	}
+	return res
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	c, err := LoadConfig(writeConfig(t, dir, "/var/log/app.log"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "logtail.json.state"), c.State)
+	require.Len(t, c.Files[0].Rules, 2)
+	assert.Equal(t, model.Counter, c.Files[0].Rules[0].Type)
+
+	bad := []string{
+		`{"files": [{"path": "a", "rules": [{"name": "X_{missing}", "pattern": "x"}]}]}`,
+		`{"files": [{"path": "a", "rules": [{"name": "X", "type": "gauge", "pattern": "x"}]}]}`,
+		`{"files": [{"path": "a", "rules": [{"name": "X", "pattern": "("}]}]}`,
+		`{"files": [{"rules": []}]}`,
+	}
+	for _, config := range bad {
+		path := filepath.Join(dir, "bad.json")
+		require.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+		_, err = LoadConfig(path)
+		assert.ErrorIs(t, err, ErrInvalidConfig, config)
+	}
+}
+
+func TestSource_Follow(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendLines(t, logPath, "status=500 rt=9\n")
+	agent := model.AgentConfig{LogConfig: writeConfig(t, dir, logPath)}
+
+	s, err := NewSource(zap.NewNop().Sugar(), agent, nil)
+	require.NoError(t, err)
+
+	// Lines written before the first start are skipped.
+	assert.Empty(t, s.poll())
+
+	appendLines(t, logPath, "status=200 rt=0.5\nstatus=200 rt=1.5\nstatus=404")
+	assert.Equal(t, map[string]float64{"Requests_200": 2, "RequestTime": 1.5}, values(s.poll()))
+
+	// The unterminated line is counted once complete.
+	appendLines(t, logPath, " rt=2\n")
+	assert.Equal(t, map[string]float64{"Requests_404": 1, "RequestTime": 2}, values(s.poll()))
+
+	// Truncated.
+	require.NoError(t, os.Truncate(logPath, 0))
+	appendLines(t, logPath, "status=201\n")
+	assert.Equal(t, map[string]float64{"Requests_201": 1}, values(s.poll()))
+
+	// Rotated: the tail of the old file and the whole new one are read.
+	appendLines(t, logPath, "status=202\n")
+	require.NoError(t, os.Rename(logPath, logPath+".1"))
+	appendLines(t, logPath, "status=203\n")
+	assert.Equal(t, map[string]float64{"Requests_202": 1, "Requests_203": 1}, values(s.poll()))
+
+	// Restarted: resumes from the saved offset.
+	appendLines(t, logPath, "status=204\n")
+	s.close()
+	appendLines(t, logPath, "status=205\n")
+	s, err = NewSource(zap.NewNop().Sugar(), agent, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Requests_204": 1, "Requests_205": 1}, values(s.poll()))
+
+	// Restarted after rotation: the new file is read from the start.
+	s.close()
+	require.NoError(t, os.Rename(logPath, logPath+".2"))
+	appendLines(t, logPath, "status=206\n")
+	s, err = NewSource(zap.NewNop().Sugar(), agent, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Requests_206": 1}, values(s.poll()))
+	s.close()
+}
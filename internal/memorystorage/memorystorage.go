@@ -3,53 +3,405 @@ package memorystorage
 import (
 	"context"
 	"fmt"
+	"maps"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/randomtoy/gometrics/internal/dump"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
 	"go.uber.org/zap"
 )
 
 type InMemoryStorage struct {
 	Mutex   sync.Mutex
 	Metrics map[string]model.Metric
+	// History holds samples per storage key in time order. FileStorage
+	// persists it with millisecond precision.
+	History map[string][]model.Sample
+	// Rollups holds the compacted history per resolution and storage key.
+	// FileStorage persists it as well.
+	Rollups map[time.Duration]map[string][]model.Rollup
 	log     *zap.SugaredLogger
 }
 
 func NewInMemoryStorage(l *zap.SugaredLogger, path string) *InMemoryStorage {
 	return &InMemoryStorage{
 		Metrics: make(map[string]model.Metric),
+		History: make(map[string][]model.Sample),
+		Rollups: make(map[time.Duration]map[string][]model.Rollup),
 		log:     l,
 	}
 }
 
+func (s *InMemoryStorage) record(key string, m model.Metric) {
+	s.History[key] = append(s.History[key], m.Sample(*m.UpdatedAt))
+}
+
+// RollupsOf returns the rollups of key by resolution. Caller must hold the
+// Mutex.
+func (s *InMemoryStorage) RollupsOf(key string) map[time.Duration][]model.Rollup {
+	var res map[time.Duration][]model.Rollup
+	for r, rollups := range s.Rollups {
+		if len(rollups[key]) == 0 {
+			continue
+		}
+		if res == nil {
+			res = make(map[time.Duration][]model.Rollup)
+		}
+		res[r] = rollups[key]
+	}
+	return res
+}
+
+// GetAllRollups returns the rollups of id by resolution.
+func (s *InMemoryStorage) GetAllRollups(ctx context.Context, id string) (map[time.Duration][]model.Rollup, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	if _, found := s.Metrics[key]; !found {
+		return nil, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	res := s.RollupsOf(key)
+	for r, rollups := range res {
+		res[r] = append([]model.Rollup(nil), rollups...)
+	}
+	return res, nil
+}
+
+// PutRollups replaces the rollups of id.
+func (s *InMemoryStorage) PutRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.putRollups(ctx, id, rollups)
+}
+
+func (s *InMemoryStorage) putRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	if _, found := s.Metrics[key]; !found {
+		return fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	for _, byKey := range s.Rollups {
+		delete(byKey, key)
+	}
+	for r, rs := range rollups {
+		if len(rs) == 0 {
+			continue
+		}
+		if s.Rollups[r] == nil {
+			s.Rollups[r] = make(map[string][]model.Rollup)
+		}
+		s.Rollups[r][key] = rs
+	}
+	return nil
+}
+
+// forget drops the history of key.
+func (s *InMemoryStorage) forget(key string) {
+	delete(s.History, key)
+	for _, rollups := range s.Rollups {
+		delete(rollups, key)
+	}
+}
+
 func (s *InMemoryStorage) UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error) {
-	if metric.Type == model.Counter {
-		existing, found := s.Metrics[metric.ID]
-		if found {
-			metric.Summ(existing.Delta)
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), metric.ID)
+	existing, found := s.Metrics[key]
+	if found && existing.Type != metric.Type {
+		return model.Metric{}, model.TypeConflict(metric.ID, existing.Type, metric.Type)
+	}
+	if found && metric.Type == model.Counter {
+		metric.Summ(existing.Delta)
+	}
+	metric.Touch(time.Now())
+	s.Metrics[key] = metric
+	s.record(key, metric)
+	return s.Metrics[key], nil
+}
+
+// PutSeries stores metric as given, so counters are set rather than added,
+// and splices samples into its history. UpdatedAt is kept when set.
+func (s *InMemoryStorage) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.putSeries(ctx, metric, samples)
+}
+
+func (s *InMemoryStorage) putSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	key := tenant.Key(tenant.FromContext(ctx), metric.ID)
+	existing, found := s.Metrics[key]
+	if found && existing.Type != metric.Type {
+		return model.TypeConflict(metric.ID, existing.Type, metric.Type)
+	}
+	if metric.UpdatedAt == nil {
+		metric.Touch(time.Now())
+	}
+	s.Metrics[key] = metric
+	s.History[key] = model.SpliceSamples(s.History[key], samples)
+	return nil
+}
+
+// Backup writes every series to w while holding the Mutex, so writes wait
+// for it to finish.
+func (s *InMemoryStorage) Backup(ctx context.Context, w dump.Writer) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	keys := make([]string, 0, len(s.Metrics))
+	for k := range s.Metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t, _, ok := tenant.SplitKey(k)
+		if !ok {
+			continue
+		}
+		err := w.Write(dump.Record{Tenant: t, Metric: s.Metrics[k], Samples: s.History[k], Rollups: s.RollupsOf(k)})
+		if err != nil {
+			return fmt.Errorf("cant write %s: %w", k, err)
+		}
+	}
+	return w.Close()
+}
+
+// Restore stores the records of r under the Mutex, first dropping every
+// series when replace is set. It works on copies of the maps so a bad
+// record leaves storage untouched.
+func (s *InMemoryStorage) Restore(ctx context.Context, r dump.Reader, replace bool) (int, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	metrics, history, rollups := s.Metrics, s.History, s.Rollups
+	if replace {
+		s.Metrics = make(map[string]model.Metric)
+		s.History = make(map[string][]model.Sample)
+		s.Rollups = make(map[time.Duration]map[string][]model.Rollup)
+	} else {
+		s.Metrics, s.History = maps.Clone(metrics), maps.Clone(history)
+		s.Rollups = make(map[time.Duration]map[string][]model.Rollup, len(rollups))
+		for r, byKey := range rollups {
+			s.Rollups[r] = maps.Clone(byKey)
 		}
 	}
-	s.Metrics[metric.ID] = metric
-	return s.Metrics[metric.ID], nil
+	n, err := dump.Import(ctx, dump.SinkFuncs{Series: s.putSeries, Rollups: s.putRollups}, r)
+	if err != nil {
+		s.Metrics, s.History, s.Rollups = metrics, history, rollups
+		return 0, err
+	}
+	return n, nil
 }
 
 func (s *InMemoryStorage) GetMetric(ctx context.Context, metric string) (model.Metric, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
 
-	m, ok := s.Metrics[metric]
+	m, ok := s.Metrics[tenant.Key(tenant.FromContext(ctx), metric)]
 	if !ok {
-		return model.Metric{}, fmt.Errorf("can't find metric: %s", metric)
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, metric)
 	}
 	return m, nil
 }
 
 func (s *InMemoryStorage) GetAllMetrics(ctx context.Context) (map[string]model.Metric, error) {
-	result := make(map[string]model.Metric, len(s.Metrics))
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	prefix := tenant.Key(tenant.FromContext(ctx), "")
+	result := make(map[string]model.Metric)
 	for k, v := range s.Metrics {
-		result[k] = v
+		if strings.HasPrefix(k, prefix) {
+			result[v.ID] = v
+		}
 	}
 	return result, nil
 }
 
+func (s *InMemoryStorage) ListMetrics(ctx context.Context, filter model.ListFilter) ([]model.Metric, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	prefix := tenant.Key(tenant.FromContext(ctx), "")
+	var metrics []model.Metric
+	for k, v := range s.Metrics {
+		if strings.HasPrefix(k, prefix) {
+			metrics = append(metrics, v)
+		}
+	}
+	return filter.Select(metrics)
+}
+
+func (s *InMemoryStorage) ListTenants(ctx context.Context) ([]string, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	seen := make(map[string]struct{})
+	for k := range s.Metrics {
+		t, _, ok := tenant.SplitKey(k)
+		if ok {
+			seen[t] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(seen))
+	for t := range seen {
+		result = append(result, t)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Migrate upgrades metrics loaded from files written by older versions:
+// bare IDs move into the default tenant and missing timestamps are set to
+// now so the janitor doesn't expire them right away. Caller must hold the
+// Mutex.
+func (s *InMemoryStorage) Migrate() {
+	now := time.Now()
+	for k, v := range s.Metrics {
+		if v.UpdatedAt == nil {
+			v.Touch(now)
+			s.Metrics[k] = v
+		}
+		if k == v.ID {
+			delete(s.Metrics, k)
+			s.Metrics[tenant.Key(tenant.Default, v.ID)] = v
+		}
+	}
+}
+
+func (s *InMemoryStorage) ExpireMetric(ctx context.Context, id string, before time.Time) (bool, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	existing, found := s.Metrics[key]
+	if !found || !existing.StaleBefore(before) {
+		return false, nil
+	}
+	delete(s.Metrics, key)
+	s.forget(key)
+	return true, nil
+}
+
+func (s *InMemoryStorage) DeleteByPrefix(ctx context.Context, prefix string) ([]string, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	keyPrefix := tenant.Key(tenant.FromContext(ctx), prefix)
+	var deleted []string
+	for k, v := range s.Metrics {
+		if strings.HasPrefix(k, keyPrefix) {
+			delete(s.Metrics, k)
+			s.forget(k)
+			deleted = append(deleted, v.ID)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted, nil
+}
+
+func (s *InMemoryStorage) ResetCounter(ctx context.Context, id string) (model.Metric, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	existing, found := s.Metrics[key]
+	if !found {
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	if existing.Type != model.Counter {
+		return model.Metric{}, model.TypeConflict(id, existing.Type, model.Counter)
+	}
+	zero := int64(0)
+	existing.Delta = &zero
+	existing.Touch(time.Now())
+	s.Metrics[key] = existing
+	s.record(key, existing)
+	return existing, nil
+}
+
+// GetSamples returns the history of id between start and end inclusive.
+func (s *InMemoryStorage) GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	if _, found := s.Metrics[key]; !found {
+		return nil, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	history := s.History[key]
+	from := sort.Search(len(history), func(i int) bool { return !history[i].Time.Before(start) })
+	to := sort.Search(len(history), func(i int) bool { return history[i].Time.After(end) })
+	if from >= to {
+		return []model.Sample{}, nil
+	}
+	return append([]model.Sample(nil), history[from:to]...), nil
+}
+
+// GetRollups returns the rollups of id at resolution res between start and
+// end inclusive.
+func (s *InMemoryStorage) GetRollups(ctx context.Context, id string, res time.Duration, start, end time.Time) ([]model.Rollup, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	if _, found := s.Metrics[key]; !found {
+		return nil, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	rollups := s.Rollups[res][key]
+	from := sort.Search(len(rollups), func(i int) bool { return !rollups[i].Time.Before(start) })
+	to := sort.Search(len(rollups), func(i int) bool { return rollups[i].Time.After(end) })
+	if from >= to {
+		return []model.Rollup{}, nil
+	}
+	return append([]model.Rollup(nil), rollups[from:to]...), nil
+}
+
+// Compact rolls up every bucket completed by now and drops data that fell
+// out of retention. Each tier continues after its newest bucket.
+func (s *InMemoryStorage) Compact(ctx context.Context, now time.Time, r model.Retention) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for key, history := range s.History {
+		src := make([]model.Rollup, 0, len(history))
+		for _, p := range history {
+			src = append(src, model.RollupOf(p))
+		}
+		for _, tier := range r.Tiers {
+			if s.Rollups[tier.Resolution] == nil {
+				s.Rollups[tier.Resolution] = make(map[string][]model.Rollup)
+			}
+			rollups := s.Rollups[tier.Resolution][key]
+			var from time.Time
+			if len(rollups) > 0 {
+				from = rollups[len(rollups)-1].Time.Add(tier.Resolution)
+			}
+			rollups = append(rollups, model.Downsample(src, tier.Resolution, from, now.Truncate(tier.Resolution))...)
+			if tier.Retention > 0 {
+				cut := now.Add(-tier.Retention)
+				i := sort.Search(len(rollups), func(i int) bool { return !rollups[i].Time.Before(cut) })
+				rollups = rollups[i:]
+			}
+			s.Rollups[tier.Resolution][key] = rollups
+			src = rollups
+		}
+		if r.Raw > 0 {
+			cut := now.Add(-r.Raw)
+			i := sort.Search(len(history), func(i int) bool { return !history[i].Time.Before(cut) })
+			s.History[key] = history[i:]
+		}
+	}
+	return nil
+}
+
 func (s *InMemoryStorage) Close() {}
 
 func (s *InMemoryStorage) Ping(ctx context.Context) error {
@@ -57,14 +409,63 @@ func (s *InMemoryStorage) Ping(ctx context.Context) error {
 }
 
 func (s *InMemoryStorage) UpdateMetricBatch(ctx context.Context, metrics []model.Metric) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	t := tenant.FromContext(ctx)
+	// Check the whole batch first so a conflict leaves storage untouched.
+	types := make(map[string]model.MetricType, len(metrics))
 	for _, metric := range metrics {
+		stored, found := types[metric.ID]
+		if !found {
+			existing, ok := s.Metrics[tenant.Key(t, metric.ID)]
+			stored, found = existing.Type, ok
+		}
+		if found && stored != metric.Type {
+			return model.TypeConflict(metric.ID, stored, metric.Type)
+		}
+		types[metric.ID] = metric.Type
+	}
+	now := time.Now()
+	for _, metric := range metrics {
+		key := tenant.Key(t, metric.ID)
 		if metric.Type == model.Counter {
-			existing, found := s.Metrics[metric.ID]
+			existing, found := s.Metrics[key]
 			if found {
 				metric.Summ(existing.Delta)
 			}
 		}
-		s.Metrics[metric.ID] = metric
+		metric.Touch(now)
+		s.Metrics[key] = metric
+		s.record(key, metric)
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) RetypeMetric(ctx context.Context, id string, t model.MetricType) (model.Metric, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	existing, found := s.Metrics[key]
+	if !found {
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	s.Metrics[key] = existing.Convert(t)
+	// Old samples have the other type's meaning.
+	s.forget(key)
+	return s.Metrics[key], nil
+}
+
+func (s *InMemoryStorage) DeleteMetric(ctx context.Context, id string) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	if _, found := s.Metrics[key]; !found {
+		return fmt.Errorf("%w: %s", model.ErrNotFound, id)
 	}
+	delete(s.Metrics, key)
+	s.forget(key)
 	return nil
 }
@@ -1,11 +1,17 @@
 package memorystorage
 
 import (
+	"bytes"
 	"context"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/randomtoy/gometrics/internal/dump"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -89,3 +95,276 @@ func TestInMemoryStorage_GetMetric(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestInMemoryStorage_Tenants(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	store := NewInMemoryStorage(l, "")
+
+	ctxA := tenant.WithTenant(context.Background(), "team-a")
+	ctxB := tenant.WithTenant(context.Background(), "team-b")
+
+	valueA := float64(1)
+	valueB := float64(2)
+	store.UpdateMetric(ctxA, model.Metric{ID: "Alloc", Type: model.Gauge, Value: &valueA})
+	store.UpdateMetric(ctxB, model.Metric{ID: "Alloc", Type: model.Gauge, Value: &valueB})
+
+	t.Run("Metrics are isolated", func(t *testing.T) {
+		metric, err := store.GetMetric(ctxA, "Alloc")
+		assert.NoError(t, err)
+		assert.Equal(t, &valueA, metric.Value)
+
+		metrics, err := store.GetAllMetrics(ctxB)
+		assert.NoError(t, err)
+		assert.Len(t, metrics, 1)
+		assert.Equal(t, &valueB, metrics["Alloc"].Value)
+
+		_, err = store.GetMetric(context.Background(), "Alloc")
+		assert.Error(t, err)
+	})
+
+	t.Run("List tenants", func(t *testing.T) {
+		tenants, err := store.ListTenants(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"team-a", "team-b"}, tenants)
+	})
+}
+
+func TestInMemoryStorage_TypeConflict(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	store := NewInMemoryStorage(l, "")
+
+	value := float64(1.5)
+	delta := int64(2)
+	_, err := store.UpdateMetric(ctx, model.Metric{ID: "Mixed", Type: model.Gauge, Value: &value})
+	assert.NoError(t, err)
+
+	t.Run("Update with other type", func(t *testing.T) {
+		_, err := store.UpdateMetric(ctx, model.Metric{ID: "Mixed", Type: model.Counter, Delta: &delta})
+		assert.ErrorIs(t, err, model.ErrTypeConflict)
+	})
+
+	t.Run("Batch with other type", func(t *testing.T) {
+		other := float64(3)
+		err := store.UpdateMetricBatch(ctx, []model.Metric{
+			{ID: "Fresh", Type: model.Gauge, Value: &other},
+			{ID: "Mixed", Type: model.Counter, Delta: &delta},
+		})
+		assert.ErrorIs(t, err, model.ErrTypeConflict)
+
+		_, err = store.GetMetric(ctx, "Fresh")
+		assert.ErrorIs(t, err, model.ErrNotFound)
+	})
+
+	t.Run("Retype", func(t *testing.T) {
+		m, err := store.RetypeMetric(ctx, "Mixed", model.Counter)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), *m.Delta)
+
+		m, err = store.UpdateMetric(ctx, model.Metric{ID: "Mixed", Type: model.Counter, Delta: &delta})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), *m.Delta)
+	})
+}
+
+func TestInMemoryStorage_Delete(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	store := NewInMemoryStorage(l, "")
+
+	value := float64(1)
+	delta := int64(7)
+	store.UpdateMetricBatch(ctx, []model.Metric{
+		{ID: "CPUutilization0", Type: model.Gauge, Value: &value},
+		{ID: "CPUutilization1", Type: model.Gauge, Value: &value},
+		{ID: "Alloc", Type: model.Gauge, Value: &value},
+		{ID: "PollCount", Type: model.Counter, Delta: &delta},
+	})
+
+	t.Run("Delete metric", func(t *testing.T) {
+		assert.NoError(t, store.DeleteMetric(ctx, "Alloc"))
+		assert.ErrorIs(t, store.DeleteMetric(ctx, "Alloc"), model.ErrNotFound)
+	})
+
+	t.Run("Delete by prefix", func(t *testing.T) {
+		ids, err := store.DeleteByPrefix(ctx, "CPU")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"CPUutilization0", "CPUutilization1"}, ids)
+
+		metrics, _ := store.GetAllMetrics(ctx)
+		assert.Len(t, metrics, 1)
+	})
+
+	t.Run("Reset counter", func(t *testing.T) {
+		before, err := store.GetMetric(ctx, "PollCount")
+		require.NoError(t, err)
+		m, err := store.ResetCounter(ctx, "PollCount")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), *m.Delta)
+		assert.False(t, m.UpdatedAt.Before(*before.UpdatedAt))
+		samples, err := store.GetSamples(ctx, "PollCount", time.Time{}, time.Now())
+		require.NoError(t, err)
+		require.Len(t, samples, 2)
+		assert.Equal(t, 0.0, samples[1].Value)
+
+		_, err = store.ResetCounter(ctx, "Unknown")
+		assert.ErrorIs(t, err, model.ErrNotFound)
+	})
+}
+
+func TestInMemoryStorage_GetSamples(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	store := NewInMemoryStorage(l, "")
+
+	delta := int64(5)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		d := delta
+		_, err := store.UpdateMetric(ctx, model.Metric{ID: "PollCount", Type: model.Counter, Delta: &d})
+		assert.NoError(t, err)
+	}
+
+	samples, err := store.GetSamples(ctx, "PollCount", start, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, samples, 3)
+	assert.Equal(t, float64(15), samples[2].Value)
+
+	samples, err = store.GetSamples(ctx, "PollCount", time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, samples)
+
+	_, err = store.GetSamples(ctx, "Unknown", start, time.Now())
+	assert.ErrorIs(t, err, model.ErrNotFound)
+}
+
+func TestInMemoryStorage_Compact(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	store := NewInMemoryStorage(l, "")
+	_, err := store.UpdateMetric(ctx, model.Metric{ID: "Alloc", Type: model.Gauge, Value: new(float64)})
+	assert.NoError(t, err)
+
+	key := tenant.Key(tenant.Default, "Alloc")
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.History[key] = []model.Sample{
+		{Time: base.Add(10 * time.Second), Value: 1},
+		{Time: base.Add(50 * time.Second), Value: 3},
+		{Time: base.Add(70 * time.Second), Value: 8},
+		{Time: base.Add(130 * time.Second), Value: 4},
+	}
+	r := model.Retention{Raw: time.Minute, Tiers: []model.Tier{{Resolution: time.Minute}, {Resolution: time.Hour}}}
+
+	// The third minute is still open and the hour has not ended.
+	now := base.Add(150 * time.Second)
+	assert.NoError(t, store.Compact(ctx, now, r))
+	rollups, err := store.GetRollups(ctx, "Alloc", time.Minute, base, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Rollup{
+		{Time: base, Min: 1, Max: 3, Avg: 2, Last: 3, Count: 2},
+		{Time: base.Add(time.Minute), Min: 8, Max: 8, Avg: 8, Last: 8, Count: 1},
+	}, rollups)
+	assert.Len(t, store.History[key], 1)
+	assert.Empty(t, store.Rollups[time.Hour][key])
+
+	// Compacting again continues after the newest rollup.
+	now = base.Add(time.Hour + time.Second)
+	assert.NoError(t, store.Compact(ctx, now, r))
+	rollups, _ = store.GetRollups(ctx, "Alloc", time.Minute, base, now)
+	assert.Len(t, rollups, 3)
+	rollups, _ = store.GetRollups(ctx, "Alloc", time.Hour, base, now)
+	assert.Equal(t, []model.Rollup{{Time: base, Min: 1, Max: 8, Avg: 4, Last: 4, Count: 4}}, rollups)
+	assert.Empty(t, store.History[key])
+
+	assert.NoError(t, store.DeleteMetric(ctx, "Alloc"))
+	assert.Empty(t, store.Rollups[time.Minute][key])
+}
+
+func TestInMemoryStorage_PutSeries(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage(zap.NewNop().Sugar(), "")
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	d := int64(5)
+	_, err := store.UpdateMetric(ctx, model.Metric{ID: "PollCount", Type: model.Counter, Delta: &d})
+	require.NoError(t, err)
+
+	total := int64(42)
+	err = store.PutSeries(ctx, model.Metric{ID: "PollCount", Type: model.Counter, Delta: &total}, []model.Sample{
+		{Time: start, Value: 40},
+		{Time: start.Add(time.Second), Value: 42},
+	})
+	require.NoError(t, err)
+	m, err := store.GetMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), *m.Delta)
+
+	// The earlier live sample lies outside the imported range and is kept.
+	samples, err := store.GetSamples(ctx, "PollCount", time.Time{}, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, samples, 3)
+
+	v := 1.0
+	err = store.PutSeries(ctx, model.Metric{ID: "PollCount", Type: model.Gauge, Value: &v}, nil)
+	assert.ErrorIs(t, err, model.ErrTypeConflict)
+}
+
+func TestInMemoryStorage_BackupRestore(t *testing.T) {
+	ctx := tenant.WithTenant(context.Background(), "team-a")
+	l := zap.NewNop().Sugar()
+	src := NewInMemoryStorage(l, "")
+	d := int64(3)
+	for i := 0; i < 2; i++ {
+		_, err := src.UpdateMetric(ctx, model.Metric{ID: "PollCount", Type: model.Counter, Delta: &d})
+		require.NoError(t, err)
+	}
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	src.Rollups[time.Minute] = map[string][]model.Rollup{
+		tenant.Key("team-a", "PollCount"): {{Time: start, Min: 3, Max: 6, Avg: 4.5, Last: 6, Count: 2}},
+	}
+	var buf bytes.Buffer
+	w, err := dump.NewWriter(dump.FormatJSONL, &buf)
+	require.NoError(t, err)
+	require.NoError(t, src.Backup(ctx, w))
+	backup := buf.String()
+
+	dst := NewInMemoryStorage(l, "")
+	v := 1.0
+	_, err = dst.UpdateMetric(ctx, model.Metric{ID: "Alloc", Type: model.Gauge, Value: &v})
+	require.NoError(t, err)
+
+	t.Run("merge", func(t *testing.T) {
+		r, err := dump.NewReader(dump.FormatJSONL, strings.NewReader(backup))
+		require.NoError(t, err)
+		n, err := dst.Restore(context.Background(), r, false)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		metrics, _ := dst.GetAllMetrics(ctx)
+		assert.Len(t, metrics, 2)
+		assert.Equal(t, int64(6), *metrics["PollCount"].Delta)
+	})
+
+	t.Run("invalid record leaves storage untouched", func(t *testing.T) {
+		r, err := dump.NewReader(dump.FormatJSONL, strings.NewReader(`{"tenant":"team-a","id":"x","type":"gauge"}`))
+		require.NoError(t, err)
+		_, err = dst.Restore(context.Background(), r, true)
+		assert.Error(t, err)
+		metrics, _ := dst.GetAllMetrics(ctx)
+		assert.Len(t, metrics, 2)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		r, err := dump.NewReader(dump.FormatJSONL, strings.NewReader(backup))
+		require.NoError(t, err)
+		_, err = dst.Restore(context.Background(), r, true)
+		require.NoError(t, err)
+		metrics, _ := dst.GetAllMetrics(ctx)
+		assert.Len(t, metrics, 1)
+		samples, err := dst.GetSamples(ctx, "PollCount", time.Time{}, time.Now())
+		require.NoError(t, err)
+		assert.Len(t, samples, 2)
+		rollups, err := dst.GetRollups(ctx, "PollCount", time.Minute, start, start)
+		require.NoError(t, err)
+		assert.Equal(t, []model.Rollup{{Time: start, Min: 3, Max: 6, Avg: 4.5, Last: 6, Count: 2}}, rollups)
+	})
+}
@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (tenant, id);
+
+-- +goose Down
+DELETE FROM metrics WHERE tenant <> 'default';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (id);
+ALTER TABLE metrics DROP COLUMN IF EXISTS tenant;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- +goose Down
+ALTER TABLE metrics DROP COLUMN IF EXISTS updated_at;
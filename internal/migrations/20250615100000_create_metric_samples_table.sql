@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS metric_samples (
+    tenant TEXT NOT NULL,
+    id TEXT NOT NULL,
+    ts TIMESTAMPTZ NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    FOREIGN KEY (tenant, id) REFERENCES metrics (tenant, id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS metric_samples_series_ts_idx ON metric_samples (tenant, id, ts);
+
+-- +goose Down
+DROP TABLE IF EXISTS metric_samples;
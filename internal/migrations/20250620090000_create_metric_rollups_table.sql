@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS metric_rollups (
+    tenant TEXT NOT NULL,
+    id TEXT NOT NULL,
+    resolution BIGINT NOT NULL,
+    ts TIMESTAMPTZ NOT NULL,
+    min DOUBLE PRECISION NOT NULL,
+    max DOUBLE PRECISION NOT NULL,
+    avg DOUBLE PRECISION NOT NULL,
+    last DOUBLE PRECISION NOT NULL,
+    count BIGINT NOT NULL,
+    PRIMARY KEY (tenant, id, resolution, ts),
+    FOREIGN KEY (tenant, id) REFERENCES metrics (tenant, id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS metric_samples_ts_idx ON metric_samples (ts);
+CREATE INDEX IF NOT EXISTS metric_rollups_resolution_ts_idx ON metric_rollups (resolution, ts);
+
+-- +goose Down
+DROP INDEX IF EXISTS metric_samples_ts_idx;
+DROP TABLE IF EXISTS metric_rollups;
@@ -0,0 +1,8 @@
+// Package migrations embeds the PostgreSQL schema migrations, so they are
+// applied wherever the binary runs from.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -1,9 +1,29 @@
 package model
 
+// DefaultCgroupRoot is where cgroup v2 is usually mounted.
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
 type AgentConfig struct {
 	Addr           string `env:"ADDRESS"`
 	ReportInterval int    `env:"REPORT_INTERVAL"`
 	PollInterval   int    `env:"POLL_INTERVAL"`
 	Key            string `env:"KEY"`
 	RateLimit      int    `env:"RATE_LIMIT"`
+	IngestAddr     string `env:"INGEST_ADDRESS"`
+	IngestSocket   string `env:"INGEST_SOCKET"`
+	// IngestToken is the bearer token apps must send to the ingest
+	// listener. IngestAddr must be a loopback address without it.
+	IngestToken string `env:"INGEST_TOKEN"`
+	// ExecCommands are run with sh -c, EXEC_COMMANDS holds one per line.
+	ExecCommands []string `env:"EXEC_COMMANDS"`
+	ExecInterval int      `env:"EXEC_INTERVAL"`
+	ExecTimeout  int      `env:"EXEC_TIMEOUT"`
+	// LogConfig is the JSON file of the files to follow and their rules.
+	LogConfig string `env:"LOG_CONFIG"`
+	// Processes are alias=kind:pattern matchers, PROCESSES holds one per
+	// line.
+	Processes []string `env:"PROCESSES"`
+	// CgroupRoot is where cgroup v2 is mounted, empty disables the cgroup
+	// collector.
+	CgroupRoot string `env:"CGROUP_ROOT"`
 }
@@ -0,0 +1,46 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ListFilter selects a page of metrics ordered by ID. Empty fields match
+// everything; After is the last ID of the previous page.
+type ListFilter struct {
+	Type   MetricType
+	Prefix string
+	Regex  string
+	After  string
+	Limit  int
+}
+
+// Select returns the metrics matching f, sorted by ID, for backends that
+// filter in memory.
+func (f ListFilter) Select(metrics []Metric) ([]Metric, error) {
+	var re *regexp.Regexp
+	if f.Regex != "" {
+		var err error
+		re, err = regexp.Compile(f.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	result := []Metric{}
+	for _, m := range metrics {
+		if (f.Type != "" && m.Type != f.Type) ||
+			!strings.HasPrefix(m.ID, f.Prefix) ||
+			(re != nil && !re.MatchString(m.ID)) ||
+			m.ID <= f.After {
+			continue
+		}
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return result, nil
+}
@@ -1,6 +1,10 @@
 package model
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 type MetricType string
 
@@ -9,11 +13,19 @@ const (
 	Counter MetricType = "counter"
 )
 
+var (
+	ErrTypeConflict = errors.New("metric type conflict")
+	ErrNotFound     = errors.New("metric not found")
+)
+
 type Metric struct {
 	ID    string     `json:"id"`
 	Type  MetricType `json:"type"`
 	Value *float64   `json:"value,omitempty"`
 	Delta *int64     `json:"delta,omitempty"`
+	// UpdatedAt is set by storage on every write, values sent by clients
+	// are ignored.
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
 }
 
 func (m Metric) String() string {
@@ -44,3 +56,36 @@ func (m *Metric) DerefInt64(i *int64) int64 {
 	}
 	return *i
 }
+
+func TypeConflict(id string, stored, got MetricType) error {
+	return fmt.Errorf("%w: %s is stored as %s, got %s", ErrTypeConflict, id, stored, got)
+}
+
+// Convert returns the metric as type t. Gauge values are truncated when
+// turned into counters.
+func (m Metric) Convert(t MetricType) Metric {
+	if m.Type == t {
+		return m
+	}
+	res := Metric{ID: m.ID, Type: t, UpdatedAt: m.UpdatedAt}
+	switch t {
+	case Gauge:
+		v := float64(m.DerefInt64(m.Delta))
+		res.Value = &v
+	case Counter:
+		d := int64(m.DerefFloat64(m.Value))
+		res.Delta = &d
+	}
+	return res
+}
+
+func (m *Metric) Touch(t time.Time) *Metric {
+	m.UpdatedAt = &t
+	return m
+}
+
+// StaleBefore reports whether the metric was last written before t.
+// Metrics without a timestamp are never stale.
+func (m Metric) StaleBefore(t time.Time) bool {
+	return m.UpdatedAt != nil && m.UpdatedAt.Before(t)
+}
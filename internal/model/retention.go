@@ -0,0 +1,95 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tier is a rollup resolution and how long its buckets are kept. A zero
+// Retention keeps them forever.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// Retention says how long raw samples are kept and which rollups are built
+// from them, finest first. Each tier is computed from the one before it.
+type Retention struct {
+	Raw   time.Duration
+	Tiers []Tier
+}
+
+const DefaultRetentionSpec = "raw=48h,1m=720h,1h=8760h"
+
+func DefaultRetention() Retention {
+	r, _ := ParseRetention(DefaultRetentionSpec)
+	return r
+}
+
+// ParseRetention parses "raw=48h,1m=720h,1h=8760h": raw sample retention
+// followed by resolution=retention pairs. Resolutions are whole seconds and
+// each must be a multiple of the previous one.
+func ParseRetention(s string) (Retention, error) {
+	var r Retention
+	if s == "" {
+		return r, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return r, fmt.Errorf("invalid retention: %q", pair)
+		}
+		keep, err := time.ParseDuration(v)
+		if err != nil || keep < 0 {
+			return r, fmt.Errorf("invalid retention %q", pair)
+		}
+		if k == "raw" {
+			r.Raw = keep
+			continue
+		}
+		res, err := time.ParseDuration(k)
+		if err != nil || res < time.Second || res%time.Second != 0 {
+			return r, fmt.Errorf("invalid resolution %q", pair)
+		}
+		r.Tiers = append(r.Tiers, Tier{Resolution: res, Retention: keep})
+	}
+	sort.Slice(r.Tiers, func(i, j int) bool { return r.Tiers[i].Resolution < r.Tiers[j].Resolution })
+	for i := 1; i < len(r.Tiers); i++ {
+		if r.Tiers[i].Resolution%r.Tiers[i-1].Resolution != 0 {
+			return r, fmt.Errorf("resolution %s is not a multiple of %s", r.Tiers[i].Resolution, r.Tiers[i-1].Resolution)
+		}
+	}
+	return r, nil
+}
+
+func (r Retention) Enabled() bool {
+	return r.Raw > 0 || len(r.Tiers) > 0
+}
+
+// Resolution picks the data to answer a range query from start with the
+// given step. It prefers the coarsest tier not coarser than step that still
+// holds start, then the finest tier that holds start, then the coarsest
+// tier. 0 means raw samples.
+func (r Retention) Resolution(now, start time.Time, step time.Duration) time.Duration {
+	levels := append([]Tier{{Retention: r.Raw}}, r.Tiers...)
+	holds := func(t Tier) bool {
+		return t.Retention <= 0 || !start.Before(now.Add(-t.Retention))
+	}
+	best := -1
+	for i, t := range levels {
+		if holds(t) && t.Resolution <= step {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return levels[best].Resolution
+	}
+	for _, t := range levels {
+		if holds(t) {
+			return t.Resolution
+		}
+	}
+	return levels[len(levels)-1].Resolution
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetention(t *testing.T) {
+	r, err := ParseRetention("1h=8760h, raw=48h, 1m=720h")
+	assert.NoError(t, err)
+	assert.Equal(t, Retention{
+		Raw:   48 * time.Hour,
+		Tiers: []Tier{{time.Minute, 720 * time.Hour}, {time.Hour, 8760 * time.Hour}},
+	}, r)
+	assert.Equal(t, r, DefaultRetention())
+
+	for _, s := range []string{"raw", "raw=forever", "500ms=1h", "1m=1h,90s=1h"} {
+		_, err := ParseRetention(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRetention_Resolution(t *testing.T) {
+	r := DefaultRetention()
+	now := time.Now()
+
+	assert.Equal(t, time.Duration(0), r.Resolution(now, now.Add(-time.Hour), 10*time.Second))
+	assert.Equal(t, time.Minute, r.Resolution(now, now.Add(-time.Hour), 5*time.Minute))
+	assert.Equal(t, time.Hour, r.Resolution(now, now.Add(-24*time.Hour), 2*time.Hour))
+	// Raw samples are gone, so the finest tier still holding start wins.
+	assert.Equal(t, time.Minute, r.Resolution(now, now.Add(-72*time.Hour), 10*time.Second))
+	assert.Equal(t, time.Hour, r.Resolution(now, now.Add(-60*24*time.Hour), time.Minute))
+	assert.Equal(t, time.Hour, r.Resolution(now, now.Add(-2*8760*time.Hour), time.Minute))
+
+	assert.Equal(t, time.Duration(0), Retention{}.Resolution(now, time.Time{}, time.Hour))
+}
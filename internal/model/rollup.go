@@ -0,0 +1,55 @@
+package model
+
+import (
+	"math"
+	"time"
+)
+
+// Rollup summarises the samples of one series in [Time, Time+resolution).
+type Rollup struct {
+	Time  time.Time `json:"t"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Last  float64   `json:"last"`
+	Count int64     `json:"count"`
+}
+
+// RollupOf turns a raw sample into a rollup of one point.
+func RollupOf(s Sample) Rollup {
+	return Rollup{Time: s.Time, Min: s.Value, Max: s.Value, Avg: s.Value, Last: s.Value, Count: 1}
+}
+
+// Merge adds o, which must not be older than r, to r.
+func (r *Rollup) Merge(o Rollup) {
+	if r.Count == 0 {
+		t := r.Time
+		*r = o
+		r.Time = t
+		return
+	}
+	total := r.Count + o.Count
+	r.Avg = (r.Avg*float64(r.Count) + o.Avg*float64(o.Count)) / float64(total)
+	r.Min = math.Min(r.Min, o.Min)
+	r.Max = math.Max(r.Max, o.Max)
+	r.Last = o.Last
+	r.Count = total
+}
+
+// Downsample merges points in time order into buckets of length res. Only
+// points in [from, until) are used, so until should be the start of the
+// first incomplete bucket.
+func Downsample(points []Rollup, res time.Duration, from, until time.Time) []Rollup {
+	var out []Rollup
+	for _, p := range points {
+		if p.Time.Before(from) || !p.Time.Before(until) {
+			continue
+		}
+		bucket := p.Time.Truncate(res)
+		if len(out) == 0 || !out[len(out)-1].Time.Equal(bucket) {
+			out = append(out, Rollup{Time: bucket})
+		}
+		out[len(out)-1].Merge(p)
+	}
+	return out
+}
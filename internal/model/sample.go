@@ -0,0 +1,37 @@
+package model
+
+import (
+	"sort"
+	"time"
+)
+
+// Sample is one point of a series history. Counters are stored as their
+// running total after the write, so rates can be derived from differences.
+type Sample struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+func (m Metric) Sample(t time.Time) Sample {
+	switch m.Type {
+	case Counter:
+		return Sample{Time: t, Value: float64(m.DerefInt64(m.Delta))}
+	default:
+		return Sample{Time: t, Value: m.DerefFloat64(m.Value)}
+	}
+}
+
+// SpliceSamples replaces the part of history covered by samples, both in
+// time order, with samples.
+func SpliceSamples(history, samples []Sample) []Sample {
+	if len(samples) == 0 {
+		return history
+	}
+	first, last := samples[0].Time, samples[len(samples)-1].Time
+	from := sort.Search(len(history), func(i int) bool { return !history[i].Time.Before(first) })
+	to := sort.Search(len(history), func(i int) bool { return history[i].Time.After(last) })
+	res := make([]Sample, 0, from+len(samples)+len(history)-to)
+	res = append(res, history[:from]...)
+	res = append(res, samples...)
+	return append(res, history[to:]...)
+}
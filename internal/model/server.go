@@ -1,10 +1,29 @@
 package model
 
+import "time"
+
 type ServerConfig struct {
-	Addr          string `env:"ADDRESS"`
-	StoreInterval int    `env:"STORE_INTERVAL"`
-	FilePath      string `env:"FILE_STORAGE_PATH"`
-	Restore       bool   `env:"RESTORE"`
-	DatabaseDSN   string `env:"DATABASE_DSN"`
-	Key           string `env:"KEY"`
+	Addr            string        `env:"ADDRESS"`
+	StoreInterval   int           `env:"STORE_INTERVAL"`
+	FilePath        string        `env:"FILE_STORAGE_PATH"`
+	Restore         bool          `env:"RESTORE"`
+	DatabaseDSN     string        `env:"DATABASE_DSN"`
+	Key             string        `env:"KEY"`
+	TenantTokens    string        `env:"TENANT_TOKENS"`
+	AdminToken      string        `env:"ADMIN_TOKEN"`
+	IngestRate      float64       `env:"INGEST_RATE"`
+	IngestBurst     int           `env:"INGEST_BURST"`
+	ClientSeries    int           `env:"MAX_CLIENT_SERIES"`
+	MaxSeries       int           `env:"MAX_SERIES"`
+	MaxPrefixSeries int           `env:"MAX_PREFIX_SERIES"`
+	SeriesOverflow  string        `env:"SERIES_OVERFLOW"`
+	AllowNonFinite  bool          `env:"ALLOW_NON_FINITE"`
+	ExpireTTL       time.Duration `env:"EXPIRE_TTL"`
+	ExpireOverrides string        `env:"EXPIRE_OVERRIDES"`
+	ExpireInterval  time.Duration `env:"EXPIRE_INTERVAL"`
+	StreamBuffer    int           `env:"STREAM_BUFFER"`
+	Retention       string        `env:"RETENTION"`
+	CompactInterval time.Duration `env:"COMPACT_INTERVAL"`
+	TSDBPath        string        `env:"TSDB_PATH"`
+	WSOrigins       string        `env:"WS_ORIGINS"`
 }
@@ -0,0 +1,234 @@
+// Package procstat reports resource usage of selected processes.
+package procstat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/validation"
+	"github.com/shirou/gopsutil/process"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidMatcher = errors.New("invalid process matcher")
+
+// Sink receives the metrics of each poll.
+type Sink interface {
+	Ingest(metrics []model.Metric)
+}
+
+type matchKind string
+
+const (
+	byName    matchKind = "name"
+	byCmdline matchKind = "cmdline"
+	byPidfile matchKind = "pidfile"
+)
+
+// Matcher selects the processes reported under Alias.
+type Matcher struct {
+	Alias   string
+	kind    matchKind
+	re      *regexp.Regexp
+	pidfile string
+}
+
+// ParseMatcher reads alias=name:<regexp>, alias=cmdline:<regexp> or
+// alias=pidfile:<path>.
+func ParseMatcher(s string) (Matcher, error) {
+	alias, spec, ok := strings.Cut(s, "=")
+	if !ok {
+		return Matcher{}, fmt.Errorf("%w: %q, want alias=kind:pattern", ErrInvalidMatcher, s)
+	}
+	err := validation.DefaultPolicy().Name(alias)
+	if err != nil {
+		return Matcher{}, fmt.Errorf("%w: %w", ErrInvalidMatcher, err)
+	}
+	kind, pattern, _ := strings.Cut(spec, ":")
+	m := Matcher{Alias: alias, kind: matchKind(kind)}
+	switch m.kind {
+	case byName, byCmdline:
+		m.re, err = regexp.Compile(pattern)
+		if err != nil {
+			return Matcher{}, fmt.Errorf("%w: %s: %w", ErrInvalidMatcher, alias, err)
+		}
+	case byPidfile:
+		if pattern == "" {
+			return Matcher{}, fmt.Errorf("%w: %s: empty pidfile", ErrInvalidMatcher, alias)
+		}
+		m.pidfile = pattern
+	default:
+		return Matcher{}, fmt.Errorf("%w: %s: unknown kind %q", ErrInvalidMatcher, alias, kind)
+	}
+	return m, nil
+}
+
+// Source reports, for every matcher, the sums over its processes of CPU %,
+// RSS, open FDs, threads and I/O bytes, how many there are and whether any
+// is up. Values a process doesn't let us read, such as the FDs of another
+// user's process, are left out of the sums.
+type Source struct {
+	log      *zap.SugaredLogger
+	matchers []Matcher
+	interval time.Duration
+	sink     Sink
+
+	// procs keeps processes between polls, CPU % is measured since the
+	// previous one.
+	procs map[int32]*process.Process
+}
+
+func NewSource(l *zap.SugaredLogger, config model.AgentConfig, sink Sink) (*Source, error) {
+	s := &Source{
+		log:      l,
+		interval: time.Duration(config.PollInterval) * time.Second,
+		sink:     sink,
+		procs:    make(map[int32]*process.Process),
+	}
+	for _, spec := range config.Processes {
+		m, err := ParseMatcher(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.matchers = append(s.matchers, m)
+	}
+	if s.interval <= 0 {
+		s.interval = 2 * time.Second
+	}
+	return s, nil
+}
+
+func (s *Source) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sink.Ingest(s.collect(ctx))
+		}
+	}
+}
+
+func (s *Source) collect(ctx context.Context) []model.Metric {
+	var all []*process.Process
+	for _, m := range s.matchers {
+		if m.kind != byPidfile {
+			var err error
+			all, err = process.ProcessesWithContext(ctx)
+			if err != nil {
+				s.log.Warnf("cant list processes: %v", err)
+			}
+			break
+		}
+	}
+
+	seen := make(map[int32]*process.Process)
+	var metrics []model.Metric
+	for _, m := range s.matchers {
+		procs := s.match(ctx, m, all)
+		for _, p := range procs {
+			seen[p.Pid] = p
+		}
+		metrics = append(metrics, s.report(ctx, m.Alias, procs)...)
+	}
+	s.procs = seen
+	return metrics
+}
+
+// match returns the processes of m, reusing the ones seen last poll.
+func (s *Source) match(ctx context.Context, m Matcher, all []*process.Process) []*process.Process {
+	if m.kind == byPidfile {
+		pid, err := readPidfile(m.pidfile)
+		if err != nil {
+			return nil
+		}
+		if p, ok := s.procs[pid]; ok {
+			return []*process.Process{p}
+		}
+		p, err := process.NewProcessWithContext(ctx, pid)
+		if err != nil {
+			return nil
+		}
+		return []*process.Process{p}
+	}
+
+	var res []*process.Process
+	for _, p := range all {
+		var v string
+		var err error
+		if m.kind == byName {
+			v, err = p.NameWithContext(ctx)
+		} else {
+			v, err = p.CmdlineWithContext(ctx)
+		}
+		if err != nil || !m.re.MatchString(v) {
+			continue
+		}
+		if prev, ok := s.procs[p.Pid]; ok {
+			p = prev
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+func readPidfile(path string) (int32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int32(pid), nil
+}
+
+func (s *Source) report(ctx context.Context, alias string, procs []*process.Process) []model.Metric {
+	values := map[string]float64{
+		"Up":    0,
+		"Count": float64(len(procs)),
+	}
+	if len(procs) > 0 {
+		values["Up"] = 1
+	}
+	add := func(name string, v float64) {
+		values[name] += v
+	}
+	for _, p := range procs {
+		if cpu, err := p.PercentWithContext(ctx, 0); err == nil {
+			add("CPUPercent", cpu)
+		}
+		if mem, err := p.MemoryInfoWithContext(ctx); err == nil {
+			add("RSS", float64(mem.RSS))
+		}
+		if fds, err := p.NumFDsWithContext(ctx); err == nil {
+			add("OpenFDs", float64(fds))
+		}
+		if threads, err := p.NumThreadsWithContext(ctx); err == nil {
+			add("Threads", float64(threads))
+		}
+		if io, err := p.IOCountersWithContext(ctx); err == nil {
+			add("ReadBytes", float64(io.ReadBytes))
+			add("WriteBytes", float64(io.WriteBytes))
+		}
+	}
+
+	metrics := make([]model.Metric, 0, len(values))
+	for name, v := range values {
+		metrics = append(metrics, model.Metric{ID: "Process_" + alias + "_" + name, Type: model.Gauge, Value: &v})
+	}
+	return metrics
+}
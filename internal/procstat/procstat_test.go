@@ -0,0 +1,58 @@
+package procstat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseMatcher(t *testing.T) {
+	m, err := ParseMatcher("nginx=name:^nginx$")
+	require.NoError(t, err)
+	assert.Equal(t, "nginx", m.Alias)
+	assert.Equal(t, byName, m.kind)
+
+	m, err = ParseMatcher("pg=pidfile:/run/postgresql.pid")
+	require.NoError(t, err)
+	assert.Equal(t, "/run/postgresql.pid", m.pidfile)
+
+	for _, spec := range []string{"nginx", "bad alias=name:x", "app=cmdline:(", "app=pid:1", "app=pidfile:"} {
+		_, err = ParseMatcher(spec)
+		assert.ErrorIs(t, err, ErrInvalidMatcher, spec)
+	}
+}
+
+func TestSource_Collect(t *testing.T) {
+	dir := t.TempDir()
+	pidfile := filepath.Join(dir, "self.pid")
+	require.NoError(t, os.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644))
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	s, err := NewSource(zap.NewNop().Sugar(), model.AgentConfig{Processes: []string{
+		"self=pidfile:" + pidfile,
+		"byname=name:^" + filepath.Base(exe) + "$",
+		"gone=pidfile:" + filepath.Join(dir, "missing.pid"),
+	}}, nil)
+	require.NoError(t, err)
+
+	got := make(map[string]float64)
+	for _, m := range s.collect(context.Background()) {
+		got[m.ID] = *m.Value
+	}
+	assert.Equal(t, 1.0, got["Process_self_Up"])
+	assert.Positive(t, got["Process_self_RSS"])
+	assert.Positive(t, got["Process_self_Threads"])
+	assert.Positive(t, got["Process_self_OpenFDs"])
+	assert.Equal(t, 1.0, got["Process_byname_Up"])
+	assert.Equal(t, 0.0, got["Process_gone_Up"])
+	assert.Equal(t, 0.0, got["Process_gone_Count"])
+	assert.Contains(t, s.procs, int32(os.Getpid()))
+}
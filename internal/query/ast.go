@@ -0,0 +1,79 @@
+package query
+
+import (
+	"path"
+	"regexp"
+	"time"
+)
+
+type Expr interface {
+	expr()
+}
+
+type NumberLiteral struct {
+	Value float64
+}
+
+// Selector picks series by name and label matchers. Name may contain
+// glob characters; Range is only set inside rate().
+type Selector struct {
+	Name     string
+	Matchers []*Matcher
+	Range    time.Duration
+}
+
+type Matcher struct {
+	Label string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+type Call struct {
+	Func string
+	Arg  *Selector
+}
+
+type Aggregate struct {
+	Op   string
+	By   []string
+	Expr Expr
+}
+
+type Binary struct {
+	Op       string
+	LHS, RHS Expr
+}
+
+type Negate struct {
+	Expr Expr
+}
+
+func (*NumberLiteral) expr() {}
+func (*Selector) expr()      {}
+func (*Call) expr()          {}
+func (*Aggregate) expr()     {}
+func (*Binary) expr()        {}
+func (*Negate) expr()        {}
+
+func (m *Matcher) Matches(v string) bool {
+	switch m.Op {
+	case "=":
+		return v == m.Value
+	case "!=":
+		return v != m.Value
+	case "=~":
+		return m.re.MatchString(v)
+	case "!~":
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+func (s *Selector) matchesName(name string) bool {
+	if s.Name == "" {
+		return true
+	}
+	ok, _ := path.Match(s.Name, name)
+	return ok
+}
@@ -0,0 +1,21 @@
+// Package query implements a small PromQL-like expression language over the
+// metrics in storage.
+//
+// Every series carries three labels: __name__ (the metric ID), type and
+// prefix (see storage.SeriesPrefix). Supported syntax:
+//
+//	HeapAlloc                         exact name
+//	CPUutilization*                   name glob, * and ? are wildcards
+//	{__name__=~"Heap.*", type="gauge"} label matchers: = != =~ !~
+//	rate(PollCount[5m])               per-second increase of counters
+//	sum by (prefix) (CPUutilization*) sum, avg, max, min, count
+//	HeapAlloc / HeapSys * 100         arithmetic: + - * /
+//	avg(CPUutilization*) > 90         comparisons filter: == != > < >= <=
+//
+// A '*' directly after a name is part of the glob, so multiplication needs
+// whitespace: HeapAlloc * 2. Names may contain '-', so subtraction between
+// names needs whitespace as well.
+//
+// A selector evaluated at a past time takes the last sample at or before
+// it, looking back at most five minutes; series without one are left out.
+package query
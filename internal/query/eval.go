@@ -0,0 +1,399 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/series"
+	"github.com/randomtoy/gometrics/internal/storage"
+)
+
+// lookback is how far back a selector looks for the last sample when it is
+// evaluated at a time before the latest value.
+const lookback = 5 * time.Minute
+
+const (
+	LabelName   = "__name__"
+	LabelType   = "type"
+	LabelPrefix = "prefix"
+)
+
+// Source is the part of storage.Storage the evaluator reads from.
+type Source interface {
+	GetAllMetrics(ctx context.Context) (map[string]model.Metric, error)
+	GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error)
+}
+
+type Series struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+type ValueType string
+
+const (
+	ScalarType ValueType = "scalar"
+	VectorType ValueType = "vector"
+)
+
+// Result is a scalar or a vector. Scalar is a pointer so a zero result is
+// still encoded.
+type Result struct {
+	Type   ValueType `json:"type"`
+	Scalar *float64  `json:"scalar,omitempty"`
+	Vector []Series  `json:"vector,omitempty"`
+}
+
+func scalar(v float64) Result {
+	return Result{Type: ScalarType, Scalar: &v}
+}
+
+type evaluator struct {
+	ctx     context.Context
+	src     Source
+	at      time.Time
+	metrics map[string]model.Metric
+}
+
+// Eval parses input and evaluates it at time at against the tenant of ctx.
+func Eval(ctx context.Context, src Source, input string, at time.Time) (Result, error) {
+	e, err := Parse(input)
+	if err != nil {
+		return Result{}, err
+	}
+	return EvalExpr(ctx, src, e, at)
+}
+
+// EvalExpr evaluates an already parsed expression, so callers that run the
+// same expression repeatedly only parse it once.
+func EvalExpr(ctx context.Context, src Source, e Expr, at time.Time) (Result, error) {
+	ev := &evaluator{ctx: ctx, src: src, at: at}
+	res, err := ev.eval(e)
+	if err != nil {
+		return Result{}, err
+	}
+	sort.Slice(res.Vector, func(i, j int) bool {
+		return labelsKey(res.Vector[i].Labels, "") < labelsKey(res.Vector[j].Labels, "")
+	})
+	return res, nil
+}
+
+func labelsOf(m model.Metric) map[string]string {
+	return map[string]string{
+		LabelName:   m.ID,
+		LabelType:   string(m.Type),
+		LabelPrefix: storage.SeriesPrefix(m.ID),
+	}
+}
+
+// labelsKey renders a label set without the excluded label for matching.
+func labelsKey(labels map[string]string, exclude string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != exclude {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(labels[k])
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+func dropName(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != LabelName {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func (ev *evaluator) eval(e Expr) (Result, error) {
+	switch e := e.(type) {
+	case *NumberLiteral:
+		return scalar(e.Value), nil
+	case *Negate:
+		res, err := ev.eval(e.Expr)
+		if err != nil {
+			return Result{}, err
+		}
+		return ev.binary("*", scalar(-1), res)
+	case *Selector:
+		if e.Range > 0 {
+			return Result{}, fmt.Errorf("range selector is only allowed inside rate()")
+		}
+		return ev.selectSeries(e)
+	case *Call:
+		return ev.rate(e.Arg)
+	case *Aggregate:
+		return ev.aggregate(e)
+	case *Binary:
+		lhs, err := ev.eval(e.LHS)
+		if err != nil {
+			return Result{}, err
+		}
+		rhs, err := ev.eval(e.RHS)
+		if err != nil {
+			return Result{}, err
+		}
+		return ev.binary(e.Op, lhs, rhs)
+	}
+	return Result{}, fmt.Errorf("unsupported expression %T", e)
+}
+
+func (ev *evaluator) matching(sel *Selector) ([]model.Metric, error) {
+	if ev.metrics == nil {
+		metrics, err := ev.src.GetAllMetrics(ev.ctx)
+		if err != nil {
+			return nil, err
+		}
+		ev.metrics = metrics
+	}
+	var res []model.Metric
+	for _, m := range ev.metrics {
+		if !sel.matchesName(m.ID) {
+			continue
+		}
+		labels := labelsOf(m)
+		ok := true
+		for _, matcher := range sel.Matchers {
+			if !matcher.Matches(labels[matcher.Label]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (ev *evaluator) selectSeries(sel *Selector) (Result, error) {
+	metrics, err := ev.matching(sel)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Type: VectorType, Vector: []Series{}}
+	for _, m := range metrics {
+		v, ok, err := ev.valueAt(m)
+		if err != nil {
+			return Result{}, err
+		}
+		if ok {
+			res.Vector = append(res.Vector, Series{Labels: labelsOf(m), Value: v})
+		}
+	}
+	return res, nil
+}
+
+// valueAt is the value of m at the evaluation time: the current one unless m
+// was written since, then the last sample within lookback. Series without
+// one are left out.
+func (ev *evaluator) valueAt(m model.Metric) (float64, bool, error) {
+	if m.UpdatedAt == nil || !m.UpdatedAt.After(ev.at) {
+		return m.Sample(ev.at).Value, true, nil
+	}
+	samples, err := ev.src.GetSamples(ev.ctx, m.ID, ev.at.Add(-lookback), ev.at)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(samples) == 0 {
+		return 0, false, nil
+	}
+	return samples[len(samples)-1].Value, true, nil
+}
+
+// rate is the per-second increase of matching counters over the range.
+// Series with fewer than two samples in the range are left out.
+func (ev *evaluator) rate(sel *Selector) (Result, error) {
+	metrics, err := ev.matching(sel)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Type: VectorType, Vector: []Series{}}
+	for _, m := range metrics {
+		if m.Type != model.Counter {
+			continue
+		}
+		samples, err := ev.src.GetSamples(ev.ctx, m.ID, ev.at.Add(-sel.Range), ev.at)
+		if err != nil {
+			return Result{}, err
+		}
+		if len(samples) < 2 {
+			continue
+		}
+		increase := 0.0
+		for i := 1; i < len(samples); i++ {
+			increase += series.Increase(samples[i-1].Value, samples[i].Value)
+		}
+		res.Vector = append(res.Vector, Series{
+			Labels: dropName(labelsOf(m)),
+			Value:  increase / sel.Range.Seconds(),
+		})
+	}
+	return res, nil
+}
+
+func (ev *evaluator) aggregate(a *Aggregate) (Result, error) {
+	inner, err := ev.eval(a.Expr)
+	if err != nil {
+		return Result{}, err
+	}
+	if inner.Type != VectorType {
+		return Result{}, fmt.Errorf("%s expects a vector", a.Op)
+	}
+	type group struct {
+		labels map[string]string
+		values []float64
+	}
+	groups := make(map[string]*group)
+	for _, s := range inner.Vector {
+		labels := make(map[string]string, len(a.By))
+		for _, l := range a.By {
+			if v, ok := s.Labels[l]; ok {
+				labels[l] = v
+			}
+		}
+		key := labelsKey(labels, "")
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+		}
+		g.values = append(g.values, s.Value)
+	}
+	res := Result{Type: VectorType, Vector: []Series{}}
+	for _, g := range groups {
+		var v float64
+		switch a.Op {
+		case "sum", "avg":
+			for _, x := range g.values {
+				v += x
+			}
+			if a.Op == "avg" {
+				v /= float64(len(g.values))
+			}
+		case "max":
+			v = math.Inf(-1)
+			for _, x := range g.values {
+				v = math.Max(v, x)
+			}
+		case "min":
+			v = math.Inf(1)
+			for _, x := range g.values {
+				v = math.Min(v, x)
+			}
+		case "count":
+			v = float64(len(g.values))
+		}
+		res.Vector = append(res.Vector, Series{Labels: g.labels, Value: v})
+	}
+	return res, nil
+}
+
+func apply(op string, a, b float64) (float64, bool) {
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		return a / b, true
+	case "==":
+		return a, a == b
+	case "!=":
+		return a, a != b
+	case ">":
+		return a, a > b
+	case "<":
+		return a, a < b
+	case ">=":
+		return a, a >= b
+	case "<=":
+		return a, a <= b
+	}
+	return 0, false
+}
+
+// binary follows PromQL: arithmetic drops the metric name, comparisons
+// filter the left side. Vectors are matched on labels other than the name,
+// and two single-element vectors always match, so HeapAlloc / HeapSys works.
+func (ev *evaluator) binary(op string, lhs, rhs Result) (Result, error) {
+	cmp := comparisons[op]
+	switch {
+	case lhs.Type == ScalarType && rhs.Type == ScalarType:
+		v, ok := apply(op, *lhs.Scalar, *rhs.Scalar)
+		if cmp {
+			v = 0
+			if ok {
+				v = 1
+			}
+		}
+		return scalar(v), nil
+	case lhs.Type == VectorType && rhs.Type == ScalarType:
+		return mapVector(op, lhs.Vector, func(x float64) (float64, bool) { return apply(op, x, *rhs.Scalar) }), nil
+	case lhs.Type == ScalarType && rhs.Type == VectorType:
+		return mapVector(op, rhs.Vector, func(x float64) (float64, bool) {
+			v, ok := apply(op, *lhs.Scalar, x)
+			if cmp {
+				v = x
+			}
+			return v, ok
+		}), nil
+	}
+
+	res := Result{Type: VectorType, Vector: []Series{}}
+	if len(lhs.Vector) == 1 && len(rhs.Vector) == 1 {
+		l, r := lhs.Vector[0], rhs.Vector[0]
+		if v, ok := apply(op, l.Value, r.Value); ok {
+			res.Vector = append(res.Vector, Series{Labels: resultLabels(op, l.Labels), Value: v})
+		}
+		return res, nil
+	}
+	right := make(map[string]Series, len(rhs.Vector))
+	for _, s := range rhs.Vector {
+		right[labelsKey(s.Labels, LabelName)] = s
+	}
+	for _, l := range lhs.Vector {
+		r, found := right[labelsKey(l.Labels, LabelName)]
+		if !found {
+			continue
+		}
+		if v, ok := apply(op, l.Value, r.Value); ok {
+			res.Vector = append(res.Vector, Series{Labels: resultLabels(op, l.Labels), Value: v})
+		}
+	}
+	return res, nil
+}
+
+func resultLabels(op string, labels map[string]string) map[string]string {
+	if comparisons[op] {
+		return labels
+	}
+	return dropName(labels)
+}
+
+func mapVector(op string, vector []Series, f func(float64) (float64, bool)) Result {
+	res := Result{Type: VectorType, Vector: []Series{}}
+	for _, s := range vector {
+		if v, ok := f(s.Value); ok {
+			res.Vector = append(res.Vector, Series{Labels: resultLabels(op, s.Labels), Value: v})
+		}
+	}
+	return res
+}
@@ -0,0 +1,137 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r == ':' || r == '*' || r == '?' || unicode.IsLetter(r)
+}
+
+func isIdentChar(r rune) bool {
+	return isIdentStart(r) || r == '.' || r == '-' || unicode.IsDigit(r)
+}
+
+func expectOperand(tokens []token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	switch tokens[len(tokens)-1].kind {
+	case tokIdent, tokNumber, tokRParen, tokRBrace, tokDuration:
+		return false
+	}
+	return true
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case r == '{':
+			tokens = append(tokens, token{tokLBrace, "{", i})
+			i++
+		case r == '}':
+			tokens = append(tokens, token{tokRBrace, "}", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case r == '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unclosed range at %d", i)
+			}
+			tokens = append(tokens, token{tokDuration, strings.TrimSpace(string(runes[i+1 : j])), i})
+			i = j + 1
+		case r == '"' || r == '\'':
+			j := i + 1
+			var sb strings.Builder
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unclosed string at %d", i)
+			}
+			tokens = append(tokens, token{tokString, sb.String(), i})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E' ||
+				((runes[j] == '+' || runes[j] == '-') && (runes[j-1] == 'e' || runes[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, string(runes[i:j]), i})
+			i = j
+		case r == '*' && !expectOperand(tokens):
+			// After an operand '*' multiplies, otherwise it starts a glob.
+			tokens = append(tokens, token{tokOp, "*", i})
+			i++
+		case isIdentStart(r):
+			j := i
+			for j < len(runes) && isIdentChar(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, string(runes[i:j]), i})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "==", "!=", ">=", "<=", "=~", "!~":
+				tokens = append(tokens, token{tokOp, two, i})
+				i += 2
+				continue
+			}
+			switch r {
+			case '+', '-', '/', '>', '<', '=', '*':
+				tokens = append(tokens, token{tokOp, string(r), i})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected character %q at %d", r, i)
+			}
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(runes)}), nil
+}
@@ -0,0 +1,283 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var aggregations = map[string]bool{"sum": true, "avg": true, "max": true, "min": true, "count": true}
+
+var comparisons = map[string]bool{"==": true, "!=": true, ">": true, "<": true, ">=": true, "<=": true}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse turns an expression into its syntax tree.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s at %d, got %q", what, t.pos, t.text)
+	}
+	return t, nil
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	lhs, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokOp && comparisons[t.text]; t = p.peek() {
+		p.next()
+		rhs, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: t.text, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseAdditive() (Expr, error) {
+	lhs, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokOp && (t.text == "+" || t.text == "-"); t = p.peek() {
+		p.next()
+		rhs, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: t.text, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseMultiplicative() (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokOp && (t.text == "*" || t.text == "/"); t = p.peek() {
+		p.next()
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: t.text, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if t := p.peek(); t.kind == tokOp && t.text == "-" {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Negate{Expr: e}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return &NumberLiteral{Value: v}, nil
+	case tokLParen:
+		p.next()
+		e, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokRParen, "')'")
+		return e, err
+	case tokLBrace:
+		return p.parseSelector("")
+	case tokIdent:
+		p.next()
+		if aggregations[t.text] && p.isAggregation() {
+			return p.parseAggregate(t.text)
+		}
+		if t.text == "rate" && p.peek().kind == tokLParen {
+			return p.parseRate()
+		}
+		return p.parseSelector(t.text)
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// isAggregation tells "sum(...)" and "sum by (...)" apart from a metric
+// called sum.
+func (p *parser) isAggregation() bool {
+	t := p.peek()
+	return t.kind == tokLParen || (t.kind == tokIdent && t.text == "by")
+}
+
+func (p *parser) parseGrouping() ([]string, error) {
+	_, err := p.expect(tokLParen, "'('")
+	if err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for p.peek().kind != tokRParen {
+		l, err := p.expect(tokIdent, "label name")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, l.text)
+		if p.peek().kind == tokComma {
+			p.next()
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+func (p *parser) parseAggregate(op string) (Expr, error) {
+	agg := &Aggregate{Op: op}
+	var err error
+	if t := p.peek(); t.kind == tokIdent && t.text == "by" {
+		p.next()
+		agg.By, err = p.parseGrouping()
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = p.expect(tokLParen, "'('")
+	if err != nil {
+		return nil, err
+	}
+	agg.Expr, err = p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(tokRParen, "')'")
+	if err != nil {
+		return nil, err
+	}
+	// PromQL also allows the grouping after the argument.
+	if t := p.peek(); t.kind == tokIdent && t.text == "by" && agg.By == nil {
+		p.next()
+		agg.By, err = p.parseGrouping()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *parser) parseRate() (Expr, error) {
+	p.next()
+	t := p.next()
+	var sel Expr
+	var err error
+	switch t.kind {
+	case tokIdent:
+		sel, err = p.parseSelector(t.text)
+	case tokLBrace:
+		p.pos--
+		sel, err = p.parseSelector("")
+	default:
+		return nil, fmt.Errorf("rate expects a selector at %d", t.pos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := sel.(*Selector)
+	if s.Range <= 0 {
+		return nil, fmt.Errorf("rate expects a range like [5m] at %d", t.pos)
+	}
+	_, err = p.expect(tokRParen, "')'")
+	if err != nil {
+		return nil, err
+	}
+	return &Call{Func: "rate", Arg: s}, nil
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	sel := &Selector{Name: name}
+	if p.peek().kind == tokLBrace {
+		p.next()
+		for p.peek().kind != tokRBrace {
+			label, err := p.expect(tokIdent, "label name")
+			if err != nil {
+				return nil, err
+			}
+			op := p.next()
+			if op.kind != tokOp || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+				return nil, fmt.Errorf("expected matcher operator at %d, got %q", op.pos, op.text)
+			}
+			value, err := p.expect(tokString, "quoted label value")
+			if err != nil {
+				return nil, err
+			}
+			m := &Matcher{Label: label.text, Op: op.text, Value: value.text}
+			if op.text == "=~" || op.text == "!~" {
+				// Anchored like PromQL regex matchers.
+				m.re, err = regexp.Compile("^(?:" + value.text + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("invalid regex %q: %w", value.text, err)
+				}
+			}
+			sel.Matchers = append(sel.Matchers, m)
+			if p.peek().kind == tokComma {
+				p.next()
+			}
+		}
+		p.next()
+	}
+	if name == "" && len(sel.Matchers) == 0 {
+		return nil, fmt.Errorf("selector needs a name or at least one matcher")
+	}
+	if p.peek().kind == tokDuration {
+		t := p.next()
+		d, err := time.ParseDuration(t.text)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid range %q at %d", t.text, t.pos)
+		}
+		sel.Range = d
+	}
+	return sel, nil
+}
@@ -0,0 +1,139 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/memorystorage"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{
+		"HeapAlloc",
+		"CPUutilization*",
+		`{__name__=~"Heap.*", type="gauge"}`,
+		"rate(PollCount[5m])",
+		"sum by (prefix) (CPUutilization*)",
+		"avg(CPUutilization*) by (prefix)",
+		"HeapAlloc / HeapSys * 100",
+		"-HeapAlloc + 2*3",
+		"max(CPUutilization*) >= 90",
+	}
+	for _, in := range valid {
+		_, err := Parse(in)
+		assert.NoError(t, err, in)
+	}
+
+	invalid := []string{
+		"",
+		"HeapAlloc +",
+		"rate(PollCount)",
+		`{type~"gauge"}`,
+		`{__name__=~"("}`,
+		"sum by (prefix",
+		"HeapAlloc[5m",
+	}
+	for _, in := range invalid {
+		_, err := Parse(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestEval(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	store := memorystorage.NewInMemoryStorage(l, "")
+
+	gauge := func(id string, v float64) model.Metric {
+		return model.Metric{ID: id, Type: model.Gauge, Value: &v}
+	}
+	delta := int64(10)
+	store.UpdateMetricBatch(ctx, []model.Metric{
+		gauge("HeapAlloc", 50),
+		gauge("HeapSys", 200),
+		gauge("CPUutilization0", 10),
+		gauge("CPUutilization1", 30),
+		{ID: "PollCount", Type: model.Counter, Delta: &delta},
+	})
+	d := delta
+	store.UpdateMetric(ctx, model.Metric{ID: "PollCount", Type: model.Counter, Delta: &d})
+	now := time.Now()
+
+	eval := func(in string) Result {
+		res, err := Eval(ctx, store, in, now)
+		assert.NoError(t, err, in)
+		return res
+	}
+
+	res := eval("HeapAlloc / HeapSys * 100")
+	assert.Len(t, res.Vector, 1)
+	assert.Equal(t, float64(25), res.Vector[0].Value)
+
+	res = eval("CPUutilization*")
+	assert.Len(t, res.Vector, 2)
+
+	res = eval(`{__name__=~"Heap.*"}`)
+	assert.Len(t, res.Vector, 2)
+
+	res = eval("avg by (prefix) (CPUutilization*)")
+	assert.Equal(t, []Series{{Labels: map[string]string{"prefix": "CPUutilization"}, Value: 20}}, res.Vector)
+
+	res = eval("max(CPUutilization*) > 25")
+	assert.Len(t, res.Vector, 1)
+	res = eval("CPUutilization* < 20")
+	assert.Len(t, res.Vector, 1)
+	assert.Equal(t, "CPUutilization0", res.Vector[0].Labels[LabelName])
+
+	res = eval("rate(PollCount[1m])")
+	assert.Len(t, res.Vector, 1)
+	assert.InDelta(t, 10.0/60, res.Vector[0].Value, 1e-9)
+
+	res = eval("1 + 2 * 3")
+	assert.Equal(t, ScalarType, res.Type)
+	assert.Equal(t, float64(7), *res.Scalar)
+
+	res = eval("2 - 2")
+	body, err := json.Marshal(res)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type": "scalar", "scalar": 0}`, string(body))
+
+	_, err = Eval(ctx, store, "HeapAlloc[5m]", now)
+	assert.Error(t, err)
+}
+
+func TestEval_PastTime(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	store := memorystorage.NewInMemoryStorage(l, "")
+
+	now := time.Now()
+	v := 3.0
+	metric := model.Metric{ID: "Temp", Type: model.Gauge, Value: &v}
+	metric.Touch(now)
+	require.NoError(t, store.PutSeries(ctx, metric, []model.Sample{
+		{Time: now.Add(-30 * time.Minute), Value: 1},
+		{Time: now.Add(-10 * time.Minute), Value: 2},
+		{Time: now, Value: 3},
+	}))
+
+	values := func(at time.Time) []float64 {
+		res, err := Eval(ctx, store, "Temp", at)
+		require.NoError(t, err)
+		var vs []float64
+		for _, s := range res.Vector {
+			vs = append(vs, s.Value)
+		}
+		return vs
+	}
+	assert.Equal(t, []float64{3}, values(now))
+	assert.Equal(t, []float64{3}, values(now.Add(time.Hour)))
+	assert.Equal(t, []float64{2}, values(now.Add(-8*time.Minute)))
+	// Nothing within the lookback.
+	assert.Empty(t, values(now.Add(-20*time.Minute)))
+}
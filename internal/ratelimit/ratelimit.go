@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// SeriesRetryAfter is suggested to clients that hit the series cap. Series
+// are only released when the client goes idle, so it just spaces out
+// retries.
+const SeriesRetryAfter = time.Minute
+
+// DefaultIdleTimeout is how long a client is remembered without requests.
+const DefaultIdleTimeout = 10 * time.Minute
+
+var (
+	ErrRateLimited = errors.New("ingestion rate limit exceeded")
+	ErrSeriesLimit = errors.New("series limit exceeded")
+)
+
+type Config struct {
+	// Rate is the number of metric updates per second a client may send.
+	Rate float64
+	// Burst is the token bucket size. Defaults to Rate when zero. A batch
+	// larger than Burst is let through on a full bucket and the rest is
+	// taken from the tokens to come, delaying the next requests.
+	Burst int
+	// MaxSeries caps the number of distinct metric IDs per client.
+	MaxSeries int
+	// IdleTimeout is how long a client is kept without requests, and at
+	// least until its bucket refilled. Defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+type Limiter struct {
+	mu        sync.Mutex
+	config    Config
+	clients   map[string]*client
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type client struct {
+	bucket   *rate.Limiter
+	series   map[string]struct{}
+	lastSeen time.Time
+}
+
+func NewLimiter(config Config) *Limiter {
+	if config.Burst <= 0 {
+		config.Burst = int(config.Rate)
+	}
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	// Forgetting a client before its bucket refilled would give it tokens.
+	if config.Rate > 0 {
+		refill := time.Duration(float64(config.Burst) / config.Rate * float64(time.Second))
+		config.IdleTimeout = max(config.IdleTimeout, refill)
+	}
+	return &Limiter{
+		config:  config,
+		clients: make(map[string]*client),
+		now:     time.Now,
+	}
+}
+
+// sweep forgets clients idle for longer than IdleTimeout, at most once per
+// IdleTimeout. Caller must hold mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.config.IdleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for id, c := range l.clients {
+		// A client still owing tokens for a large batch is kept until it
+		// paid them back.
+		if now.Sub(c.lastSeen) >= l.config.IdleTimeout && c.bucket.TokensAt(now) >= 0 {
+			delete(l.clients, id)
+		}
+	}
+}
+
+func (l *Limiter) Enabled() bool {
+	return l.config.Rate > 0 || l.config.MaxSeries > 0
+}
+
+// Allow accounts one token per metric in ids. On rejection it returns the
+// delay after which the client may retry. Nothing is consumed on rejection.
+func (l *Limiter) Allow(clientID string, ids []string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	c, ok := l.clients[clientID]
+	if !ok {
+		c = &client{
+			bucket: rate.NewLimiter(rate.Limit(l.config.Rate), l.config.Burst),
+			series: make(map[string]struct{}),
+		}
+		l.clients[clientID] = c
+	}
+	c.lastSeen = now
+
+	var added []string
+	rollback := func() {
+		for _, id := range added {
+			delete(c.series, id)
+		}
+	}
+	if l.config.MaxSeries > 0 {
+		for _, id := range ids {
+			if _, found := c.series[id]; !found {
+				added = append(added, id)
+				c.series[id] = struct{}{}
+			}
+		}
+		if len(c.series) > l.config.MaxSeries {
+			rollback()
+			return SeriesRetryAfter, ErrSeriesLimit
+		}
+	}
+
+	if l.config.Rate > 0 {
+		n := len(ids)
+		first := min(n, l.config.Burst)
+		r := c.bucket.ReserveN(now, first)
+		if delay := r.DelayFrom(now); delay > 0 {
+			r.CancelAt(now)
+			rollback()
+			return delay, ErrRateLimited
+		}
+		// ReserveN refuses more than Burst at once, the rest is reserved
+		// in Burst-sized steps.
+		for n -= first; n > 0; n -= l.config.Burst {
+			c.bucket.ReserveN(now, min(n, l.config.Burst))
+		}
+	}
+	return 0, nil
+}
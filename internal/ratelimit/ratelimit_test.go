@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	t.Run("Rate limit", func(t *testing.T) {
+		l := NewLimiter(Config{Rate: 1, Burst: 3})
+
+		_, err := l.Allow("agent", []string{"a", "b", "c"})
+		assert.NoError(t, err)
+
+		retry, err := l.Allow("agent", []string{"a"})
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Positive(t, retry)
+
+		_, err = l.Allow("other", []string{"a"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Batch larger than burst", func(t *testing.T) {
+		l := NewLimiter(Config{Rate: 1, Burst: 2, IdleTimeout: time.Second})
+		now := time.Now()
+		l.now = func() time.Time { return now }
+
+		_, err := l.Allow("agent", []string{"a", "b", "c", "d", "e"})
+		assert.NoError(t, err)
+
+		// Three tokens are owed, plus one for the next metric.
+		retry, err := l.Allow("agent", []string{"a"})
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Equal(t, 4*time.Second, retry)
+
+		// Going idle doesn't clear the debt.
+		now = now.Add(2 * time.Second)
+		_, err = l.Allow("other", []string{"a"})
+		assert.NoError(t, err)
+		_, err = l.Allow("agent", []string{"a"})
+		assert.ErrorIs(t, err, ErrRateLimited)
+
+		now = now.Add(2 * time.Second)
+		_, err = l.Allow("agent", []string{"a"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Series limit", func(t *testing.T) {
+		l := NewLimiter(Config{MaxSeries: 2})
+
+		_, err := l.Allow("agent", []string{"a", "b"})
+		assert.NoError(t, err)
+
+		_, err = l.Allow("agent", []string{"a", "c"})
+		assert.ErrorIs(t, err, ErrSeriesLimit)
+
+		_, err = l.Allow("agent", []string{"a", "b"})
+		assert.NoError(t, err)
+	})
+	t.Run("Idle clients are forgotten", func(t *testing.T) {
+		l := NewLimiter(Config{MaxSeries: 1, IdleTimeout: time.Minute})
+		now := time.Now()
+		l.now = func() time.Time { return now }
+
+		_, err := l.Allow("agent", []string{"a"})
+		assert.NoError(t, err)
+		_, err = l.Allow("other", []string{"a"})
+		assert.NoError(t, err)
+
+		now = now.Add(30 * time.Second)
+		_, err = l.Allow("other", []string{"a"})
+		assert.NoError(t, err)
+
+		now = now.Add(45 * time.Second)
+		_, err = l.Allow("other", []string{"a"})
+		assert.NoError(t, err)
+		assert.Len(t, l.clients, 1)
+		assert.Contains(t, l.clients, "other")
+
+		// The series of a forgotten client no longer count.
+		_, err = l.Allow("agent", []string{"b"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Idle timeout covers the refill", func(t *testing.T) {
+		l := NewLimiter(Config{Rate: 1, Burst: 600, IdleTimeout: time.Second})
+		assert.Equal(t, 10*time.Minute, l.config.IdleTimeout)
+	})
+}
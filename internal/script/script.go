@@ -0,0 +1,172 @@
+// Package script runs user commands on an interval and reports what they
+// print as metrics.
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/validation"
+	"go.uber.org/zap"
+)
+
+// ErrorsMetric counts failed runs: commands that exit non-zero, time out or
+// print something that can't be parsed.
+const ErrorsMetric = "ExecErrors"
+
+var ErrInvalidOutput = errors.New("invalid command output")
+
+// Sink receives the metrics of each run.
+type Sink interface {
+	Ingest(metrics []model.Metric)
+}
+
+// Source runs every configured command with sh -c each interval.
+type Source struct {
+	log      *zap.SugaredLogger
+	commands []string
+	interval time.Duration
+	timeout  time.Duration
+	sink     Sink
+	policy   validation.Policy
+}
+
+const (
+	defaultInterval = 10 * time.Second
+	defaultTimeout  = 5 * time.Second
+)
+
+func NewSource(l *zap.SugaredLogger, config model.AgentConfig, sink Sink) *Source {
+	s := &Source{
+		log:      l,
+		commands: config.ExecCommands,
+		interval: time.Duration(config.ExecInterval) * time.Second,
+		timeout:  time.Duration(config.ExecTimeout) * time.Second,
+		sink:     sink,
+		policy:   validation.DefaultPolicy(),
+	}
+	if s.interval <= 0 {
+		s.interval = defaultInterval
+	}
+	if s.timeout <= 0 {
+		s.timeout = defaultTimeout
+	}
+	return s
+}
+
+func (s *Source) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sink.Ingest(s.collect(ctx))
+		}
+	}
+}
+
+// collect runs the commands concurrently so a slow one doesn't hold back
+// the others. The error count is always reported, zero included, so it can
+// be alerted on.
+func (s *Source) collect(ctx context.Context) []model.Metric {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		metrics  []model.Metric
+		failures int64
+	)
+	for _, command := range s.commands {
+		wg.Add(1)
+		go func(command string) {
+			defer wg.Done()
+			res, err := s.run(ctx, command)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				s.log.Warnf("command %q failed: %v", command, err)
+				failures++
+				return
+			}
+			metrics = append(metrics, res...)
+		}(command)
+	}
+	wg.Wait()
+	return append(metrics, model.Metric{ID: ErrorsMetric, Type: model.Counter, Delta: &failures})
+}
+
+func (s *Source) run(ctx context.Context, command string) ([]model.Metric, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait for grandchildren holding the pipes once the timeout kills sh.
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", s.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	metrics, err := Parse(stdout.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	invalid := s.policy.Batch(metrics)
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalidOutput, invalid[0].ID, invalid[0].Message)
+	}
+	return metrics, nil
+}
+
+// Parse reads either a JSON array of metrics, as accepted by /updates/, or
+// lines of "name value" reported as gauges. Blank lines and lines starting
+// with # are skipped.
+func Parse(out []byte) ([]model.Metric, error) {
+	out = bytes.TrimSpace(out)
+	if bytes.HasPrefix(out, []byte("[")) {
+		var metrics []model.Metric
+		err := json.Unmarshal(out, &metrics)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidOutput, err)
+		}
+		return metrics, nil
+	}
+
+	var metrics []model.Metric
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: line %d: want name value", ErrInvalidOutput, n)
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidOutput, n, err)
+		}
+		metrics = append(metrics, model.Metric{ID: fields[0], Type: model.Gauge, Value: &v})
+	}
+	return metrics, scanner.Err()
+}
@@ -0,0 +1,53 @@
+package script
+
+import (
+	"context"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParse(t *testing.T) {
+	metrics, err := Parse([]byte("# queues\nQueueDepth 12\n\nCertExpiryDays 41.5\n"))
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "QueueDepth", metrics[0].ID)
+	assert.Equal(t, model.Gauge, metrics[0].Type)
+	assert.Equal(t, 12.0, *metrics[0].Value)
+	assert.Equal(t, 41.5, *metrics[1].Value)
+
+	metrics, err = Parse([]byte(`[{"id":"Jobs","type":"counter","delta":3}]`))
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(3), *metrics[0].Delta)
+
+	_, err = Parse([]byte("QueueDepth"))
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+	_, err = Parse([]byte("QueueDepth lots"))
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+	_, err = Parse([]byte("[{"))
+	assert.ErrorIs(t, err, ErrInvalidOutput)
+}
+
+func TestSource_Collect(t *testing.T) {
+	s := NewSource(zap.NewNop().Sugar(), model.AgentConfig{
+		ExecCommands: []string{
+			"echo QueueDepth 7",
+			"exit 3",
+			"echo 'bad-name! 1'",
+			"sleep 5",
+		},
+		ExecTimeout: 1,
+	}, nil)
+
+	got := make(map[string]model.Metric)
+	for _, m := range s.collect(context.Background()) {
+		got[m.ID] = m
+	}
+	require.Len(t, got, 2)
+	assert.Equal(t, 7.0, *got["QueueDepth"].Value)
+	assert.Equal(t, int64(3), *got[ErrorsMetric].Delta)
+}
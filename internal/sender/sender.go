@@ -1,25 +1,31 @@
 package sender
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/json"
-	"fmt"
-	"net/http"
+	"errors"
 	"sync"
 	"time"
 
-	"github.com/randomtoy/gometrics/internal/crypto"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/pkg/client"
 	"go.uber.org/zap"
 )
 
+// Sender reports the latest batch of the collector every report interval.
+// Batches carry counter totals and the server adds up deltas, so the sender
+// remembers what it has sent of each counter and sends the difference.
 type Sender struct {
 	log         *zap.SugaredLogger
 	config      model.AgentConfig
 	metricsChan <-chan []model.Metric
-	client      *http.Client
+	client      *client.Sender
+
+	mu sync.Mutex
+	// sent is the part of each counter total the server acknowledged,
+	// inflight the part in batches still being sent. A failed batch only
+	// leaves inflight, so its deltas go out with the next one.
+	sent     map[string]int64
+	inflight map[string]int64
 }
 
 func NewSender(log *zap.SugaredLogger, config model.AgentConfig, metricsChan <-chan []model.Metric) *Sender {
@@ -27,7 +33,9 @@ func NewSender(log *zap.SugaredLogger, config model.AgentConfig, metricsChan <-c
 		log:         log,
 		config:      config,
 		metricsChan: metricsChan,
-		client:      &http.Client{},
+		client:      client.NewSender(config.Addr, client.WithKey(config.Key)),
+		sent:        make(map[string]int64),
+		inflight:    make(map[string]int64),
 	}
 }
 
@@ -48,52 +56,120 @@ func (s *Sender) Run(ctx context.Context, wg *sync.WaitGroup) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			metrics := <-s.metricsChan
+			metrics := s.drain()
+			if len(metrics) == 0 {
+				continue
+			}
+			// Deltas are taken here, in order, so concurrent batches never
+			// carry the same increment.
+			batch, deltas := s.prepare(metrics)
 			workerPool <- struct{}{}
-			go func(metrics []model.Metric) {
+			go func() {
 				defer func() { <-workerPool }()
-				s.sendMetricsBatch(metrics)
-			}(metrics)
+				s.send(ctx, batch, deltas)
+			}()
 		}
 	}
 }
 
-func (s *Sender) sendMetricsBatch(metrics []model.Metric) {
-	jsonData, err := json.Marshal(metrics)
-	if err != nil {
-		return
-	}
-	var buf bytes.Buffer
-	gzipWriter := gzip.NewWriter(&buf)
-	_, err = gzipWriter.Write(jsonData)
-	if err != nil {
-		s.log.Errorf("failed to compress data: %v", err)
-		return
+// drain takes every batch collected since the last report and keeps the
+// latest metric of each ID: the last gauge value and the current total of
+// each counter.
+func (s *Sender) drain() []model.Metric {
+	latest := make(map[string]model.Metric)
+	for {
+		select {
+		case metrics := <-s.metricsChan:
+			for _, m := range metrics {
+				latest[m.ID] = m
+			}
+		default:
+			res := make([]model.Metric, 0, len(latest))
+			for _, m := range latest {
+				res = append(res, m)
+			}
+			return res
+		}
 	}
-	gzipWriter.Close()
+}
 
-	url := fmt.Sprintf("http://%s/updates/", s.config.Addr)
-	req, err := http.NewRequest(http.MethodPost, url, &buf)
-	if err != nil {
-		s.log.Errorf("Can't wrap Request: %v", err)
-		return
+// prepare turns counter totals into the deltas not sent yet. Counters
+// without new increments are left out once the server knows them.
+func (s *Sender) prepare(metrics []model.Metric) ([]client.Metric, map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch := make([]client.Metric, 0, len(metrics))
+	deltas := make(map[string]int64)
+	for _, m := range metrics {
+		if m.Type != model.Counter {
+			batch = append(batch, client.Metric{ID: m.ID, Type: string(m.Type), Value: m.Value})
+			continue
+		}
+		_, known := s.sent[m.ID]
+		d := m.DerefInt64(m.Delta) - s.sent[m.ID] - s.inflight[m.ID]
+		if d == 0 && known {
+			continue
+		}
+		s.inflight[m.ID] += d
+		deltas[m.ID] = d
+		batch = append(batch, client.Metric{ID: m.ID, Type: string(m.Type), Delta: &d})
 	}
-	if s.config.Key != "" {
-		hash := crypto.ComputeHMACSHA256(string(jsonData), s.config.Key)
-		req.Header.Set("HashSHA256", hash)
+	return batch, deltas
+}
+
+func (s *Sender) send(ctx context.Context, batch []client.Metric, deltas map[string]int64) {
+	done := s.post(ctx, batch)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, d := range deltas {
+		s.inflight[id] -= d
+		if done[id] {
+			s.sent[id] += d
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
+}
 
-	for attempt := 1; attempt <= 4; attempt++ {
-		resp, err := s.client.Do(req)
-		if err == nil {
-			resp.Body.Close()
-			return
+// post sends batch and returns the IDs the server took or refused for good.
+// When it refuses the batch, the metrics are sent one by one so only the
+// offending ones are dropped; their counter deltas count as sent so they
+// don't come back in every batch.
+func (s *Sender) post(ctx context.Context, batch []client.Metric) map[string]bool {
+	done := make(map[string]bool, len(batch))
+	if len(batch) == 0 {
+		return done
+	}
+	err := s.client.Send(ctx, batch)
+	if rejected(err) && len(batch) > 1 {
+		s.log.Warnf("server refused the batch, sending metrics one by one: %v", err)
+		for _, m := range batch {
+			err := s.client.Send(ctx, []client.Metric{m})
+			if err != nil && !rejected(err) {
+				s.log.Errorf("can't send metrics: %v", err)
+				break
+			}
+			if err != nil {
+				s.log.Errorf("dropping metric %s: %v", m.ID, err)
+			}
+			done[m.ID] = true
 		}
-		backoff := time.Duration((attempt-1)*2+1) * time.Second
-		s.log.Errorf("Can't send metrics %v due to error: %v", backoff, err)
-		time.Sleep(backoff)
+		return done
 	}
-	s.log.Errorf("failed to send metrics after retries: %v", err)
+	switch {
+	case rejected(err):
+		s.log.Errorf("dropping metric %s: %v", batch[0].ID, err)
+	case err != nil:
+		s.log.Errorf("can't send metrics: %v", err)
+		return done
+	}
+	for _, m := range batch {
+		done[m.ID] = true
+	}
+	return done
+}
+
+// rejected reports whether the server refused what was sent for good.
+func rejected(err error) bool {
+	var se *client.StatusError
+	return errors.As(err, &se) && se.Rejected()
 }
@@ -0,0 +1,125 @@
+package sender
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeServer adds up counter deltas like the server does, failing the
+// requests queued in fail and refusing batches that carry poison.
+type fakeServer struct {
+	t        *testing.T
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+	fail     int
+	poison   string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail > 0 {
+		f.fail--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	gz, err := gzip.NewReader(r.Body)
+	require.NoError(f.t, err)
+	var batch []model.Metric
+	require.NoError(f.t, json.NewDecoder(gz).Decode(&batch))
+	for _, m := range batch {
+		if m.ID == f.poison {
+			http.Error(w, "type conflict", http.StatusConflict)
+			return
+		}
+	}
+	for _, m := range batch {
+		if m.Type == model.Counter {
+			f.counters[m.ID] += *m.Delta
+		} else {
+			f.gauges[m.ID] = *m.Value
+		}
+	}
+}
+
+func counter(id string, total int64) model.Metric {
+	return model.Metric{ID: id, Type: model.Counter, Delta: &total}
+}
+
+func gauge(id string, v float64) model.Metric {
+	return model.Metric{ID: id, Type: model.Gauge, Value: &v}
+}
+
+func TestSender_SendsDeltas(t *testing.T) {
+	fake := &fakeServer{t: t, counters: make(map[string]int64), gauges: make(map[string]float64)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	metricsChan := make(chan []model.Metric, 10)
+	s := NewSender(zap.NewNop().Sugar(), model.AgentConfig{Addr: srv.URL}, metricsChan)
+	report := func() {
+		batch, deltas := s.prepare(s.drain())
+		s.send(context.Background(), batch, deltas)
+	}
+
+	// Only the latest total of each counter matters.
+	metricsChan <- []model.Metric{counter("PollCount", 1), gauge("Alloc", 1)}
+	metricsChan <- []model.Metric{counter("PollCount", 3), gauge("Alloc", 2), counter("ExecErrors", 0)}
+	report()
+	assert.Equal(t, map[string]int64{"PollCount": 3, "ExecErrors": 0}, fake.counters)
+	assert.Equal(t, 2.0, fake.gauges["Alloc"])
+
+	// A failed batch rolls into the next one.
+	fake.fail = 1
+	metricsChan <- []model.Metric{counter("PollCount", 5), counter("ExecErrors", 0)}
+	report()
+	metricsChan <- []model.Metric{counter("PollCount", 7), counter("ExecErrors", 0)}
+	report()
+	assert.Equal(t, map[string]int64{"PollCount": 7, "ExecErrors": 0}, fake.counters)
+
+	// Batches prepared before the previous one is acknowledged don't repeat
+	// its increments.
+	metricsChan <- []model.Metric{counter("PollCount", 8)}
+	first, firstDeltas := s.prepare(s.drain())
+	metricsChan <- []model.Metric{counter("PollCount", 10)}
+	second, secondDeltas := s.prepare(s.drain())
+	s.send(context.Background(), second, secondDeltas)
+	s.send(context.Background(), first, firstDeltas)
+	assert.Equal(t, int64(10), fake.counters["PollCount"])
+	assert.Empty(t, s.drain())
+}
+
+func TestSender_DropsRefusedMetrics(t *testing.T) {
+	fake := &fakeServer{t: t, counters: make(map[string]int64), gauges: make(map[string]float64), poison: "Alloc"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	metricsChan := make(chan []model.Metric, 10)
+	s := NewSender(zap.NewNop().Sugar(), model.AgentConfig{Addr: srv.URL}, metricsChan)
+	report := func() {
+		batch, deltas := s.prepare(s.drain())
+		s.send(context.Background(), batch, deltas)
+	}
+
+	// The refused metric doesn't hold back the rest of the batch.
+	metricsChan <- []model.Metric{counter("PollCount", 1), counter("Alloc", 4)}
+	report()
+	assert.Equal(t, map[string]int64{"PollCount": 1}, fake.counters)
+
+	// Its delta isn't resent, so later batches go through as one.
+	fake.poison = ""
+	metricsChan <- []model.Metric{counter("PollCount", 2), counter("Alloc", 5)}
+	report()
+	assert.Equal(t, map[string]int64{"PollCount": 2, "Alloc": 1}, fake.counters)
+}
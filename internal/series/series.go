@@ -0,0 +1,138 @@
+package series
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+)
+
+type Aggregation string
+
+const (
+	Avg  Aggregation = "avg"
+	Min  Aggregation = "min"
+	Max  Aggregation = "max"
+	Sum  Aggregation = "sum"
+	Last Aggregation = "last"
+	// Rate is the per-second increase of a counter, counter resets are
+	// treated as a restart from zero.
+	Rate Aggregation = "rate"
+)
+
+func ParseAggregation(s string) (Aggregation, error) {
+	switch a := Aggregation(s); a {
+	case Avg, Min, Max, Sum, Last, Rate:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown aggregation: %q", s)
+}
+
+// Increase returns how much a counter grew from a to b.
+func Increase(a, b float64) float64 {
+	if b < a {
+		return b
+	}
+	return b - a
+}
+
+// Bucket aggregates samples into buckets [t, t+step) for t = start,
+// start+step, ... up to end, labelling each point with t. Samples must be in
+// time order. Samples before start are only used as the base for rate.
+// Empty buckets are skipped.
+func Bucket(samples []model.Sample, start, end time.Time, step time.Duration, agg Aggregation) []model.Sample {
+	points := []model.Sample{}
+	var prev *model.Sample
+	i := 0
+	for ; i < len(samples) && samples[i].Time.Before(start); i++ {
+		prev = &samples[i]
+	}
+	for t := start; !t.After(end); t = t.Add(step) {
+		next := t.Add(step)
+		var (
+			n        int
+			sum      float64
+			min, max = math.Inf(1), math.Inf(-1)
+			last     float64
+			increase float64
+		)
+		for ; i < len(samples) && samples[i].Time.Before(next); i++ {
+			v := samples[i].Value
+			n++
+			sum += v
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+			last = v
+			if prev != nil {
+				increase += Increase(prev.Value, v)
+			}
+			prev = &samples[i]
+		}
+		if n == 0 {
+			continue
+		}
+		var v float64
+		switch agg {
+		case Avg:
+			v = sum / float64(n)
+		case Min:
+			v = min
+		case Max:
+			v = max
+		case Sum:
+			v = sum
+		case Last:
+			v = last
+		case Rate:
+			v = increase / step.Seconds()
+		}
+		points = append(points, model.Sample{Time: t, Value: v})
+	}
+	return points
+}
+
+// BucketRollups is Bucket for rollups, which are placed in the bucket of
+// their start time. Rate uses the last value of each rollup.
+func BucketRollups(rollups []model.Rollup, start, end time.Time, step time.Duration, agg Aggregation) []model.Sample {
+	points := []model.Sample{}
+	var prev *model.Rollup
+	i := 0
+	for ; i < len(rollups) && rollups[i].Time.Before(start); i++ {
+		prev = &rollups[i]
+	}
+	for t := start; !t.After(end); t = t.Add(step) {
+		next := t.Add(step)
+		var (
+			bucket   = model.Rollup{Time: t}
+			increase float64
+		)
+		for ; i < len(rollups) && rollups[i].Time.Before(next); i++ {
+			bucket.Merge(rollups[i])
+			if prev != nil {
+				increase += Increase(prev.Last, rollups[i].Last)
+			}
+			prev = &rollups[i]
+		}
+		if bucket.Count == 0 {
+			continue
+		}
+		var v float64
+		switch agg {
+		case Avg:
+			v = bucket.Avg
+		case Min:
+			v = bucket.Min
+		case Max:
+			v = bucket.Max
+		case Sum:
+			v = bucket.Avg * float64(bucket.Count)
+		case Last:
+			v = bucket.Last
+		case Rate:
+			v = increase / step.Seconds()
+		}
+		points = append(points, model.Sample{Time: t, Value: v})
+	}
+	return points
+}
@@ -0,0 +1,69 @@
+package series
+
+import (
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(sec int, v float64) model.Sample {
+		return model.Sample{Time: start.Add(time.Duration(sec) * time.Second), Value: v}
+	}
+	samples := []model.Sample{at(-5, 0), at(0, 10), at(5, 20), at(10, 30), at(25, 5)}
+	end := start.Add(29 * time.Second)
+	step := 10 * time.Second
+
+	tests := []struct {
+		agg  Aggregation
+		want []float64
+	}{
+		{Avg, []float64{15, 30, 5}},
+		{Min, []float64{10, 30, 5}},
+		{Max, []float64{20, 30, 5}},
+		{Sum, []float64{30, 30, 5}},
+		{Last, []float64{20, 30, 5}},
+		// 0->10->20 then 20->30, then a reset to 5.
+		{Rate, []float64{2, 1, 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.agg), func(t *testing.T) {
+			points := Bucket(samples, start, end, step, tt.agg)
+			var got []float64
+			for _, p := range points {
+				got = append(got, p.Value)
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, start.Add(20*time.Second), points[2].Time)
+		})
+	}
+}
+
+func TestBucketRollups(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(sec int, v float64) model.Sample {
+		return model.Sample{Time: start.Add(time.Duration(sec) * time.Second), Value: v}
+	}
+	samples := []model.Sample{at(-5, 0), at(0, 10), at(2, 20), at(5, 20), at(10, 30), at(25, 5)}
+	end := start.Add(29 * time.Second)
+	step := 10 * time.Second
+
+	var raw []model.Rollup
+	for _, s := range samples {
+		raw = append(raw, model.RollupOf(s))
+	}
+	rollups := model.Downsample(raw, 5*time.Second, time.Time{}, end)
+	assert.Len(t, rollups, 5)
+
+	for _, agg := range []Aggregation{Avg, Min, Max, Sum, Last, Rate} {
+		t.Run(string(agg), func(t *testing.T) {
+			assert.Equal(t, Bucket(samples, start, end, step, agg), BucketRollups(raw, start, end, step, agg))
+			if agg != Rate {
+				assert.Equal(t, Bucket(samples, start, end, step, agg), BucketRollups(rollups, start, end, step, agg))
+			}
+		})
+	}
+}
@@ -6,17 +6,22 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/randomtoy/gometrics/internal/admin"
 	"github.com/randomtoy/gometrics/internal/compress"
 	"github.com/randomtoy/gometrics/internal/crypto"
+	"github.com/randomtoy/gometrics/internal/dashboard"
 	"github.com/randomtoy/gometrics/internal/handlers"
 	"github.com/randomtoy/gometrics/internal/logger"
+	"github.com/randomtoy/gometrics/internal/tenant"
 	"go.uber.org/zap"
 )
 
 type Server struct {
-	log     *zap.SugaredLogger
-	handler *handlers.Handler
-	key     string
+	log        *zap.SugaredLogger
+	handler    *handlers.Handler
+	key        string
+	tenants    map[string]string
+	adminToken string
 }
 type Option func(s *Server)
 
@@ -37,10 +42,25 @@ func WithHMAC(key string) Option {
 	}
 }
 
+func WithTenantTokens(tokens map[string]string) Option {
+	return func(s *Server) {
+		s.tenants = tokens
+	}
+}
+
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
 func (s *Server) Run(addr string) error {
 	e := echo.New()
 
-	e.Use(middleware.Gzip())
+	// Backups are gzip'd already.
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		Skipper: func(c echo.Context) bool { return c.Path() == "/admin/backup" },
+	}))
 
 	e.Use(logger.ResponseLogger(*s.log))
 	e.Use(compress.GzipDecompress)
@@ -50,13 +70,36 @@ func (s *Server) Run(addr string) error {
 		e.Use(crypto.HMACSHA256Middleware(s.key))
 	}
 	fmt.Printf("%#v", s.key)
-	e.GET("/", s.handler.HandleAllMetrics)
+	// Tenant resolution is per route so that the admin group can use its own
+	// bearer token.
+	tm := tenant.Middleware(s.tenants)
+	e.GET("/", s.handler.HandleAllMetrics, tm)
+	e.GET("/metric/:name", s.handler.MetricPage, tm)
+	e.StaticFS("/static", dashboard.Static)
 	e.GET("/ping", s.handler.PingDBHandler)
-	e.POST("/value/", s.handler.GetMetricJSON)
-	e.GET("/value/*", s.handler.HandleMetrics)
-	e.POST("/update/", s.handler.UpdateMetricJSON)
-	e.POST("/update/*", s.handler.HandleUpdate)
-	e.POST("/updates/", s.handler.BatchHandler)
+	e.POST("/value/", s.handler.GetMetricJSON, tm)
+	e.GET("/value/*", s.handler.HandleMetrics, tm)
+	e.POST("/update/", s.handler.UpdateMetricJSON, tm)
+	e.POST("/update/*", s.handler.HandleUpdate, tm)
+	e.POST("/updates/", s.handler.BatchHandler, tm)
+	e.GET("/api/v1/metrics", s.handler.ListMetrics, tm)
+	e.GET("/api/v1/stream", s.handler.Stream, tm)
+	e.GET("/api/v1/ws", s.handler.StreamWebSocket, tm)
+	e.GET("/api/v1/query", s.handler.Query, tm)
+	e.GET("/api/v1/query_range", s.handler.QueryRange, tm)
+
+	auth := admin.TokenAuth(s.adminToken)
+	e.DELETE("/value/:type/:name", s.handler.DeleteMetric, auth)
+	e.DELETE("/values/", s.handler.BatchDeleteHandler, auth)
+	e.POST("/reset/counter/:name", s.handler.ResetCounter, auth)
+
+	a := e.Group("/admin", auth)
+	a.GET("/tenants", s.handler.ListTenants)
+	a.GET("/cardinality", s.handler.Cardinality)
+	a.POST("/metrics/retype", s.handler.RetypeMetric)
+	a.DELETE("/metrics/:id", s.handler.AdminDeleteMetric)
+	a.GET("/backup", s.handler.Backup)
+	a.POST("/restore", s.handler.Restore)
 
 	e.Any("/*", func(c echo.Context) error {
 		return c.String(http.StatusNotFound, "Page not found")
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/dump"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"go.uber.org/zap"
+)
+
+type OverflowMode string
+
+const (
+	OverflowReject OverflowMode = "reject"
+	OverflowDrop   OverflowMode = "drop"
+	OverflowLog    OverflowMode = "log"
+)
+
+var (
+	ErrSeriesLimit = errors.New("series limit exceeded")
+	// ErrSeriesDropped is returned for a single write the guard dropped in
+	// OverflowDrop mode.
+	ErrSeriesDropped = errors.New("series dropped: series limit exceeded")
+)
+
+type CardinalityLimits struct {
+	// MaxSeries caps the number of series across all tenants, 0 disables.
+	MaxSeries int
+	// MaxPrefixSeries caps the number of series sharing one name prefix.
+	MaxPrefixSeries int
+	Overflow        OverflowMode
+}
+
+type PrefixCount struct {
+	Prefix string `json:"prefix"`
+	Series int    `json:"series"`
+}
+
+type CardinalityReport struct {
+	Series          int           `json:"series"`
+	MaxSeries       int           `json:"max_series"`
+	MaxPrefixSeries int           `json:"max_prefix_series"`
+	Overflow        OverflowMode  `json:"overflow"`
+	Rejected        int64         `json:"rejected"`
+	Dropped         int64         `json:"dropped"`
+	Logged          int64         `json:"logged"`
+	Top             []PrefixCount `json:"top"`
+}
+
+// CardinalityReporter is implemented by storages that track series counts.
+type CardinalityReporter interface {
+	Cardinality(top int) CardinalityReport
+}
+
+// BatchDropper is implemented by storages that may drop metrics of a batch
+// instead of failing it.
+type BatchDropper interface {
+	// UpdateMetricBatchDropped is UpdateMetricBatch also returning how many
+	// metrics were dropped.
+	UpdateMetricBatchDropped(ctx context.Context, metrics []model.Metric) (int, error)
+}
+
+// CardinalityGuard wraps a Storage and refuses to create series beyond the
+// configured limits. It keeps its own index of series keyed by tenant and ID.
+type CardinalityGuard struct {
+	Storage
+	log    *zap.SugaredLogger
+	limits CardinalityLimits
+
+	mu       sync.Mutex
+	series   map[string]struct{}
+	prefixes map[string]int
+	// pending counts the writes holding a reservation of a series that is
+	// not known to be stored yet. Once one of them succeeds the series
+	// stays, the last one failing gives it back.
+	pending  map[string]int
+	rejected int64
+	dropped  int64
+	logged   int64
+}
+
+func NewCardinalityGuard(ctx context.Context, l *zap.SugaredLogger, store Storage, limits CardinalityLimits) (*CardinalityGuard, error) {
+	if limits.Overflow == "" {
+		limits.Overflow = OverflowReject
+	}
+	switch limits.Overflow {
+	case OverflowReject, OverflowDrop, OverflowLog:
+	default:
+		return nil, fmt.Errorf("unknown series overflow mode: %s", limits.Overflow)
+	}
+	g := &CardinalityGuard{
+		Storage:  store,
+		log:      l,
+		limits:   limits,
+		series:   make(map[string]struct{}),
+		prefixes: make(map[string]int),
+		pending:  make(map[string]int),
+	}
+	err := g.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// load counts the series already in storage and replaces the index with
+// them. Storage is read without holding mu.
+func (g *CardinalityGuard) load(ctx context.Context) error {
+	series := make(map[string]struct{})
+	prefixes := make(map[string]int)
+	tenants, err := g.Storage.ListTenants(ctx)
+	if err != nil {
+		return fmt.Errorf("cant list tenants: %w", err)
+	}
+	for _, t := range tenants {
+		metrics, err := g.Storage.GetAllMetrics(tenant.WithTenant(ctx, t))
+		if err != nil {
+			return fmt.Errorf("cant load series of tenant %s: %w", t, err)
+		}
+		for id := range metrics {
+			series[tenant.Key(t, id)] = struct{}{}
+			prefixes[SeriesPrefix(id)]++
+		}
+	}
+	g.mu.Lock()
+	g.series, g.prefixes = series, prefixes
+	g.mu.Unlock()
+	return nil
+}
+
+// SeriesPrefix groups metric IDs into families: the name is cut at the first
+// '.', '_' or ':' and trailing digits are dropped, so CPUutilization0..N
+// share the CPUutilization prefix.
+func SeriesPrefix(id string) string {
+	if i := strings.IndexAny(id, "._:"); i > 0 {
+		id = id[:i]
+	}
+	trimmed := strings.TrimRight(id, "0123456789")
+	if trimmed == "" {
+		return id
+	}
+	return trimmed
+}
+
+func (g *CardinalityGuard) add(key, id string) {
+	if _, found := g.series[key]; found {
+		return
+	}
+	g.series[key] = struct{}{}
+	g.prefixes[SeriesPrefix(id)]++
+}
+
+func (g *CardinalityGuard) remove(key, id string) {
+	if _, found := g.series[key]; !found {
+		return
+	}
+	delete(g.series, key)
+	prefix := SeriesPrefix(id)
+	g.prefixes[prefix]--
+	if g.prefixes[prefix] <= 0 {
+		delete(g.prefixes, prefix)
+	}
+}
+
+// admit decides which of metrics may be written and reserves the series
+// they create, so writers running at the same time count them. It returns
+// the admitted metrics and the reserved IDs. Caller must hold mu.
+func (g *CardinalityGuard) admit(t string, metrics []model.Metric) ([]model.Metric, []string, error) {
+	admitted := make([]model.Metric, 0, len(metrics))
+	var reserved []string
+	for _, m := range metrics {
+		key := tenant.Key(t, m.ID)
+		if _, found := g.series[key]; found {
+			// Share the reservation of a write still in flight.
+			if n, ok := g.pending[key]; ok && !slices.Contains(reserved, m.ID) {
+				g.pending[key] = n + 1
+				reserved = append(reserved, m.ID)
+			}
+			admitted = append(admitted, m)
+			continue
+		}
+		prefix := SeriesPrefix(m.ID)
+		overGlobal := g.limits.MaxSeries > 0 && len(g.series) >= g.limits.MaxSeries
+		overPrefix := g.limits.MaxPrefixSeries > 0 && g.prefixes[prefix] >= g.limits.MaxPrefixSeries
+		if overGlobal || overPrefix {
+			switch g.limits.Overflow {
+			case OverflowReject:
+				g.rejected++
+				g.unreserve(t, reserved)
+				return nil, nil, fmt.Errorf("%w: %s", ErrSeriesLimit, m.ID)
+			case OverflowDrop:
+				g.dropped++
+				g.log.Infof("dropping new series %s of tenant %s: series limit exceeded", m.ID, t)
+				continue
+			case OverflowLog:
+				g.logged++
+				g.log.Warnf("series limit exceeded by %s of tenant %s", m.ID, t)
+			}
+		}
+		g.add(key, m.ID)
+		g.pending[key] = 1
+		reserved = append(reserved, m.ID)
+		admitted = append(admitted, m)
+	}
+	return admitted, reserved, nil
+}
+
+// reserve admits metrics of tenant t, holding mu only for the check so
+// storage is written without it.
+func (g *CardinalityGuard) reserve(t string, metrics []model.Metric) ([]model.Metric, []string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.admit(t, metrics)
+}
+
+// settle ends the reservations of a write: the series are stored when it
+// succeeded, otherwise the last failed write gives them back.
+func (g *CardinalityGuard) settle(t string, reserved []string, stored bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !stored {
+		g.unreserve(t, reserved)
+		return
+	}
+	for _, id := range reserved {
+		delete(g.pending, tenant.Key(t, id))
+	}
+}
+
+// unreserve is settle of a failed write for callers holding mu.
+func (g *CardinalityGuard) unreserve(t string, reserved []string) {
+	for _, id := range reserved {
+		key := tenant.Key(t, id)
+		n, ok := g.pending[key]
+		if !ok {
+			// Another write stored it meanwhile.
+			continue
+		}
+		if n > 1 {
+			g.pending[key] = n - 1
+			continue
+		}
+		delete(g.pending, key)
+		g.remove(key, id)
+	}
+}
+
+// forget removes series deleted from storage from the index.
+func (g *CardinalityGuard) forget(t string, ids []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, id := range ids {
+		key := tenant.Key(t, id)
+		delete(g.pending, key)
+		g.remove(key, id)
+	}
+}
+
+// UpdateMetric returns ErrSeriesDropped when the metric is dropped over the
+// limit, so callers don't report it as stored.
+func (g *CardinalityGuard) UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error) {
+	t := tenant.FromContext(ctx)
+	admitted, reserved, err := g.reserve(t, []model.Metric{metric})
+	if err != nil {
+		return model.Metric{}, err
+	}
+	if len(admitted) == 0 {
+		return model.Metric{}, fmt.Errorf("%w: %s", ErrSeriesDropped, metric.ID)
+	}
+	res, err := g.Storage.UpdateMetric(ctx, metric)
+	g.settle(t, reserved, err == nil)
+	return res, err
+}
+
+func (g *CardinalityGuard) UpdateMetricBatch(ctx context.Context, metrics []model.Metric) error {
+	_, err := g.UpdateMetricBatchDropped(ctx, metrics)
+	return err
+}
+
+func (g *CardinalityGuard) UpdateMetricBatchDropped(ctx context.Context, metrics []model.Metric) (int, error) {
+	t := tenant.FromContext(ctx)
+	admitted, reserved, err := g.reserve(t, metrics)
+	if err != nil {
+		return 0, err
+	}
+	dropped := len(metrics) - len(admitted)
+	if len(admitted) == 0 {
+		return dropped, nil
+	}
+	err = g.Storage.UpdateMetricBatch(ctx, admitted)
+	g.settle(t, reserved, err == nil)
+	if err != nil {
+		return 0, err
+	}
+	return dropped, nil
+}
+
+func (g *CardinalityGuard) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	t := tenant.FromContext(ctx)
+	admitted, reserved, err := g.reserve(t, []model.Metric{metric})
+	if err != nil || len(admitted) == 0 {
+		return err
+	}
+	err = g.Storage.PutSeries(ctx, metric, samples)
+	g.settle(t, reserved, err == nil)
+	return err
+}
+
+// Restore is not limited: a backup is restored whole and the series are
+// counted again afterwards.
+func (g *CardinalityGuard) Restore(ctx context.Context, r dump.Reader, replace bool) (int, error) {
+	n, err := g.Storage.Restore(ctx, r, replace)
+	if err != nil {
+		return 0, err
+	}
+	err = g.load(ctx)
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (g *CardinalityGuard) DeleteMetric(ctx context.Context, id string) error {
+	err := g.Storage.DeleteMetric(ctx, id)
+	if err != nil {
+		return err
+	}
+	g.forget(tenant.FromContext(ctx), []string{id})
+	return nil
+}
+
+func (g *CardinalityGuard) ExpireMetric(ctx context.Context, id string, before time.Time) (bool, error) {
+	expired, err := g.Storage.ExpireMetric(ctx, id, before)
+	if err != nil || !expired {
+		return expired, err
+	}
+	g.forget(tenant.FromContext(ctx), []string{id})
+	return true, nil
+}
+
+func (g *CardinalityGuard) DeleteByPrefix(ctx context.Context, prefix string) ([]string, error) {
+	ids, err := g.Storage.DeleteByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	g.forget(tenant.FromContext(ctx), ids)
+	return ids, nil
+}
+
+func (g *CardinalityGuard) Cardinality(top int) CardinalityReport {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	counts := make([]PrefixCount, 0, len(g.prefixes))
+	for p, n := range g.prefixes {
+		counts = append(counts, PrefixCount{Prefix: p, Series: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Series != counts[j].Series {
+			return counts[i].Series > counts[j].Series
+		}
+		return counts[i].Prefix < counts[j].Prefix
+	})
+	if top > 0 && len(counts) > top {
+		counts = counts[:top]
+	}
+	return CardinalityReport{
+		Series:          len(g.series),
+		MaxSeries:       g.limits.MaxSeries,
+		MaxPrefixSeries: g.limits.MaxPrefixSeries,
+		Overflow:        g.limits.Overflow,
+		Rejected:        g.rejected,
+		Dropped:         g.dropped,
+		Logged:          g.logged,
+		Top:             counts,
+	}
+}
+
+// Subscribe exposes the change feed of the wrapped storage.
+func (g *CardinalityGuard) Subscribe(ctx context.Context, filter FeedFilter) (*Subscription, error) {
+	s, ok := g.Storage.(Subscriber)
+	if !ok {
+		return nil, ErrNoFeed
+	}
+	return s.Subscribe(ctx, filter)
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/memorystorage"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSeriesPrefix(t *testing.T) {
+	assert.Equal(t, "CPUutilization", SeriesPrefix("CPUutilization12"))
+	assert.Equal(t, "http", SeriesPrefix("http_requests_total"))
+	assert.Equal(t, "HeapAlloc", SeriesPrefix("HeapAlloc"))
+	assert.Equal(t, "42", SeriesPrefix("42"))
+}
+
+func TestCardinalityGuard(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	value := float64(1)
+	gauge := func(id string) model.Metric {
+		return model.Metric{ID: id, Type: model.Gauge, Value: &value}
+	}
+
+	t.Run("Reject over prefix limit", func(t *testing.T) {
+		g, err := NewCardinalityGuard(ctx, l, memorystorage.NewInMemoryStorage(l, ""), CardinalityLimits{MaxPrefixSeries: 2})
+		assert.NoError(t, err)
+
+		err = g.UpdateMetricBatch(ctx, []model.Metric{gauge("CPUutilization0"), gauge("CPUutilization1")})
+		assert.NoError(t, err)
+
+		_, err = g.UpdateMetric(ctx, gauge("CPUutilization2"))
+		assert.ErrorIs(t, err, ErrSeriesLimit)
+
+		_, err = g.UpdateMetric(ctx, gauge("CPUutilization1"))
+		assert.NoError(t, err)
+
+		report := g.Cardinality(10)
+		assert.Equal(t, 2, report.Series)
+		assert.Equal(t, int64(1), report.Rejected)
+		assert.Equal(t, []PrefixCount{{Prefix: "CPUutilization", Series: 2}}, report.Top)
+	})
+
+	t.Run("Drop over global limit", func(t *testing.T) {
+		g, err := NewCardinalityGuard(ctx, l, memorystorage.NewInMemoryStorage(l, ""), CardinalityLimits{MaxSeries: 1, Overflow: OverflowDrop})
+		assert.NoError(t, err)
+
+		err = g.UpdateMetricBatch(ctx, []model.Metric{gauge("Alloc"), gauge("Sys")})
+		assert.NoError(t, err)
+
+		all, err := g.GetAllMetrics(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, all, 1)
+		assert.Equal(t, int64(1), g.Cardinality(0).Dropped)
+	})
+	t.Run("Drop a single write", func(t *testing.T) {
+		g, err := NewCardinalityGuard(ctx, l, memorystorage.NewInMemoryStorage(l, ""), CardinalityLimits{MaxSeries: 1, Overflow: OverflowDrop})
+		require.NoError(t, err)
+
+		_, err = g.UpdateMetric(ctx, gauge("Alloc"))
+		require.NoError(t, err)
+		_, err = g.UpdateMetric(ctx, gauge("Sys"))
+		assert.ErrorIs(t, err, ErrSeriesDropped)
+	})
+
+	t.Run("Storage is written without the lock", func(t *testing.T) {
+		store := &blockingStorage{
+			InMemoryStorage: memorystorage.NewInMemoryStorage(l, ""),
+			calls:           make(chan chan error),
+		}
+		g, err := NewCardinalityGuard(ctx, l, store, CardinalityLimits{MaxSeries: 1})
+		require.NoError(t, err)
+
+		update := func(id string) <-chan error {
+			done := make(chan error, 1)
+			go func() {
+				_, err := g.UpdateMetric(ctx, gauge(id))
+				done <- err
+			}()
+			return done
+		}
+		first := update("Alloc")
+		firstCall := <-store.calls
+		// The pending write holds the only slot.
+		assert.Equal(t, 1, g.Cardinality(0).Series)
+		_, err = g.UpdateMetric(ctx, gauge("Sys"))
+		assert.ErrorIs(t, err, ErrSeriesLimit)
+
+		// A second writer of the same series shares the reservation, the
+		// first one failing doesn't give it back.
+		second := update("Alloc")
+		secondCall := <-store.calls
+		firstCall <- errors.New("write failed")
+		assert.Error(t, <-first)
+		assert.Equal(t, 1, g.Cardinality(0).Series)
+		secondCall <- nil
+		assert.NoError(t, <-second)
+		assert.Equal(t, 1, g.Cardinality(0).Series)
+
+		// A failed write of a new series gives its slot back.
+		require.NoError(t, g.DeleteMetric(ctx, "Alloc"))
+		third := update("Sys")
+		(<-store.calls) <- errors.New("write failed")
+		assert.Error(t, <-third)
+		assert.Equal(t, 0, g.Cardinality(0).Series)
+	})
+}
+
+// blockingStorage holds each UpdateMetric until the test answers on the
+// channel it sends to calls, failing with the error it gets.
+type blockingStorage struct {
+	*memorystorage.InMemoryStorage
+	calls chan chan error
+}
+
+func (s *blockingStorage) UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error) {
+	reply := make(chan error)
+	s.calls <- reply
+	err := <-reply
+	if err != nil {
+		return model.Metric{}, err
+	}
+	return s.InMemoryStorage.UpdateMetric(ctx, metric)
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+)
+
+const DefaultFeedBuffer = 256
+
+var (
+	// ErrSlowConsumer ends a subscription whose buffer overflowed. The
+	// subscriber should reload the current state and subscribe again.
+	ErrSlowConsumer = errors.New("subscriber too slow, events dropped")
+	ErrNoFeed       = errors.New("storage has no change feed")
+)
+
+// FeedFilter selects metrics by exact name or name prefix. The zero value
+// matches everything.
+type FeedFilter struct {
+	Name   string
+	Prefix string
+}
+
+func (f FeedFilter) Match(id string) bool {
+	if f.Name != "" && id != f.Name {
+		return false
+	}
+	return strings.HasPrefix(id, f.Prefix)
+}
+
+// Subscription delivers updated metrics of one tenant on C. C is closed when
+// the subscription context ends or the subscriber falls behind; Err tells
+// which.
+type Subscription struct {
+	C <-chan model.Metric
+
+	ch     chan model.Metric
+	tenant string
+	filter FeedFilter
+	err    error
+}
+
+// Err returns why C was closed. It is only valid after C is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Subscriber is implemented by storages that publish a change feed.
+type Subscriber interface {
+	Subscribe(ctx context.Context, filter FeedFilter) (*Subscription, error)
+}
+
+// Feed wraps a Storage and publishes every successful write to subscribers.
+// Publishing never blocks: a subscriber whose buffer is full is dropped with
+// ErrSlowConsumer.
+type Feed struct {
+	Storage
+	buffer int
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewFeed(store Storage, buffer int) *Feed {
+	if buffer <= 0 {
+		buffer = DefaultFeedBuffer
+	}
+	return &Feed{
+		Storage: store,
+		buffer:  buffer,
+		subs:    make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe registers a subscriber for the tenant of ctx until ctx is done.
+func (f *Feed) Subscribe(ctx context.Context, filter FeedFilter) (*Subscription, error) {
+	ch := make(chan model.Metric, f.buffer)
+	sub := &Subscription{
+		C:      ch,
+		ch:     ch,
+		tenant: tenant.FromContext(ctx),
+		filter: filter,
+	}
+	f.mu.Lock()
+	f.subs[sub] = struct{}{}
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.close(sub, ctx.Err())
+	}()
+	return sub, nil
+}
+
+// close removes sub and closes its channel. Caller must hold mu.
+func (f *Feed) close(sub *Subscription, err error) {
+	if _, found := f.subs[sub]; !found {
+		return
+	}
+	delete(f.subs, sub)
+	sub.err = err
+	close(sub.ch)
+}
+
+func (f *Feed) hasSubscribers() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs) > 0
+}
+
+func (f *Feed) publish(t string, metrics ...model.Metric) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		if sub.tenant != t {
+			continue
+		}
+		for _, m := range metrics {
+			if !sub.filter.Match(m.ID) {
+				continue
+			}
+			select {
+			case sub.ch <- m:
+			default:
+				f.close(sub, ErrSlowConsumer)
+			}
+			if _, found := f.subs[sub]; !found {
+				break
+			}
+		}
+	}
+}
+
+func (f *Feed) UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error) {
+	res, err := f.Storage.UpdateMetric(ctx, metric)
+	if err != nil {
+		return res, err
+	}
+	f.publish(tenant.FromContext(ctx), res)
+	return res, nil
+}
+
+// UpdateMetricBatch publishes the stored values rather than the request, so
+// counters carry their totals. They are only read back when someone listens.
+func (f *Feed) UpdateMetricBatch(ctx context.Context, metrics []model.Metric) error {
+	err := f.Storage.UpdateMetricBatch(ctx, metrics)
+	if err != nil || !f.hasSubscribers() {
+		return err
+	}
+	seen := make(map[string]struct{}, len(metrics))
+	updated := make([]model.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if _, found := seen[m.ID]; found {
+			continue
+		}
+		seen[m.ID] = struct{}{}
+		res, err := f.Storage.GetMetric(ctx, m.ID)
+		if err != nil {
+			continue
+		}
+		updated = append(updated, res)
+	}
+	f.publish(tenant.FromContext(ctx), updated...)
+	return nil
+}
+
+func (f *Feed) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	err := f.Storage.PutSeries(ctx, metric, samples)
+	if err != nil || !f.hasSubscribers() {
+		return err
+	}
+	res, err := f.Storage.GetMetric(ctx, metric.ID)
+	if err == nil {
+		f.publish(tenant.FromContext(ctx), res)
+	}
+	return nil
+}
+
+func (f *Feed) ResetCounter(ctx context.Context, id string) (model.Metric, error) {
+	res, err := f.Storage.ResetCounter(ctx, id)
+	if err != nil {
+		return res, err
+	}
+	f.publish(tenant.FromContext(ctx), res)
+	return res, nil
+}
+
+func (f *Feed) RetypeMetric(ctx context.Context, id string, t model.MetricType) (model.Metric, error) {
+	res, err := f.Storage.RetypeMetric(ctx, id, t)
+	if err != nil {
+		return res, err
+	}
+	f.publish(tenant.FromContext(ctx), res)
+	return res, nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/memorystorage"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestFeed(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	value := float64(1)
+	delta := int64(2)
+	gauge := func(id string) model.Metric {
+		return model.Metric{ID: id, Type: model.Gauge, Value: &value}
+	}
+
+	t.Run("Filters by tenant and prefix", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		f := NewFeed(memorystorage.NewInMemoryStorage(l, ""), 8)
+		sub, err := f.Subscribe(ctx, FeedFilter{Prefix: "CPU"})
+		assert.NoError(t, err)
+
+		_, err = f.UpdateMetric(ctx, gauge("Alloc"))
+		assert.NoError(t, err)
+		_, err = f.UpdateMetric(tenant.WithTenant(ctx, "other"), gauge("CPUutilization1"))
+		assert.NoError(t, err)
+		counter := model.Metric{ID: "CPUcount", Type: model.Counter, Delta: &delta}
+		assert.NoError(t, f.UpdateMetricBatch(ctx, []model.Metric{gauge("CPUutilization0"), counter, counter}))
+
+		m := <-sub.C
+		assert.Equal(t, "CPUutilization0", m.ID)
+		m = <-sub.C
+		assert.Equal(t, int64(4), *m.Delta)
+
+		cancel()
+		_, ok := <-sub.C
+		assert.False(t, ok)
+		assert.ErrorIs(t, sub.Err(), context.Canceled)
+	})
+
+	t.Run("Drops slow consumer", func(t *testing.T) {
+		ctx := context.Background()
+		f := NewFeed(memorystorage.NewInMemoryStorage(l, ""), 1)
+		sub, err := f.Subscribe(ctx, FeedFilter{Name: "Alloc"})
+		assert.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			_, err = f.UpdateMetric(ctx, gauge("Alloc"))
+			assert.NoError(t, err)
+		}
+		_, ok := <-sub.C
+		assert.True(t, ok)
+		_, ok = <-sub.C
+		assert.False(t, ok)
+		assert.ErrorIs(t, sub.Err(), ErrSlowConsumer)
+	})
+}
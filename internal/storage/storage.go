@@ -6,23 +6,68 @@ import (
 	"time"
 
 	"github.com/randomtoy/gometrics/internal/db"
+	"github.com/randomtoy/gometrics/internal/dump"
 	"github.com/randomtoy/gometrics/internal/filestorage"
 	"github.com/randomtoy/gometrics/internal/memorystorage"
 	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tsdb"
 	"go.uber.org/zap"
 )
 
 type Storage interface {
 	UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error)
 	UpdateMetricBatch(ctx context.Context, metrics []model.Metric) error
+	// PutSeries stores metric as given, so counters are set rather than
+	// added, and writes samples into its history.
+	PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error
 	GetAllMetrics(ctx context.Context) (map[string]model.Metric, error)
 	GetMetric(ctx context.Context, metric string) (model.Metric, error)
+	ListMetrics(ctx context.Context, filter model.ListFilter) ([]model.Metric, error)
+	GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error)
+	// GetRollups returns the history of id compacted to resolution res.
+	GetRollups(ctx context.Context, id string, res time.Duration, start, end time.Time) ([]model.Rollup, error)
+	// Compact builds the rollups of r up to now and drops expired history.
+	Compact(ctx context.Context, now time.Time, r model.Retention) error
+	ListTenants(ctx context.Context) ([]string, error)
+	// Backup writes every series of every tenant to w from one consistent
+	// view of the storage.
+	Backup(ctx context.Context, w dump.Writer) error
+	// Restore stores the records of r, deleting every series first when
+	// replace is set. Nothing is stored when a record is invalid.
+	Restore(ctx context.Context, r dump.Reader, replace bool) (int, error)
+	RetypeMetric(ctx context.Context, id string, t model.MetricType) (model.Metric, error)
+	DeleteMetric(ctx context.Context, id string) error
+	DeleteByPrefix(ctx context.Context, prefix string) ([]string, error)
+	ResetCounter(ctx context.Context, id string) (model.Metric, error)
+	// ExpireMetric deletes id only if it was last written before the given
+	// time, so a write racing with the janitor is not lost.
+	ExpireMetric(ctx context.Context, id string, before time.Time) (bool, error)
 
 	Close()
 	Ping(ctx context.Context) error
 }
 
 func NewStorage(l *zap.Logger, config model.Config) (Storage, error) {
+	store, err := newBackend(l, config)
+	if err != nil {
+		return nil, err
+	}
+	// The feed sits below the guard so writes dropped by the guard are not
+	// published.
+	feed := NewFeed(store, config.Server.StreamBuffer)
+	guard, err := NewCardinalityGuard(context.Background(), l.Sugar(), feed, CardinalityLimits{
+		MaxSeries:       config.Server.MaxSeries,
+		MaxPrefixSeries: config.Server.MaxPrefixSeries,
+		Overflow:        OverflowMode(config.Server.SeriesOverflow),
+	})
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to init cardinality guard: %w", err)
+	}
+	return guard, nil
+}
+
+func newBackend(l *zap.Logger, config model.Config) (Storage, error) {
 	if config.Server.DatabaseDSN != "" {
 		dbconn, err := db.NewDBConnector(config.Server.DatabaseDSN)
 		if err != nil {
@@ -36,6 +81,15 @@ func NewStorage(l *zap.Logger, config model.Config) (Storage, error) {
 		return dbconn, nil
 	}
 
+	if config.Server.TSDBPath != "" {
+		db, err := tsdb.Open(l.Sugar(), config.Server.TSDBPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open tsdb: %w", err)
+		}
+		l.Info("using embedded tsdb storage", zap.String("path", config.Server.TSDBPath))
+		return db, nil
+	}
+
 	memstorage := memorystorage.NewInMemoryStorage(l.Sugar(), config.Server.FilePath)
 
 	if config.Server.FilePath != "" {
@@ -0,0 +1,36 @@
+package tenant
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware resolves the tenant of a request and stores it in the request
+// context. When tokens are configured the tenant comes only from the bearer
+// token, otherwise the X-Tenant-ID header is trusted.
+func Middleware(tokens map[string]string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := Default
+			if len(tokens) > 0 {
+				token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+				t, ok := tokens[token]
+				if !ok {
+					return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Unknown tenant token"})
+				}
+				id = t
+			} else if h := c.Request().Header.Get(Header); h != "" {
+				if err := Validate(h); err != nil {
+					return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+				}
+				id = h
+			}
+
+			req := c.Request()
+			c.SetRequest(req.WithContext(WithTenant(req.Context(), id)))
+			return next(c)
+		}
+	}
+}
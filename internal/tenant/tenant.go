@@ -0,0 +1,69 @@
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	Default   string = "default"
+	Header    string = "X-Tenant-ID"
+	separator string = "/"
+)
+
+type ctxKey struct{}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the tenant attached to ctx or Default when the request
+// was not routed through the tenant middleware (tests, background jobs).
+func FromContext(ctx context.Context) string {
+	id, ok := ctx.Value(ctxKey{}).(string)
+	if !ok || id == "" {
+		return Default
+	}
+	return id
+}
+
+func Validate(id string) error {
+	if !validName.MatchString(id) {
+		return fmt.Errorf("invalid tenant id: %q", id)
+	}
+	return nil
+}
+
+// Key builds the storage key used by the memory and file backends.
+// Tenant names never contain the separator, so the first one splits the key.
+func Key(tenantID, metricID string) string {
+	return tenantID + separator + metricID
+}
+
+func SplitKey(key string) (tenantID string, metricID string, ok bool) {
+	return strings.Cut(key, separator)
+}
+
+// ParseTokens parses "token:tenant,token:tenant" into a lookup map.
+func ParseTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	if s == "" {
+		return tokens, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		token, id, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || token == "" {
+			return nil, fmt.Errorf("invalid tenant token pair: %q", pair)
+		}
+		err := Validate(id)
+		if err != nil {
+			return nil, err
+		}
+		tokens[token] = id
+	}
+	return tokens, nil
+}
@@ -0,0 +1,136 @@
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Logs are append-only files of records framed as
+// uint32 length | uint32 CRC-32 of payload | payload.
+// A torn or corrupt tail left by a crash is cut off when the log is read.
+
+const frameHeader = 8
+
+func appendFrame(buf, payload []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// replayLog calls fn for each intact record of path and returns the file
+// opened for appending after the last one. A missing file is created. In
+// read-only mode the file is left as is and a missing one is returned as
+// nil.
+func replayLog(path string, readOnly bool, fn func(payload []byte) error) (*os.File, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	if readOnly {
+		f, err = os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant open %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cant stat %s: %w", path, err)
+	}
+	var (
+		r      = bufio.NewReader(f)
+		header [frameHeader]byte
+		valid  int64
+	)
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			break
+		}
+		// A torn header can claim any length, it can't be past the end.
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		if length > info.Size()-valid-frameHeader {
+			break
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(r, payload)
+		if err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		err = fn(payload)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cant replay %s: %w", path, err)
+		}
+		valid += int64(frameHeader + len(payload))
+	}
+	if readOnly {
+		return f, nil
+	}
+	err = f.Truncate(valid)
+	if err == nil {
+		_, err = f.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cant truncate %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// writeLog replaces path with records, going through a temporary file so
+// the old log survives a crash.
+func writeLog(path string, records [][]byte) error {
+	var buf []byte
+	for _, r := range records {
+		buf = appendFrame(buf, r)
+	}
+	return writeFileAtomic(path, buf)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Join(err, os.Remove(tmp))
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
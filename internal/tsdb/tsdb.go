@@ -0,0 +1,1285 @@
+// Package tsdb is an embedded, append-only time-series storage engine.
+//
+// A database directory holds:
+//
+//	wal.log            every write, replayed on open and checkpointed when it grows
+//	chunks-N.dat       Gorilla-compressed chunks of samples, appended as heads fill up
+//	index-N.log        where the chunks of each series are, plus drop and trim markers
+//	rollups.log        the rollups of each tier, checkpointed like the WAL
+//	CURRENT            the generation N in use
+//
+// Compaction rolls up completed buckets into every tier, drops raw samples
+// and rollups past their retention and, once enough of the chunk file is
+// garbage, rewrites the live chunks merged into a new generation.
+package tsdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/dump"
+	"github.com/randomtoy/gometrics/internal/gorilla"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"go.uber.org/zap"
+)
+
+const (
+	// headSamples is how many samples a series buffers before they are cut
+	// into a chunk.
+	headSamples = 120
+	// compactedSamples is the chunk size used when chunks are rewritten.
+	compactedSamples = 1024
+	// minCheckpoint is the WAL size below which it is never checkpointed.
+	minCheckpoint = 1 << 20
+
+	walName     = "wal.log"
+	rollupsName = "rollups.log"
+	currentName = "CURRENT"
+)
+
+type chunkRef struct {
+	MinT int64 `json:"min"`
+	MaxT int64 `json:"max"`
+	Off  int64 `json:"off"`
+	Len  int64 `json:"len"`
+}
+
+type series struct {
+	metric  model.Metric
+	chunks  []chunkRef
+	head    []model.Sample
+	rollups map[time.Duration][]model.Rollup
+}
+
+func (s *series) maxT() int64 {
+	if len(s.head) > 0 {
+		return s.head[len(s.head)-1].Time.UnixMilli()
+	}
+	if len(s.chunks) > 0 {
+		return s.chunks[len(s.chunks)-1].MaxT
+	}
+	return -1 << 63
+}
+
+// add appends p to the head. Samples not newer than the stored history are
+// dropped, except that a write in the same millisecond replaces the last
+// head sample.
+func (s *series) add(p model.Sample) {
+	t, last := p.Time.UnixMilli(), s.maxT()
+	switch {
+	case t > last:
+		s.head = append(s.head, p)
+	case t == last && len(s.head) > 0:
+		s.head[len(s.head)-1] = p
+	}
+}
+
+type walRecord struct {
+	Op     string        `json:"op"`
+	Key    string        `json:"key"`
+	Metric *model.Metric `json:"metric,omitempty"`
+	Sample *model.Sample `json:"sample,omitempty"`
+	// Before is the cut of a trim, in Unix milliseconds.
+	Before int64 `json:"before,omitempty"`
+}
+
+const (
+	opPut    = "put"
+	opSample = "sample"
+	opDelete = "delete"
+	opClear  = "clear"
+)
+
+type indexRecord struct {
+	Op  string    `json:"op"`
+	Key string    `json:"key"`
+	Ref *chunkRef `json:"ref,omitempty"`
+	// Before is the cut of a trim, in Unix milliseconds.
+	Before int64 `json:"before,omitempty"`
+}
+
+const (
+	opChunk = "chunk"
+	opDrop  = "drop"
+	// opTrim drops history before a cut, in both the WAL and the index.
+	opTrim = "trim"
+)
+
+type rollupRecord struct {
+	Op      string         `json:"op"`
+	Key     string         `json:"key"`
+	Res     time.Duration  `json:"res,omitempty"`
+	Rollups []model.Rollup `json:"rollups,omitempty"`
+	Before  int64          `json:"before,omitempty"`
+}
+
+// opRollup appends the buckets of one tier, opTrim and opDrop are shared
+// with the index.
+const opRollup = "rollup"
+
+// trimRollups drops the buckets starting before the cut.
+func trimRollups(rollups []model.Rollup, before int64) []model.Rollup {
+	i := sort.Search(len(rollups), func(i int) bool { return rollups[i].Time.UnixMilli() >= before })
+	return rollups[i:]
+}
+
+// trimChunks drops the chunks ending before the cut.
+func trimChunks(chunks []chunkRef, before int64) []chunkRef {
+	i := 0
+	for ; i < len(chunks) && chunks[i].MaxT < before; i++ {
+	}
+	return chunks[i:]
+}
+
+// trimHead drops the head samples older than the cut.
+func trimHead(head []model.Sample, before int64) []model.Sample {
+	i := sort.Search(len(head), func(i int) bool { return head[i].Time.UnixMilli() >= before })
+	return head[i:]
+}
+
+// ErrReadOnly is returned by the writes to a database opened with
+// OpenReadOnly.
+var ErrReadOnly = errors.New("tsdb is read-only")
+
+type DB struct {
+	log      *zap.SugaredLogger
+	dir      string
+	readOnly bool
+
+	mu         sync.RWMutex
+	series     map[string]*series
+	gen        int
+	wal        *os.File
+	walSize    int64
+	checkpoint int64
+	index      *os.File
+	chunks     *os.File
+	chunksSize int64
+	dead       int64
+
+	rollups           *os.File
+	rollupsSize       int64
+	rollupsCheckpoint int64
+}
+
+// Open opens the database in dir, creating it if needed.
+func Open(l *zap.SugaredLogger, dir string) (*DB, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("cant create %s: %w", dir, err)
+	}
+	return open(l, dir, false)
+}
+
+// OpenReadOnly opens the existing database in dir without changing any of
+// its files, not even the torn tail of a log. Writes return ErrReadOnly.
+func OpenReadOnly(l *zap.SugaredLogger, dir string) (*DB, error) {
+	_, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cant open %s: %w", dir, err)
+	}
+	return open(l, dir, true)
+}
+
+func open(l *zap.SugaredLogger, dir string, readOnly bool) (*DB, error) {
+	var err error
+	db := &DB{
+		log:      l,
+		dir:      dir,
+		readOnly: readOnly,
+		series:   make(map[string]*series),
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, currentName)); err == nil {
+		db.gen, err = strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", currentName, err)
+		}
+	}
+	if readOnly {
+		db.chunks, err = os.Open(db.chunksPath(db.gen))
+	} else {
+		db.chunks, err = os.OpenFile(db.chunksPath(db.gen), os.O_RDWR|os.O_CREATE, 0o644)
+	}
+	switch {
+	case readOnly && errors.Is(err, os.ErrNotExist):
+		db.chunks = nil
+	case err != nil:
+		return nil, fmt.Errorf("cant open chunks: %w", err)
+	default:
+		st, err := db.chunks.Stat()
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("cant stat chunks: %w", err)
+		}
+		db.chunksSize = st.Size()
+	}
+
+	refs := make(map[string][]chunkRef)
+	db.index, err = replayLog(db.indexPath(db.gen), readOnly, func(payload []byte) error {
+		var r indexRecord
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return err
+		}
+		switch r.Op {
+		case opChunk:
+			refs[r.Key] = append(refs[r.Key], *r.Ref)
+		case opDrop:
+			delete(refs, r.Key)
+		case opTrim:
+			refs[r.Key] = trimChunks(refs[r.Key], r.Before)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	db.wal, err = replayLog(filepath.Join(dir, walName), readOnly, func(payload []byte) error {
+		var r walRecord
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return err
+		}
+		db.replay(r, refs)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.walSize, _ = db.wal.Seek(0, io.SeekEnd)
+	db.checkpoint = db.walSize
+
+	rollups := make(map[string]map[time.Duration][]model.Rollup)
+	db.rollups, err = replayLog(filepath.Join(dir, rollupsName), readOnly, func(payload []byte) error {
+		var r rollupRecord
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return err
+		}
+		if r.Op != opDrop && rollups[r.Key] == nil {
+			rollups[r.Key] = make(map[time.Duration][]model.Rollup)
+		}
+		switch r.Op {
+		case opRollup:
+			rollups[r.Key][r.Res] = append(rollups[r.Key][r.Res], r.Rollups...)
+		case opTrim:
+			rollups[r.Key][r.Res] = trimRollups(rollups[r.Key][r.Res], r.Before)
+		case opDrop:
+			delete(rollups, r.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for key, rs := range rollups {
+		if s := db.series[key]; s != nil {
+			s.rollups = rs
+		}
+	}
+	db.rollupsSize, _ = db.rollups.Seek(0, io.SeekEnd)
+	db.rollupsCheckpoint = db.rollupsSize
+
+	live := int64(0)
+	for _, s := range db.series {
+		for _, ref := range s.chunks {
+			live += ref.Len
+		}
+	}
+	db.dead = db.chunksSize - live
+	return db, nil
+}
+
+// replay applies a WAL record. Samples already cut into a chunk before a
+// crash are skipped by series.add.
+func (db *DB) replay(r walRecord, refs map[string][]chunkRef) {
+	s := db.series[r.Key]
+	if s == nil && (r.Op == opPut || r.Op == opSample) {
+		s = &series{chunks: refs[r.Key]}
+		db.series[r.Key] = s
+	}
+	switch r.Op {
+	case opPut:
+		s.metric = *r.Metric
+		if r.Sample != nil {
+			s.add(*r.Sample)
+		}
+	case opSample:
+		s.add(*r.Sample)
+	case opDelete:
+		delete(db.series, r.Key)
+	case opClear:
+		// refs already reflect the drop, and any chunk cut after it.
+		if s != nil {
+			s.chunks, s.head = refs[r.Key], nil
+		}
+	case opTrim:
+		if s != nil {
+			s.head = trimHead(s.head, r.Before)
+		}
+	}
+}
+
+func (db *DB) chunksPath(gen int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("chunks-%d.dat", gen))
+}
+
+func (db *DB) indexPath(gen int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("index-%d.log", gen))
+}
+
+func (db *DB) writeWAL(records ...walRecord) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	var buf []byte
+	for _, r := range records {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = appendFrame(buf, payload)
+	}
+	n, err := db.wal.Write(buf)
+	db.walSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("cant write wal: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) writeRollups(records ...rollupRecord) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	var buf []byte
+	for _, r := range records {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = appendFrame(buf, payload)
+	}
+	n, err := db.rollups.Write(buf)
+	db.rollupsSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("cant write rollups: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) writeIndex(records ...indexRecord) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	var buf []byte
+	for _, r := range records {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = appendFrame(buf, payload)
+	}
+	_, err := db.index.Write(buf)
+	if err != nil {
+		return fmt.Errorf("cant write index: %w", err)
+	}
+	return nil
+}
+
+// drop forgets the chunks and rollups of key, so they are not resurrected
+// if the series is created again.
+func (db *DB) drop(key string) error {
+	s := db.series[key]
+	if s == nil {
+		return nil
+	}
+	if len(s.rollups) > 0 {
+		err := db.writeRollups(rollupRecord{Op: opDrop, Key: key})
+		if err != nil {
+			return err
+		}
+		s.rollups = nil
+	}
+	if len(s.chunks) == 0 {
+		return nil
+	}
+	err := db.writeIndex(indexRecord{Op: opDrop, Key: key})
+	if err != nil {
+		return err
+	}
+	for _, ref := range s.chunks {
+		db.dead += ref.Len
+	}
+	s.chunks = nil
+	return nil
+}
+
+// cut moves a full head into a chunk. Errors are only logged, the head is
+// kept and cut again on the next write.
+func (db *DB) cut(key string, s *series) {
+	if len(s.head) < headSamples {
+		return
+	}
+	ref, err := db.appendChunk(db.chunks, &db.chunksSize, s.head)
+	// Replay skips the WAL samples an indexed chunk holds, so the chunk
+	// must be on disk before its index record.
+	if err == nil {
+		err = db.chunks.Sync()
+	}
+	if err == nil {
+		err = db.writeIndex(indexRecord{Op: opChunk, Key: key, Ref: &ref})
+	}
+	if err != nil {
+		db.log.Errorf("cant cut chunk of %s: %v", key, err)
+		return
+	}
+	s.chunks = append(s.chunks, ref)
+	s.head = nil
+}
+
+func (db *DB) appendChunk(f *os.File, size *int64, samples []model.Sample) (chunkRef, error) {
+	b := gorilla.EncodeSamples(samples)
+	_, err := f.WriteAt(b, *size)
+	if err != nil {
+		return chunkRef{}, fmt.Errorf("cant write chunk: %w", err)
+	}
+	ref := chunkRef{
+		MinT: samples[0].Time.UnixMilli(),
+		MaxT: samples[len(samples)-1].Time.UnixMilli(),
+		Off:  *size,
+		Len:  int64(len(b)),
+	}
+	*size += ref.Len
+	return ref, nil
+}
+
+func (db *DB) readChunk(ref chunkRef) ([]model.Sample, error) {
+	b := make([]byte, ref.Len)
+	_, err := db.chunks.ReadAt(b, ref.Off)
+	if err != nil {
+		return nil, fmt.Errorf("cant read chunk: %w", err)
+	}
+	return gorilla.DecodeSamples(b)
+}
+
+// write stores metrics that passed the type checks and records a sample
+// for each. Caller must hold mu.
+func (db *DB) write(t string, metrics []model.Metric, now time.Time) ([]model.Metric, error) {
+	now = now.Truncate(time.Millisecond)
+	stored := make(map[string]model.Metric, len(metrics))
+	records := make([]walRecord, 0, len(metrics))
+	for _, m := range metrics {
+		key := tenant.Key(t, m.ID)
+		if m.Type == model.Counter {
+			existing, found := stored[key]
+			if !found && db.series[key] != nil {
+				existing, found = db.series[key].metric, true
+			}
+			if found {
+				m.Summ(existing.Delta)
+			}
+		}
+		m.Touch(now)
+		stored[key] = m
+		sample := m.Sample(now)
+		records = append(records, walRecord{Op: opPut, Key: key, Metric: &m, Sample: &sample})
+	}
+	err := db.writeWAL(records...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]model.Metric, 0, len(records))
+	for _, r := range records {
+		s := db.series[r.Key]
+		if s == nil {
+			s = &series{}
+			db.series[r.Key] = s
+		}
+		s.metric = *r.Metric
+		s.add(*r.Sample)
+		db.cut(r.Key, s)
+		result = append(result, s.metric)
+	}
+	return result, nil
+}
+
+func (db *DB) UpdateMetric(ctx context.Context, metric model.Metric) (model.Metric, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), metric.ID)
+	if s := db.series[key]; s != nil && s.metric.Type != metric.Type {
+		return model.Metric{}, model.TypeConflict(metric.ID, s.metric.Type, metric.Type)
+	}
+	res, err := db.write(tenant.FromContext(ctx), []model.Metric{metric}, time.Now())
+	if err != nil {
+		return model.Metric{}, err
+	}
+	return res[0], nil
+}
+
+func (db *DB) UpdateMetricBatch(ctx context.Context, metrics []model.Metric) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t := tenant.FromContext(ctx)
+	types := make(map[string]model.MetricType, len(metrics))
+	for _, m := range metrics {
+		stored, found := types[m.ID]
+		if !found {
+			if s := db.series[tenant.Key(t, m.ID)]; s != nil {
+				stored, found = s.metric.Type, true
+			}
+		}
+		if found && stored != m.Type {
+			return model.TypeConflict(m.ID, stored, m.Type)
+		}
+		types[m.ID] = m.Type
+	}
+	_, err := db.write(t, metrics, time.Now())
+	return err
+}
+
+// PutSeries stores metric as given and appends samples. The store is
+// append-only, so samples not newer than the stored history are dropped.
+func (db *DB) PutSeries(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), metric.ID)
+	if s := db.series[key]; s != nil && s.metric.Type != metric.Type {
+		return model.TypeConflict(metric.ID, s.metric.Type, metric.Type)
+	}
+	return db.putSeries(key, metric, samples)
+}
+
+// putSeries writes a series without checking its type. Caller must hold mu.
+func (db *DB) putSeries(key string, metric model.Metric, samples []model.Sample) error {
+	s := db.series[key]
+	if s == nil {
+		s = &series{}
+	}
+	if metric.UpdatedAt == nil {
+		metric.Touch(time.Now().Truncate(time.Millisecond))
+	}
+	records := []walRecord{{Op: opPut, Key: key, Metric: &metric}}
+	last := s.maxT()
+	for i := range samples {
+		if samples[i].Time.UnixMilli() > last {
+			records = append(records, walRecord{Op: opSample, Key: key, Sample: &samples[i]})
+			last = samples[i].Time.UnixMilli()
+		}
+	}
+	err := db.writeWAL(records...)
+	if err != nil {
+		return err
+	}
+	db.series[key] = s
+	s.metric = metric
+	for _, r := range records[1:] {
+		s.add(*r.Sample)
+		db.cut(key, s)
+	}
+	return nil
+}
+
+// history returns every sample of s. Caller must hold mu.
+func (db *DB) history(s *series) ([]model.Sample, error) {
+	return db.since(s, math.MinInt64)
+}
+
+// since returns the samples of s from the chunk holding from on, so it may
+// return older ones too. Caller must hold mu.
+func (db *DB) since(s *series, from int64) ([]model.Sample, error) {
+	var samples []model.Sample
+	for _, ref := range s.chunks {
+		if ref.MaxT < from {
+			continue
+		}
+		chunk, err := db.readChunk(ref)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, chunk...)
+	}
+	return append(samples, s.head...), nil
+}
+
+// Backup writes every series to w under the read lock, so writes wait for
+// it to finish.
+func (db *DB) Backup(ctx context.Context, w dump.Writer) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	keys := make([]string, 0, len(db.series))
+	for k := range db.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t, _, ok := tenant.SplitKey(k)
+		if !ok {
+			continue
+		}
+		s := db.series[k]
+		samples, err := db.history(s)
+		if err != nil {
+			return fmt.Errorf("cant read history of %s: %w", k, err)
+		}
+		err = w.Write(dump.Record{Tenant: t, Metric: s.metric, Samples: samples, Rollups: s.rollups})
+		if err != nil {
+			return fmt.Errorf("cant write %s: %w", k, err)
+		}
+	}
+	return w.Close()
+}
+
+// Restore reads and checks every record of r before writing any, then
+// stores them, first deleting every series when replace is set.
+func (db *DB) Restore(ctx context.Context, r dump.Reader, replace bool) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	type staged struct {
+		key     string
+		metric  model.Metric
+		samples []model.Sample
+		rollups map[time.Duration][]model.Rollup
+	}
+	var records []staged
+	_, err := dump.Import(ctx, dump.SinkFuncs{
+		Series: func(ctx context.Context, metric model.Metric, samples []model.Sample) error {
+			key := tenant.Key(tenant.FromContext(ctx), metric.ID)
+			if s := db.series[key]; !replace && s != nil && s.metric.Type != metric.Type {
+				return model.TypeConflict(metric.ID, s.metric.Type, metric.Type)
+			}
+			records = append(records, staged{key: key, metric: metric, samples: samples})
+			return nil
+		},
+		// Import hands over the rollups right after their series.
+		Rollups: func(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+			records[len(records)-1].rollups = rollups
+			return nil
+		},
+	}, r)
+	if err != nil {
+		return 0, err
+	}
+	if replace {
+		keys := make([]string, 0, len(db.series))
+		for k := range db.series {
+			keys = append(keys, k)
+		}
+		err = db.remove(keys...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for i, rec := range records {
+		err = db.putSeries(rec.key, rec.metric, rec.samples)
+		if err == nil && len(rec.rollups) > 0 {
+			err = db.putRollups(rec.key, rec.rollups)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+func (db *DB) GetMetric(ctx context.Context, id string) (model.Metric, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s := db.series[tenant.Key(tenant.FromContext(ctx), id)]
+	if s == nil {
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	return s.metric, nil
+}
+
+func (db *DB) tenantMetrics(ctx context.Context) []model.Metric {
+	prefix := tenant.Key(tenant.FromContext(ctx), "")
+	var metrics []model.Metric
+	for k, s := range db.series {
+		if strings.HasPrefix(k, prefix) {
+			metrics = append(metrics, s.metric)
+		}
+	}
+	return metrics
+}
+
+func (db *DB) GetAllMetrics(ctx context.Context) (map[string]model.Metric, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	result := make(map[string]model.Metric)
+	for _, m := range db.tenantMetrics(ctx) {
+		result[m.ID] = m
+	}
+	return result, nil
+}
+
+func (db *DB) ListMetrics(ctx context.Context, filter model.ListFilter) ([]model.Metric, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return filter.Select(db.tenantMetrics(ctx))
+}
+
+func (db *DB) ListTenants(ctx context.Context) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	seen := make(map[string]struct{})
+	for k := range db.series {
+		if t, _, ok := tenant.SplitKey(k); ok {
+			seen[t] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(seen))
+	for t := range seen {
+		result = append(result, t)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// GetSamples returns the history of id between start and end inclusive.
+// Times are kept with millisecond precision.
+func (db *DB) GetSamples(ctx context.Context, id string, start, end time.Time) ([]model.Sample, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s := db.series[tenant.Key(tenant.FromContext(ctx), id)]
+	if s == nil {
+		return nil, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	from, to := start.UnixMilli(), end.UnixMilli()
+	result := []model.Sample{}
+	keep := func(samples []model.Sample) {
+		for _, p := range samples {
+			if t := p.Time.UnixMilli(); t >= from && t <= to {
+				result = append(result, p)
+			}
+		}
+	}
+	for _, ref := range s.chunks {
+		if ref.MaxT < from || ref.MinT > to {
+			continue
+		}
+		samples, err := db.readChunk(ref)
+		if err != nil {
+			return nil, fmt.Errorf("cant read history of %s: %w", id, err)
+		}
+		keep(samples)
+	}
+	keep(s.head)
+	return result, nil
+}
+
+// GetRollups returns the rollups of id at resolution res between start and
+// end inclusive, as built by Compact.
+func (db *DB) GetRollups(ctx context.Context, id string, res time.Duration, start, end time.Time) ([]model.Rollup, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s := db.series[tenant.Key(tenant.FromContext(ctx), id)]
+	if s == nil {
+		return nil, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	rollups := s.rollups[res]
+	from := sort.Search(len(rollups), func(i int) bool { return !rollups[i].Time.Before(start) })
+	to := sort.Search(len(rollups), func(i int) bool { return rollups[i].Time.After(end) })
+	if from >= to {
+		return []model.Rollup{}, nil
+	}
+	return append([]model.Rollup(nil), rollups[from:to]...), nil
+}
+
+// GetAllRollups returns the rollups of id by resolution.
+func (db *DB) GetAllRollups(ctx context.Context, id string) (map[time.Duration][]model.Rollup, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s := db.series[tenant.Key(tenant.FromContext(ctx), id)]
+	if s == nil {
+		return nil, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	res := make(map[time.Duration][]model.Rollup, len(s.rollups))
+	for r, rollups := range s.rollups {
+		res[r] = append([]model.Rollup(nil), rollups...)
+	}
+	return res, nil
+}
+
+// PutRollups replaces the rollups of id.
+func (db *DB) PutRollups(ctx context.Context, id string, rollups map[time.Duration][]model.Rollup) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	if db.series[key] == nil {
+		return fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	return db.putRollups(key, rollups)
+}
+
+// putRollups replaces the rollups of key, which must exist. Caller must
+// hold mu.
+func (db *DB) putRollups(key string, rollups map[time.Duration][]model.Rollup) error {
+	s := db.series[key]
+	var records []rollupRecord
+	if len(s.rollups) > 0 {
+		records = append(records, rollupRecord{Op: opDrop, Key: key})
+	}
+	kept := make(map[time.Duration][]model.Rollup, len(rollups))
+	for r, rs := range rollups {
+		if len(rs) == 0 {
+			continue
+		}
+		records = append(records, rollupRecord{Op: opRollup, Key: key, Res: r, Rollups: rs})
+		kept[r] = rs
+	}
+	err := db.writeRollups(records...)
+	if err != nil {
+		return err
+	}
+	s.rollups = kept
+	return nil
+}
+
+func (db *DB) RetypeMetric(ctx context.Context, id string, t model.MetricType) (model.Metric, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	s := db.series[key]
+	if s == nil {
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	m := s.metric.Convert(t)
+	// Old samples have the other type's meaning.
+	err := db.drop(key)
+	if err != nil {
+		return model.Metric{}, err
+	}
+	err = db.writeWAL(walRecord{Op: opClear, Key: key}, walRecord{Op: opPut, Key: key, Metric: &m})
+	if err != nil {
+		return model.Metric{}, err
+	}
+	s.metric, s.head = m, nil
+	return m, nil
+}
+
+func (db *DB) ResetCounter(ctx context.Context, id string) (model.Metric, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	s := db.series[key]
+	if s == nil {
+		return model.Metric{}, fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	if s.metric.Type != model.Counter {
+		return model.Metric{}, model.TypeConflict(id, s.metric.Type, model.Counter)
+	}
+	now := time.Now().Truncate(time.Millisecond)
+	m := s.metric
+	zero := int64(0)
+	m.Delta = &zero
+	m.Touch(now)
+	sample := m.Sample(now)
+	err := db.writeWAL(walRecord{Op: opPut, Key: key, Metric: &m, Sample: &sample})
+	if err != nil {
+		return model.Metric{}, err
+	}
+	s.metric = m
+	s.add(sample)
+	db.cut(key, s)
+	return m, nil
+}
+
+// remove deletes the series stored under keys. Caller must hold mu.
+func (db *DB) remove(keys ...string) error {
+	records := make([]walRecord, 0, len(keys))
+	for _, key := range keys {
+		err := db.drop(key)
+		if err != nil {
+			return err
+		}
+		records = append(records, walRecord{Op: opDelete, Key: key})
+	}
+	err := db.writeWAL(records...)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(db.series, key)
+	}
+	return nil
+}
+
+func (db *DB) DeleteMetric(ctx context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	if db.series[key] == nil {
+		return fmt.Errorf("%w: %s", model.ErrNotFound, id)
+	}
+	return db.remove(key)
+}
+
+func (db *DB) DeleteByPrefix(ctx context.Context, prefix string) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t := tenant.FromContext(ctx)
+	keyPrefix := tenant.Key(t, prefix)
+	var keys, ids []string
+	for k, s := range db.series {
+		if strings.HasPrefix(k, keyPrefix) {
+			keys = append(keys, k)
+			ids = append(ids, s.metric.ID)
+		}
+	}
+	err := db.remove(keys...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (db *DB) ExpireMetric(ctx context.Context, id string, before time.Time) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := tenant.Key(tenant.FromContext(ctx), id)
+	s := db.series[key]
+	if s == nil || !s.metric.StaleBefore(before) {
+		return false, nil
+	}
+	err := db.remove(key)
+	return err == nil, err
+}
+
+// Compact rolls up every bucket completed by now, each tier continuing
+// after its newest bucket, and drops raw samples and rollups past
+// retention. It then rewrites the chunk file once at least a third of it
+// is garbage and checkpoints the WAL and the rollups once they doubled
+// since the last checkpoint.
+func (db *DB) Compact(ctx context.Context, now time.Time, r model.Retention) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	err := db.rollup(now, r.Tiers)
+	if err != nil {
+		return fmt.Errorf("cant roll up history: %w", err)
+	}
+	if r.Raw > 0 {
+		err := db.trim(now.Add(-r.Raw).UnixMilli())
+		if err != nil {
+			return fmt.Errorf("cant drop expired history: %w", err)
+		}
+	}
+	if db.dead > 0 && db.dead*3 >= db.chunksSize {
+		err := db.rewrite()
+		if err != nil {
+			return fmt.Errorf("cant rewrite chunks: %w", err)
+		}
+	}
+	if db.walSize >= minCheckpoint && db.walSize >= 2*db.checkpoint {
+		err := db.checkpointWAL()
+		if err != nil {
+			return fmt.Errorf("cant checkpoint wal: %w", err)
+		}
+	}
+	if db.rollupsSize >= minCheckpoint && db.rollupsSize >= 2*db.rollupsCheckpoint {
+		err := db.checkpointRollups()
+		if err != nil {
+			return fmt.Errorf("cant checkpoint rollups: %w", err)
+		}
+	}
+	return nil
+}
+
+// rollup extends every tier with the buckets completed by now, the first
+// from raw samples and the others from the tier before, then drops buckets
+// past the tier's retention. Caller must hold mu.
+func (db *DB) rollup(now time.Time, tiers []model.Tier) error {
+	var records []rollupRecord
+	updated := make(map[string]map[time.Duration][]model.Rollup)
+	for key, s := range db.series {
+		var src []model.Rollup
+		for i, tier := range tiers {
+			rollups := s.rollups[tier.Resolution]
+			var from time.Time
+			if len(rollups) > 0 {
+				from = rollups[len(rollups)-1].Time.Add(tier.Resolution)
+			}
+			if i == 0 {
+				samples, err := db.since(s, from.UnixMilli())
+				if err != nil {
+					return fmt.Errorf("series %s: %w", key, err)
+				}
+				src = make([]model.Rollup, 0, len(samples))
+				for _, p := range samples {
+					src = append(src, model.RollupOf(p))
+				}
+			}
+			added := model.Downsample(src, tier.Resolution, from, now.Truncate(tier.Resolution))
+			if len(added) > 0 {
+				records = append(records, rollupRecord{Op: opRollup, Key: key, Res: tier.Resolution, Rollups: added})
+				rollups = append(rollups[:len(rollups):len(rollups)], added...)
+			}
+			if tier.Retention > 0 {
+				cut := now.Add(-tier.Retention).UnixMilli()
+				if kept := trimRollups(rollups, cut); len(kept) < len(rollups) {
+					records = append(records, rollupRecord{Op: opTrim, Key: key, Res: tier.Resolution, Before: cut})
+					rollups = kept
+				}
+			}
+			if updated[key] == nil {
+				updated[key] = make(map[time.Duration][]model.Rollup, len(tiers))
+			}
+			updated[key][tier.Resolution] = rollups
+			src = rollups
+		}
+	}
+	if len(records) > 0 {
+		err := db.writeRollups(records...)
+		if err != nil {
+			return err
+		}
+	}
+	for key, rs := range updated {
+		db.series[key].rollups = rs
+	}
+	return nil
+}
+
+// trim drops history before the cut from every series, recording it in
+// the index and the WAL so it stays dropped after a reopen. Caller must
+// hold mu.
+func (db *DB) trim(before int64) error {
+	var (
+		index []indexRecord
+		wal   []walRecord
+	)
+	for key, s := range db.series {
+		if len(trimChunks(s.chunks, before)) < len(s.chunks) {
+			index = append(index, indexRecord{Op: opTrim, Key: key, Before: before})
+		}
+		if len(trimHead(s.head, before)) < len(s.head) {
+			wal = append(wal, walRecord{Op: opTrim, Key: key, Before: before})
+		}
+	}
+	if len(index) > 0 {
+		err := db.writeIndex(index...)
+		if err != nil {
+			return err
+		}
+	}
+	if len(wal) > 0 {
+		err := db.writeWAL(wal...)
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range db.series {
+		chunks := trimChunks(s.chunks, before)
+		for _, ref := range s.chunks[:len(s.chunks)-len(chunks)] {
+			db.dead += ref.Len
+		}
+		s.chunks = chunks
+		s.head = trimHead(s.head, before)
+	}
+	return nil
+}
+
+// rewrite copies the live chunks into a new generation, merging the chunks
+// of each series into larger ones. Caller must hold mu.
+func (db *DB) rewrite() error {
+	gen := db.gen + 1
+	chunks, err := os.Create(db.chunksPath(gen))
+	if err != nil {
+		return err
+	}
+	var (
+		size    int64
+		index   [][]byte
+		updated = make(map[string][]chunkRef, len(db.series))
+	)
+	fail := func(err error) error {
+		chunks.Close()
+		return errors.Join(err, os.Remove(db.chunksPath(gen)), os.Remove(db.indexPath(gen)))
+	}
+	for key, s := range db.series {
+		var samples []model.Sample
+		for _, ref := range s.chunks {
+			part, err := db.readChunk(ref)
+			if err != nil {
+				return fail(fmt.Errorf("series %s: %w", key, err))
+			}
+			samples = append(samples, part...)
+		}
+		for len(samples) > 0 {
+			n := min(len(samples), compactedSamples)
+			ref, err := db.appendChunk(chunks, &size, samples[:n])
+			if err != nil {
+				return fail(err)
+			}
+			payload, err := json.Marshal(indexRecord{Op: opChunk, Key: key, Ref: &ref})
+			if err != nil {
+				return fail(err)
+			}
+			index = append(index, payload)
+			updated[key] = append(updated[key], ref)
+			samples = samples[n:]
+		}
+	}
+	err = chunks.Sync()
+	if err == nil {
+		err = writeLog(db.indexPath(gen), index)
+	}
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(db.dir, currentName), []byte(strconv.Itoa(gen)))
+	}
+	if err != nil {
+		return fail(err)
+	}
+	indexFile, err := os.OpenFile(db.indexPath(gen), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		chunks.Close()
+		return err
+	}
+
+	db.chunks.Close()
+	db.index.Close()
+	os.Remove(db.chunksPath(db.gen))
+	os.Remove(db.indexPath(db.gen))
+	db.gen, db.chunks, db.index = gen, chunks, indexFile
+	db.chunksSize, db.dead = size, 0
+	for key, s := range db.series {
+		s.chunks = updated[key]
+	}
+	db.log.Infof("rewrote chunks into generation %d, %d bytes", gen, size)
+	return nil
+}
+
+// checkpointWAL replaces the WAL with the current state: one put per
+// series followed by its head samples. Caller must hold mu.
+func (db *DB) checkpointWAL() error {
+	var records [][]byte
+	for key, s := range db.series {
+		m := s.metric
+		rs := []walRecord{{Op: opPut, Key: key, Metric: &m}}
+		for i := range s.head {
+			rs = append(rs, walRecord{Op: opSample, Key: key, Sample: &s.head[i]})
+		}
+		for _, r := range rs {
+			payload, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			records = append(records, payload)
+		}
+	}
+	// The new WAL no longer holds the samples cut into chunks, so they
+	// must be on disk before it replaces the old one.
+	err := db.chunks.Sync()
+	if err == nil {
+		err = db.index.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("cant sync chunks: %w", err)
+	}
+	path := filepath.Join(db.dir, walName)
+	err = writeLog(path, records)
+	if err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	db.wal.Close()
+	db.wal = wal
+	db.walSize, _ = wal.Seek(0, io.SeekEnd)
+	db.checkpoint = db.walSize
+	return nil
+}
+
+// checkpointRollups replaces the rollups log with one record per series
+// and tier. Caller must hold mu.
+func (db *DB) checkpointRollups() error {
+	var records [][]byte
+	for key, s := range db.series {
+		for res, rollups := range s.rollups {
+			if len(rollups) == 0 {
+				continue
+			}
+			payload, err := json.Marshal(rollupRecord{Op: opRollup, Key: key, Res: res, Rollups: rollups})
+			if err != nil {
+				return err
+			}
+			records = append(records, payload)
+		}
+	}
+	path := filepath.Join(db.dir, rollupsName)
+	err := writeLog(path, records)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	db.rollups.Close()
+	db.rollups = f
+	db.rollupsSize, _ = f.Seek(0, io.SeekEnd)
+	db.rollupsCheckpoint = db.rollupsSize
+	return nil
+}
+
+func (db *DB) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (db *DB) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, f := range []*os.File{db.wal, db.index, db.chunks, db.rollups} {
+		if f == nil {
+			continue
+		}
+		if db.readOnly {
+			f.Close()
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			db.log.Errorf("cant sync %s: %v", f.Name(), err)
+		}
+		f.Close()
+	}
+}
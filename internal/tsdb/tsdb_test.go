@@ -0,0 +1,360 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/dump"
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/randomtoy/gometrics/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func gauge(id string, v float64) model.Metric {
+	return model.Metric{ID: id, Type: model.Gauge, Value: &v}
+}
+
+func TestDB(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	dir := t.TempDir()
+
+	db, err := Open(l, dir)
+	require.NoError(t, err)
+	start := time.Now()
+	for i := 0; i < headSamples+10; i++ {
+		_, err := db.UpdateMetric(ctx, gauge("Alloc", float64(i)))
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	delta := int64(3)
+	other := tenant.WithTenant(ctx, "other")
+	require.NoError(t, db.UpdateMetricBatch(other, []model.Metric{
+		{ID: "PollCount", Type: model.Counter, Delta: &delta},
+		{ID: "PollCount", Type: model.Counter, Delta: &delta},
+	}))
+	_, err = db.UpdateMetric(ctx, model.Metric{ID: "Alloc", Type: model.Counter, Delta: &delta})
+	assert.ErrorIs(t, err, model.ErrTypeConflict)
+	assert.Len(t, db.series[tenant.Key(tenant.Default, "Alloc")].chunks, 1)
+	db.Close()
+
+	db, err = Open(l, dir)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+
+	samples, err := db.GetSamples(ctx, "Alloc", start, time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, headSamples+10)
+	assert.Equal(t, float64(headSamples+9), samples[len(samples)-1].Value)
+
+	m, err := db.GetMetric(other, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *m.Delta)
+
+	m, err = db.ResetCounter(other, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), *m.Delta)
+	counts, err := db.GetSamples(other, "PollCount", start, time.Now())
+	require.NoError(t, err)
+	last := counts[len(counts)-1]
+	assert.Equal(t, 0.0, last.Value)
+	assert.True(t, m.UpdatedAt.Equal(last.Time))
+	tenants, _ := db.ListTenants(ctx)
+	assert.Equal(t, []string{tenant.Default, "other"}, tenants)
+
+	t.Run("Delete and recreate", func(t *testing.T) {
+		require.NoError(t, db.DeleteMetric(ctx, "Alloc"))
+		_, err := db.UpdateMetric(ctx, gauge("Alloc", 42))
+		require.NoError(t, err)
+		db.Close()
+
+		db, err = Open(l, dir)
+		require.NoError(t, err)
+		samples, err := db.GetSamples(ctx, "Alloc", start, time.Now())
+		require.NoError(t, err)
+		require.Len(t, samples, 1)
+		assert.Equal(t, float64(42), samples[0].Value)
+	})
+
+	t.Run("Compaction rewrites live chunks", func(t *testing.T) {
+		require.NoError(t, db.Compact(ctx, time.Now(), model.Retention{}))
+		assert.Equal(t, 1, db.gen)
+		assert.Zero(t, db.dead)
+		_, err := os.Stat(filepath.Join(dir, "chunks-0.dat"))
+		assert.True(t, os.IsNotExist(err))
+		db.Close()
+
+		db, err = Open(l, dir)
+		require.NoError(t, err)
+		m, err := db.GetMetric(ctx, "Alloc")
+		require.NoError(t, err)
+		assert.Equal(t, float64(42), *m.Value)
+	})
+
+	t.Run("Torn WAL tail is cut", func(t *testing.T) {
+		db.Close()
+		f, err := os.OpenFile(filepath.Join(dir, walName), os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = f.Write([]byte{0, 0, 1})
+		require.NoError(t, err)
+		f.Close()
+
+		db, err = Open(l, dir)
+		require.NoError(t, err)
+		_, err = db.UpdateMetric(ctx, gauge("Alloc", 43))
+		require.NoError(t, err)
+		db.Close()
+
+		db, err = Open(l, dir)
+		require.NoError(t, err)
+		m, err := db.GetMetric(ctx, "Alloc")
+		require.NoError(t, err)
+		assert.Equal(t, float64(43), *m.Value)
+	})
+}
+
+func TestDB_Retention(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	dir := t.TempDir()
+	db, err := Open(l, dir)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2*headSamples; i++ {
+		_, err := db.write(tenant.Default, []model.Metric{gauge("Alloc", float64(i))}, base.Add(time.Duration(i)*time.Minute))
+		require.NoError(t, err)
+	}
+
+	r := model.Retention{Raw: time.Hour, Tiers: []model.Tier{
+		{Resolution: time.Minute, Retention: 5 * time.Hour},
+		{Resolution: time.Hour},
+	}}
+	require.NoError(t, db.Compact(ctx, base.Add(4*time.Hour), r))
+	samples, err := db.GetSamples(ctx, "Alloc", base, base.Add(4*time.Hour))
+	require.NoError(t, err)
+	// The first chunk ends before the cut and is dropped as a whole.
+	assert.Len(t, samples, headSamples)
+
+	check := func(minutes int) {
+		t.Helper()
+		rollups, err := db.GetRollups(ctx, "Alloc", time.Minute, base, base.Add(4*time.Hour))
+		require.NoError(t, err)
+		assert.Len(t, rollups, minutes)
+		rollups, err = db.GetRollups(ctx, "Alloc", time.Hour, base, base.Add(4*time.Hour))
+		require.NoError(t, err)
+		require.Len(t, rollups, 4)
+		assert.True(t, base.Equal(rollups[0].Time))
+		rollups[0].Time = base
+		assert.Equal(t, model.Rollup{Time: base, Min: 0, Max: 59, Avg: 29.5, Last: 59, Count: 60}, rollups[0])
+	}
+	check(2 * headSamples)
+
+	// Rollups outlive the raw samples they were built from, and a reopen.
+	require.NoError(t, db.Compact(ctx, base.Add(7*time.Hour), r))
+	samples, err = db.GetSamples(ctx, "Alloc", base, base.Add(4*time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+	check(2*headSamples - 2*60)
+	db.Close()
+
+	db, err = Open(l, dir)
+	require.NoError(t, err)
+	check(2*headSamples - 2*60)
+
+	// Deleted series don't come back with their rollups.
+	require.NoError(t, db.DeleteMetric(ctx, "Alloc"))
+	_, err = db.UpdateMetric(ctx, gauge("Alloc", 1))
+	require.NoError(t, err)
+	db.Close()
+	db, err = Open(l, dir)
+	require.NoError(t, err)
+	rollups, err := db.GetRollups(ctx, "Alloc", time.Hour, base, base.Add(4*time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, rollups)
+}
+
+func TestDB_RetentionSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	dir := t.TempDir()
+	db, err := Open(l, dir)
+	require.NoError(t, err)
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	old := headSamples + 10
+	for i := 0; i < old; i++ {
+		_, err := db.write(tenant.Default, []model.Metric{gauge("Old", float64(i))}, base.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+	recent := base.Add(2 * time.Hour)
+	for i := 0; i < 4*headSamples; i++ {
+		_, err := db.write(tenant.Default, []model.Metric{gauge("Recent", float64(i))}, recent.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+
+	// Too little of the chunk file is expired to rewrite it, only the trim
+	// records keep the expired chunk and head dropped.
+	require.NoError(t, db.Compact(ctx, recent.Add(30*time.Minute), model.Retention{Raw: time.Hour}))
+	assert.Equal(t, 0, db.gen)
+	check := func() {
+		samples, err := db.GetSamples(ctx, "Old", base, recent)
+		require.NoError(t, err)
+		assert.Empty(t, samples)
+		samples, err = db.GetSamples(ctx, "Recent", recent, recent.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Len(t, samples, 4*headSamples)
+	}
+	check()
+	db.Close()
+
+	db, err = Open(l, dir)
+	require.NoError(t, err)
+	defer db.Close()
+	check()
+	m, err := db.GetMetric(ctx, "Old")
+	require.NoError(t, err)
+	assert.Equal(t, float64(old-1), *m.Value)
+}
+
+func TestDB_TornFrame(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	dir := t.TempDir()
+	db, err := Open(l, dir)
+	require.NoError(t, err)
+	_, err = db.UpdateMetric(ctx, gauge("Alloc", 1))
+	require.NoError(t, err)
+	db.Close()
+
+	path := filepath.Join(dir, walName)
+	intact, err := os.Stat(path)
+	require.NoError(t, err)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	// A header claiming 4GiB, followed by a few bytes.
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db, err = Open(l, dir)
+	require.NoError(t, err)
+	defer db.Close()
+	m, err := db.GetMetric(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), *m.Value)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, intact.Size(), info.Size())
+}
+
+func TestDB_BackupRestore(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+
+	src, err := Open(l, t.TempDir())
+	require.NoError(t, err)
+	defer src.Close()
+	for i := 0; i < headSamples+5; i++ {
+		_, err := src.UpdateMetric(ctx, gauge("Alloc", float64(i)))
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	hour := time.Now().Truncate(time.Hour).UTC()
+	rollup := model.Rollup{Time: hour, Min: 0, Max: 4, Avg: 2, Last: 4, Count: 5}
+	require.NoError(t, src.PutRollups(ctx, "Alloc", map[time.Duration][]model.Rollup{time.Hour: {rollup}}))
+	var buf bytes.Buffer
+	w, err := dump.NewWriter(dump.FormatJSONL, &buf)
+	require.NoError(t, err)
+	require.NoError(t, src.Backup(ctx, w))
+
+	dir := t.TempDir()
+	dst, err := Open(l, dir)
+	require.NoError(t, err)
+	_, err = dst.UpdateMetric(ctx, gauge("Frees", 1))
+	require.NoError(t, err)
+
+	r, err := dump.NewReader(dump.FormatJSONL, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	n, err := dst.Restore(ctx, r, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	dst.Close()
+
+	// The restore survives a reopen.
+	dst, err = Open(l, dir)
+	require.NoError(t, err)
+	defer dst.Close()
+	metrics, err := dst.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, float64(headSamples+4), *metrics["Alloc"].Value)
+	samples, err := dst.GetSamples(ctx, "Alloc", time.Time{}, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, samples, headSamples+5)
+	rollups, err := dst.GetAllRollups(ctx, "Alloc")
+	require.NoError(t, err)
+	require.Len(t, rollups[time.Hour], 1)
+	assert.True(t, hour.Equal(rollups[time.Hour][0].Time))
+	assert.Equal(t, int64(5), rollups[time.Hour][0].Count)
+}
+
+func TestDB_OpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+	l := zap.NewNop().Sugar()
+	dir := t.TempDir()
+
+	_, err := OpenReadOnly(l, filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+
+	db, err := Open(l, dir)
+	require.NoError(t, err)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < headSamples+1; i++ {
+		_, err := db.write(tenant.Default, []model.Metric{gauge("Alloc", float64(i))}, base.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+	db.Close()
+	f, err := os.OpenFile(filepath.Join(dir, walName), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1})
+	require.NoError(t, err)
+	f.Close()
+	files := func() map[string][]byte {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		res := make(map[string][]byte)
+		for _, e := range entries {
+			b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			require.NoError(t, err)
+			res[e.Name()] = b
+		}
+		return res
+	}
+	before := files()
+
+	db, err = OpenReadOnly(l, dir)
+	require.NoError(t, err)
+	m, err := db.GetMetric(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(headSamples), *m.Value)
+	samples, err := db.GetSamples(ctx, "Alloc", time.Time{}, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, samples, headSamples+1)
+
+	_, err = db.UpdateMetric(ctx, gauge("Alloc", 1))
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, db.DeleteMetric(ctx, "Alloc"), ErrReadOnly)
+	assert.ErrorIs(t, db.Compact(ctx, time.Now(), model.Retention{}), ErrReadOnly)
+	db.Close()
+
+	// The torn tail is still there.
+	assert.Equal(t, before, files())
+}
@@ -0,0 +1,93 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/randomtoy/gometrics/internal/model"
+)
+
+const DefaultMaxNameLength = 255
+
+var nameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.:-]*$`)
+
+var (
+	ErrInvalidName  = errors.New("invalid metric name")
+	ErrInvalidType  = errors.New("invalid metric type")
+	ErrInvalidValue = errors.New("invalid metric value")
+)
+
+type Policy struct {
+	MaxNameLength int
+	// AllowNonFinite lets NaN and ±Inf gauges through.
+	AllowNonFinite bool
+}
+
+func DefaultPolicy() Policy {
+	return Policy{MaxNameLength: DefaultMaxNameLength}
+}
+
+type ItemError struct {
+	Index   int    `json:"index"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+func (p Policy) Name(id string) error {
+	if id == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidName)
+	}
+	if p.MaxNameLength > 0 && len(id) > p.MaxNameLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidName, p.MaxNameLength)
+	}
+	if !nameRe.MatchString(id) {
+		return fmt.Errorf("%w: %q must match %s", ErrInvalidName, id, nameRe)
+	}
+	return nil
+}
+
+func (p Policy) Type(t model.MetricType) error {
+	if t != model.Gauge && t != model.Counter {
+		return fmt.Errorf("%w: %q", ErrInvalidType, t)
+	}
+	return nil
+}
+
+func (p Policy) Metric(m model.Metric) error {
+	err := p.Name(m.ID)
+	if err != nil {
+		return err
+	}
+	err = p.Type(m.Type)
+	if err != nil {
+		return err
+	}
+	switch m.Type {
+	case model.Gauge:
+		if m.Value == nil || m.Delta != nil {
+			return fmt.Errorf("%w: gauge needs value and no delta", ErrInvalidValue)
+		}
+		if !p.AllowNonFinite && (math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0)) {
+			return fmt.Errorf("%w: %v is not finite", ErrInvalidValue, *m.Value)
+		}
+	case model.Counter:
+		if m.Delta == nil || m.Value != nil {
+			return fmt.Errorf("%w: counter needs delta and no value", ErrInvalidValue)
+		}
+	}
+	return nil
+}
+
+// Batch validates every entry and reports all failures at once.
+func (p Policy) Batch(metrics []model.Metric) []ItemError {
+	var errs []ItemError
+	for i, m := range metrics {
+		err := p.Metric(m)
+		if err != nil {
+			errs = append(errs, ItemError{Index: i, ID: m.ID, Message: err.Error()})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,61 @@
+package validation
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/randomtoy/gometrics/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Metric(t *testing.T) {
+	p := DefaultPolicy()
+	value := float64(1)
+	nan := math.NaN()
+	delta := int64(1)
+
+	tests := []struct {
+		name   string
+		metric model.Metric
+		err    error
+	}{
+		{"Valid gauge", model.Metric{ID: "Alloc", Type: model.Gauge, Value: &value}, nil},
+		{"Valid counter", model.Metric{ID: "PollCount", Type: model.Counter, Delta: &delta}, nil},
+		{"Empty name", model.Metric{Type: model.Gauge, Value: &value}, ErrInvalidName},
+		{"Bad charset", model.Metric{ID: "a/b", Type: model.Gauge, Value: &value}, ErrInvalidName},
+		{"Too long", model.Metric{ID: strings.Repeat("a", 256), Type: model.Gauge, Value: &value}, ErrInvalidName},
+		{"Unknown type", model.Metric{ID: "Alloc", Type: "histogram", Value: &value}, ErrInvalidType},
+		{"Gauge with delta", model.Metric{ID: "Alloc", Type: model.Gauge, Delta: &delta}, ErrInvalidValue},
+		{"Counter with value", model.Metric{ID: "PollCount", Type: model.Counter, Value: &value}, ErrInvalidValue},
+		{"NaN gauge", model.Metric{ID: "Alloc", Type: model.Gauge, Value: &nan}, ErrInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Metric(tt.metric)
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	t.Run("NaN allowed by policy", func(t *testing.T) {
+		p := Policy{AllowNonFinite: true}
+		assert.NoError(t, p.Metric(model.Metric{ID: "Alloc", Type: model.Gauge, Value: &nan}))
+	})
+}
+
+func TestPolicy_Batch(t *testing.T) {
+	value := float64(1)
+	errs := DefaultPolicy().Batch([]model.Metric{
+		{ID: "Alloc", Type: model.Gauge, Value: &value},
+		{ID: "", Type: model.Gauge, Value: &value},
+		{ID: "Sys", Type: "unknown"},
+	})
+	assert.Len(t, errs, 2)
+	assert.Equal(t, 1, errs[0].Index)
+	assert.Equal(t, 2, errs[1].Index)
+	assert.Equal(t, "Sys", errs[1].ID)
+}
@@ -0,0 +1,221 @@
+// Package client reports metrics from Go services to a gometrics server
+// without running the agent.
+//
+//	c := client.New("localhost:8080", client.WithKey(key))
+//	defer c.Close()
+//	orders := c.Counter("OrdersPlaced")
+//	queue := c.Gauge("QueueDepth")
+//	orders.Inc()
+//	queue.Set(float64(len(jobs)))
+//
+// Writes are cheap and only touch memory. A background loop sends them as
+// one batch every flush interval: the last value of each gauge and the sum
+// of counter increments since the previous batch.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DefaultFlushInterval = 10 * time.Second
+
+var ErrClosed = errors.New("client is closed")
+
+// WithFlushInterval sets how often batches are sent.
+func WithFlushInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.flushInterval = d
+	}
+}
+
+// WithErrorHandler receives the errors of background flushes, which are
+// otherwise dropped. Metrics of a failed batch are kept for the next one.
+func WithErrorHandler(f func(error)) Option {
+	return func(o *options) {
+		o.onError = f
+	}
+}
+
+type Client struct {
+	sender *Sender
+
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64
+	handles  map[string]any
+	closed   bool
+
+	// sending serializes flushes so batches arrive in order.
+	sending sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// New starts a client sending to the server at addr, either host:port or
+// a base URL. Close it to send what is left.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{
+		sender:   NewSender(addr, opts...),
+		gauges:   make(map[string]float64),
+		counters: make(map[string]int64),
+		handles:  make(map[string]any),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	interval := c.sender.opts.flushInterval
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			err := c.Flush(context.Background())
+			if err != nil {
+				c.sender.opts.onError(err)
+			}
+		}
+	}
+}
+
+type Gauge struct {
+	c    *Client
+	name string
+}
+
+// Set records v as the value sent with the next batch.
+func (g *Gauge) Set(v float64) {
+	g.c.mu.Lock()
+	defer g.c.mu.Unlock()
+	g.c.gauges[g.name] = v
+}
+
+type Counter struct {
+	c    *Client
+	name string
+}
+
+// Add adds n to the increment sent with the next batch.
+func (ctr *Counter) Add(n int64) {
+	ctr.c.mu.Lock()
+	defer ctr.c.mu.Unlock()
+	ctr.c.counters[ctr.name] += n
+}
+
+func (ctr *Counter) Inc() {
+	ctr.Add(1)
+}
+
+// Gauge returns the gauge called name. The same handle is returned for the
+// same name. It panics if name is already a counter, as the server would
+// refuse one of them.
+func (c *Client) Gauge(name string) *Gauge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch h := c.handles[name].(type) {
+	case *Gauge:
+		return h
+	case *Counter:
+		panic(fmt.Sprintf("client: %s is a counter, it can't be used as a gauge", name))
+	}
+	g := &Gauge{c: c, name: name}
+	c.handles[name] = g
+	return g
+}
+
+// Counter returns the counter called name. The same handle is returned for
+// the same name. It panics if name is already a gauge.
+func (c *Client) Counter(name string) *Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch h := c.handles[name].(type) {
+	case *Counter:
+		return h
+	case *Gauge:
+		panic(fmt.Sprintf("client: %s is a gauge, it can't be used as a counter", name))
+	}
+	ctr := &Counter{c: c, name: name}
+	c.handles[name] = ctr
+	return ctr
+}
+
+// take empties the pending values into a batch. Caller must hold mu.
+func (c *Client) take() []Metric {
+	batch := make([]Metric, 0, len(c.gauges)+len(c.counters))
+	for name, v := range c.gauges {
+		batch = append(batch, Metric{ID: name, Type: TypeGauge, Value: &v})
+	}
+	for name, d := range c.counters {
+		if d != 0 {
+			batch = append(batch, Metric{ID: name, Type: TypeCounter, Delta: &d})
+		}
+	}
+	c.gauges = make(map[string]float64)
+	c.counters = make(map[string]int64)
+	return batch
+}
+
+// restore puts a failed batch back, keeping gauges set since and adding
+// counter increments to the ones made since. Caller must hold mu.
+func (c *Client) restore(batch []Metric) {
+	for _, m := range batch {
+		switch m.Type {
+		case TypeGauge:
+			if _, ok := c.gauges[m.ID]; !ok {
+				c.gauges[m.ID] = *m.Value
+			}
+		case TypeCounter:
+			c.counters[m.ID] += *m.Delta
+		}
+	}
+}
+
+// Flush sends the pending values now. On failure they are kept for the
+// next flush.
+func (c *Client) Flush(ctx context.Context) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+
+	c.mu.Lock()
+	batch := c.take()
+	c.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	err := c.sender.Send(ctx, batch)
+	if err != nil {
+		c.mu.Lock()
+		c.restore(batch)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Close stops the background loop and sends what is pending. Values
+// written after Close are never sent.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.stop)
+	<-c.done
+	return c.Flush(context.Background())
+}
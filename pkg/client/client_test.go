@@ -0,0 +1,142 @@
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer records the batches posted to /updates/ and answers with the
+// queued statuses, then 200.
+type fakeServer struct {
+	t        *testing.T
+	key      string
+	mu       sync.Mutex
+	batches  [][]Metric
+	statuses []int
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(f.t, "/updates/", r.URL.Path)
+	assert.Equal(f.t, "gzip", r.Header.Get("Content-Encoding"))
+	gz, err := gzip.NewReader(r.Body)
+	require.NoError(f.t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(f.t, err)
+	if f.key != "" {
+		assert.Equal(f.t, crypto.ComputeHMACSHA256(string(data), f.key), r.Header.Get("HashSHA256"))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		return
+	}
+	var batch []Metric
+	require.NoError(f.t, json.Unmarshal(data, &batch))
+	f.batches = append(f.batches, batch)
+}
+
+// values flattens the received batches into the totals the server would
+// store.
+func (f *fakeServer) values() map[string]float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := make(map[string]float64)
+	for _, batch := range f.batches {
+		for _, m := range batch {
+			if m.Type == TypeCounter {
+				res[m.ID] += float64(*m.Delta)
+			} else {
+				res[m.ID] = *m.Value
+			}
+		}
+	}
+	return res
+}
+
+func TestClient(t *testing.T) {
+	fake := &fakeServer{t: t, key: "secret"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := New(srv.URL, WithKey("secret"), WithFlushInterval(time.Hour))
+	orders := c.Counter("Orders")
+	orders.Inc()
+	orders.Add(4)
+	assert.Same(t, orders, c.Counter("Orders"))
+	c.Gauge("Queue").Set(3)
+	c.Gauge("Queue").Set(7)
+	require.NoError(t, c.Flush(context.Background()))
+
+	// Nothing pending: no request.
+	require.NoError(t, c.Flush(context.Background()))
+	orders.Inc()
+	require.NoError(t, c.Close())
+	assert.ErrorIs(t, c.Close(), ErrClosed)
+
+	assert.Len(t, fake.batches, 2)
+	assert.Equal(t, map[string]float64{"Orders": 6, "Queue": 7}, fake.values())
+}
+
+func TestClient_TypeConflict(t *testing.T) {
+	c := New("localhost:0", WithFlushInterval(time.Hour))
+	defer c.Close()
+
+	c.Counter("Orders")
+	c.Gauge("Queue")
+	assert.PanicsWithValue(t, "client: Orders is a counter, it can't be used as a gauge", func() { c.Gauge("Orders") })
+	assert.PanicsWithValue(t, "client: Queue is a gauge, it can't be used as a counter", func() { c.Counter("Queue") })
+}
+
+func TestClient_KeepsFailedBatch(t *testing.T) {
+	fake := &fakeServer{t: t, statuses: []int{http.StatusInternalServerError}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := New(srv.URL, WithFlushInterval(time.Hour))
+	c.Counter("Orders").Add(2)
+	c.Gauge("Queue").Set(1)
+	assert.Error(t, c.Flush(context.Background()))
+
+	c.Counter("Orders").Add(3)
+	c.Gauge("Queue").Set(5)
+	require.NoError(t, c.Close())
+	assert.Equal(t, map[string]float64{"Orders": 5, "Queue": 5}, fake.values())
+}
+
+func TestSender_RetriesRateLimit(t *testing.T) {
+	fake := &fakeServer{t: t, statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	v := 1.5
+	err := NewSender(srv.URL).Send(context.Background(), []Metric{{ID: "Alloc", Type: TypeGauge, Value: &v}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 1.5}, fake.values())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	d, ok := parseRetryAfter("3")
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, d)
+	_, ok = parseRetryAfter("")
+	assert.False(t, ok)
+	d, ok = parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Zero(t, d)
+}
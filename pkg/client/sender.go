@@ -0,0 +1,203 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/randomtoy/gometrics/internal/crypto"
+)
+
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+)
+
+// Metric is one entry of a batch in the server's JSON format. Gauges carry
+// Value, counters carry the Delta to add.
+type Metric struct {
+	ID    string   `json:"id"`
+	Type  string   `json:"type"`
+	Value *float64 `json:"value,omitempty"`
+	Delta *int64   `json:"delta,omitempty"`
+}
+
+// StatusError is returned by Send when the server refuses a batch.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server answered %s: %s", e.Status, e.Body)
+}
+
+// Rejected reports whether the server refused the batch itself, so sending
+// it again can't succeed: a 4xx other than 429.
+func (e *StatusError) Rejected() bool {
+	return e.StatusCode >= http.StatusBadRequest && e.StatusCode < http.StatusInternalServerError &&
+		e.StatusCode != http.StatusTooManyRequests
+}
+
+// attempts is how many times a batch is tried before Send gives up.
+const attempts = 4
+
+type options struct {
+	key           string
+	tenant        string
+	token         string
+	httpClient    *http.Client
+	flushInterval time.Duration
+	onError       func(error)
+}
+
+type Option func(*options)
+
+// WithKey signs every batch with HMAC-SHA256 in the HashSHA256 header.
+func WithKey(key string) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithTenant sends the X-Tenant-ID header. Servers configured with tenant
+// tokens ignore it, use WithToken there.
+func WithTenant(tenant string) Option {
+	return func(o *options) {
+		o.tenant = tenant
+	}
+}
+
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// Sender posts batches to the /updates/ endpoint, gzip'd and optionally
+// signed, retrying network errors and rate limiting.
+type Sender struct {
+	url  string
+	opts options
+}
+
+// NewSender returns a Sender for the server at addr, either host:port or a
+// base URL.
+func NewSender(addr string, opts ...Option) *Sender {
+	s := &Sender{opts: newOptions(opts)}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	s.url = strings.TrimSuffix(addr, "/") + "/updates/"
+	return s
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		flushInterval: DefaultFlushInterval,
+		onError:       func(error) {},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Send posts metrics as one batch. Network errors and 429 responses are
+// retried with backoff, honouring Retry-After; other failures are returned
+// right away, responses as a *StatusError.
+func (s *Sender) Send(ctx context.Context, metrics []Metric) error {
+	jsonData, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	_, err = gzipWriter.Write(jsonData)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compress data: %w", err)
+	}
+	var hash string
+	if s.opts.key != "" {
+		hash = crypto.ComputeHMACSHA256(string(jsonData), s.opts.key)
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return fmt.Errorf("can't wrap request: %w", err)
+		}
+		if hash != "" {
+			req.Header.Set("HashSHA256", hash)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		if s.opts.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.opts.token)
+		}
+		if s.opts.tenant != "" {
+			req.Header.Set("X-Tenant-ID", s.opts.tenant)
+		}
+
+		backoff := time.Duration((attempt-1)*2+1) * time.Second
+		resp, err := s.opts.httpClient.Do(req)
+		if err == nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode < http.StatusMultipleChoices:
+				return nil
+			case resp.StatusCode != http.StatusTooManyRequests:
+				return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(bytes.TrimSpace(body))}
+			}
+			err = fmt.Errorf("server is rate limiting us")
+			if retry, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				backoff = retry
+			}
+		}
+		lastErr = err
+		if attempt == attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+	return fmt.Errorf("failed to send metrics after retries: %w", lastErr)
+}
+
+// parseRetryAfter accepts both forms allowed by RFC 9110: delay in seconds
+// and an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}